@@ -0,0 +1,447 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"backend/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// AttributeHandler manages the typed attributes defined on categories and
+// the values products have for them.
+type AttributeHandler struct {
+	DB     *gorm.DB
+	Logger *log.Logger
+}
+
+type AttributeRequest struct {
+	Name    string   `json:"name" binding:"required"`
+	Type    string   `json:"type" binding:"required,oneof=enum number boolean"`
+	Unit    string   `json:"unit"`
+	Options []string `json:"options"`
+}
+
+// AttributeUpdateRequest renames an attribute or adds enum options. The type
+// of an attribute cannot change once products use it.
+type AttributeUpdateRequest struct {
+	Name    *string  `json:"name"`
+	Unit    *string  `json:"unit"`
+	Options []string `json:"options"`
+}
+
+// ProductAttributesRequest maps attribute ids to values: a string for enum
+// attributes, a number or a boolean. A null value clears the attribute.
+type ProductAttributesRequest struct {
+	Values map[string]json.RawMessage `json:"values" binding:"required"`
+}
+
+// categoryAncestry returns the ids of a category and all of its ancestors,
+// whose attributes all apply to products in the category.
+func (h *AttributeHandler) categoryAncestry(categoryID int) ([]int, error) {
+	sqlDB, err := h.DB.DB()
+	if err != nil {
+		return nil, err
+	}
+	tree, err := loadCategoryTree(sqlDB)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int
+	for _, crumb := range tree.breadcrumbs(categoryID) {
+		ids = append(ids, crumb.ID)
+	}
+	return ids, nil
+}
+
+// pruneAttributeValues deletes the attribute values that no longer apply to
+// products in a category, or to just the given ones among them, because the
+// attribute is defined outside the category and its ancestors. It runs when
+// products or categories move.
+func pruneAttributeValues(db sqlExecer, tree *categoryTree, categoryID int, productIDs ...int) error {
+	query := `DELETE pav FROM product_attribute_values pav
+		JOIN products p ON p.id = pav.product_id
+		JOIN attributes a ON a.id = pav.attribute_id
+		WHERE p.catid = ?`
+	args := []interface{}{categoryID}
+	if len(productIDs) > 0 {
+		query += " AND p.id IN (" + strings.TrimSuffix(strings.Repeat("?,", len(productIDs)), ",") + ")"
+		for _, id := range productIDs {
+			args = append(args, id)
+		}
+	}
+	// The category itself is listed in case the tree predates it
+	applicable := []interface{}{categoryID}
+	for _, crumb := range tree.breadcrumbs(categoryID) {
+		applicable = append(applicable, crumb.ID)
+	}
+	query += " AND a.category_id NOT IN (" + strings.TrimSuffix(strings.Repeat("?,", len(applicable)), ",") + ")"
+	_, err := db.Exec(query, append(args, applicable...)...)
+	return err
+}
+
+func (h *AttributeHandler) loadAttributes(categoryIDs []int) ([]models.Attribute, error) {
+	attributes := []models.Attribute{}
+	err := h.DB.Preload("Options", func(db *gorm.DB) *gorm.DB {
+		return db.Order("position, id")
+	}).Where("category_id IN ?", categoryIDs).Order("position, id").Find(&attributes).Error
+	return attributes, err
+}
+
+// addOptions appends enum options to an attribute, skipping blanks and
+// values it already has.
+func addOptions(attr *models.Attribute, values []string) {
+	seen := make(map[string]bool)
+	for _, o := range attr.Options {
+		seen[strings.ToLower(o.Value)] = true
+	}
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if v == "" || seen[strings.ToLower(v)] {
+			continue
+		}
+		seen[strings.ToLower(v)] = true
+		attr.Options = append(attr.Options, models.AttributeOption{AttributeID: attr.ID, Value: v, Position: len(attr.Options)})
+	}
+}
+
+// ListCategoryAttributes returns the attributes that apply to a category,
+// including those inherited from its parent categories.
+func (h *AttributeHandler) ListCategoryAttributes(c *gin.Context) {
+	categoryID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid category ID"})
+		return
+	}
+
+	ids, err := h.categoryAncestry(categoryID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if len(ids) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Category not found"})
+		return
+	}
+
+	attributes, err := h.loadAttributes(ids)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	c.JSON(http.StatusOK, attributes)
+}
+
+// CreateAttribute defines a new attribute on a category. Enum attributes
+// need at least one option.
+func (h *AttributeHandler) CreateAttribute(c *gin.Context) {
+	categoryID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid category ID"})
+		return
+	}
+
+	var req AttributeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+
+	var count int64
+	if err := h.DB.Table("categories").Where("catid = ?", categoryID).Count(&count).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if count == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Category not found"})
+		return
+	}
+
+	var position int64
+	if err := h.DB.Model(&models.Attribute{}).Where("category_id = ?", categoryID).Count(&position).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	attr := models.Attribute{
+		CategoryID: categoryID,
+		Name:       strings.TrimSpace(req.Name),
+		Type:       req.Type,
+		Unit:       strings.TrimSpace(req.Unit),
+		Position:   int(position),
+	}
+	if attr.Type == models.AttributeEnum {
+		addOptions(&attr, req.Options)
+	}
+	if attr.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Attribute name is required"})
+		return
+	}
+	if attr.Type == models.AttributeEnum && len(attr.Options) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Enum attributes need at least one option"})
+		return
+	}
+	if attr.Type != models.AttributeEnum && len(req.Options) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Only enum attributes have options"})
+		return
+	}
+
+	if err := h.DB.Create(&attr).Error; err != nil {
+		h.Logger.Printf("Error creating attribute: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	c.JSON(http.StatusOK, attr)
+}
+
+// UpdateAttribute renames an attribute, changes its unit or adds options.
+func (h *AttributeHandler) UpdateAttribute(c *gin.Context) {
+	attributeID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid attribute ID"})
+		return
+	}
+
+	var req AttributeUpdateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+
+	var attr models.Attribute
+	err = h.DB.Preload("Options", func(db *gorm.DB) *gorm.DB {
+		return db.Order("position, id")
+	}).First(&attr, attributeID).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Attribute not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if req.Name != nil {
+		if attr.Name = strings.TrimSpace(*req.Name); attr.Name == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Attribute name is required"})
+			return
+		}
+	}
+	if req.Unit != nil {
+		attr.Unit = strings.TrimSpace(*req.Unit)
+	}
+	if len(req.Options) > 0 {
+		if attr.Type != models.AttributeEnum {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Only enum attributes have options"})
+			return
+		}
+		addOptions(&attr, req.Options)
+	}
+
+	if err := h.DB.Session(&gorm.Session{FullSaveAssociations: true}).Save(&attr).Error; err != nil {
+		h.Logger.Printf("Error updating attribute: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	c.JSON(http.StatusOK, attr)
+}
+
+// DeleteAttribute removes an attribute together with its options and every
+// product value for it.
+func (h *AttributeHandler) DeleteAttribute(c *gin.Context) {
+	attributeID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid attribute ID"})
+		return
+	}
+
+	var deleted int64
+	err = h.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("attribute_id = ?", attributeID).Delete(&models.ProductAttributeValue{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("attribute_id = ?", attributeID).Delete(&models.AttributeOption{}).Error; err != nil {
+			return err
+		}
+		res := tx.Delete(&models.Attribute{}, attributeID)
+		deleted = res.RowsAffected
+		return res.Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if deleted == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Attribute not found"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// DeleteAttributeOption removes an enum option no product uses any more.
+func (h *AttributeHandler) DeleteAttributeOption(c *gin.Context) {
+	optionID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid option ID"})
+		return
+	}
+
+	var inUse int64
+	if err := h.DB.Model(&models.ProductAttributeValue{}).Where("option_id = ?", optionID).Count(&inUse).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if inUse > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Option is still used by products"})
+		return
+	}
+
+	res := h.DB.Delete(&models.AttributeOption{}, optionID)
+	if res.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if res.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Option not found"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// attributeValue converts a JSON value into the value row for attr.
+func attributeValue(attr models.Attribute, raw json.RawMessage) (models.ProductAttributeValue, error) {
+	value := models.ProductAttributeValue{AttributeID: attr.ID}
+	switch attr.Type {
+	case models.AttributeEnum:
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return value, fmt.Errorf("%s must be one of its options", attr.Name)
+		}
+		for _, o := range attr.Options {
+			if strings.EqualFold(o.Value, strings.TrimSpace(s)) {
+				id := o.ID
+				value.OptionID = &id
+				return value, nil
+			}
+		}
+		return value, fmt.Errorf("%q is not an option of %s", s, attr.Name)
+	case models.AttributeNumber:
+		var n float64
+		if err := json.Unmarshal(raw, &n); err != nil {
+			return value, fmt.Errorf("%s must be a number", attr.Name)
+		}
+		value.NumberValue = &n
+	case models.AttributeBoolean:
+		var b bool
+		if err := json.Unmarshal(raw, &b); err != nil {
+			return value, fmt.Errorf("%s must be true or false", attr.Name)
+		}
+		value.BoolValue = &b
+	}
+	return value, nil
+}
+
+// SetProductAttributes sets or clears attribute values on a product. Only
+// attributes of the product's category and its ancestors can be set.
+func (h *AttributeHandler) SetProductAttributes(c *gin.Context) {
+	productID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid product ID"})
+		return
+	}
+
+	var req ProductAttributesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+
+	var categoryID int
+	err = h.DB.Table("products").Select("catid").Where("id = ?", productID).Row().Scan(&categoryID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	ancestry, err := h.categoryAncestry(categoryID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	applicable, err := h.loadAttributes(ancestry)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	byID := make(map[string]models.Attribute)
+	for _, attr := range applicable {
+		byID[strconv.Itoa(int(attr.ID))] = attr
+	}
+
+	var values []models.ProductAttributeValue
+	var cleared []uint
+	for key, raw := range req.Values {
+		attr, ok := byID[key]
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Attribute %s does not apply to this product's category", key)})
+			return
+		}
+		if string(raw) == "null" {
+			cleared = append(cleared, attr.ID)
+			continue
+		}
+		value, err := attributeValue(attr, raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		value.ProductID = uint(productID)
+		values = append(values, value)
+	}
+
+	err = h.DB.Transaction(func(tx *gorm.DB) error {
+		for _, value := range values {
+			cleared = append(cleared, value.AttributeID)
+		}
+		if len(cleared) > 0 {
+			if err := tx.Where("product_id = ? AND attribute_id IN ?", productID, cleared).Delete(&models.ProductAttributeValue{}).Error; err != nil {
+				return err
+			}
+		}
+		if len(values) > 0 {
+			return tx.Create(&values).Error
+		}
+		return nil
+	})
+	if err != nil {
+		h.Logger.Printf("Error setting product attributes: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	sqlDB, err := h.DB.DB()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	attributes, err := loadProductAttributes(sqlDB, productID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"product_id": productID, "attributes": attributes})
+}
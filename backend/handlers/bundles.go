@@ -0,0 +1,303 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"backend/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// BundleRequest sets the components of a bundle, replacing any it had. An
+// empty list turns the bundle back into an ordinary product.
+type BundleRequest struct {
+	Components []BundleComponentInput `json:"components"`
+}
+
+type BundleComponentInput struct {
+	ProductID int   `json:"product_id"`
+	VariantID *uint `json:"variant_id"` // Required when the product is sold in variants
+	Quantity  int   `json:"quantity"`
+}
+
+// bundleStockExpr is how many of a bundle its components' stock covers, for
+// use in queries on the products table, and NULL for other products. Like
+// loadBundleComponents, it counts components no longer for sale as out of
+// stock.
+const bundleStockExpr = `(SELECT MIN(IF(cp.archived_at IS NULL
+		AND (cp.status = 'published' OR (cp.status = 'scheduled' AND cp.publish_at <= UTC_TIMESTAMP())),
+		GREATEST(COALESCE(cv.stock, cp.stock), 0), 0) DIV bc.quantity)
+	FROM bundle_components bc
+	JOIN products cp ON cp.id = bc.product_id
+	LEFT JOIN product_variants cv ON cv.id = bc.variant_id
+	WHERE bc.bundle_id = products.id)`
+
+// productStockExpr is the stock a product has to sell: its variants' for a
+// product sold in variants, whose own stock is not sold, what its components
+// cover for a bundle, otherwise its own.
+const productStockExpr = "COALESCE(" + variantStockExpr + ", " + bundleStockExpr + ", products.stock)"
+
+// loadBundleComponents returns a product's bundle components, if it is a
+// bundle, and how many bundles their stock covers. Components that are no
+// longer for sale count as out of stock.
+func loadBundleComponents(db sqlExecer, bundleID int) ([]models.BundleComponent, int, error) {
+	rows, err := db.Query(`SELECT bc.id, bc.bundle_id, bc.product_id, bc.variant_id, bc.quantity, bc.position,
+			p.name, COALESCE(v.sku, p.sku, ''), COALESCE(v.stock, p.stock),
+			p.archived_at IS NULL AND `+publishedCond+`
+		FROM bundle_components bc
+		JOIN products p ON p.id = bc.product_id
+		LEFT JOIN product_variants v ON v.id = bc.variant_id
+		WHERE bc.bundle_id = ? ORDER BY bc.position, bc.id`, bundleID)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var components []models.BundleComponent
+	available := -1
+	for rows.Next() {
+		var comp models.BundleComponent
+		var stock int
+		var forSale bool
+		if err := rows.Scan(&comp.ID, &comp.BundleID, &comp.ProductID, &comp.VariantID, &comp.Quantity, &comp.Position,
+			&comp.Name, &comp.SKU, &stock, &forSale); err != nil {
+			return nil, 0, err
+		}
+		if !forSale {
+			stock = 0
+		}
+		if n := stock / comp.Quantity; available < 0 || n < available {
+			available = max(n, 0)
+		}
+		components = append(components, comp)
+	}
+	return components, max(available, 0), rows.Err()
+}
+
+// SetBundleComponents makes a product a bundle of other products, each in a
+// quantity per bundle, from a JSON BundleRequest. The bundle keeps its own
+// price; its stock is whatever its components' stock covers. Bundles cannot
+// contain bundles, and a product sold in variants joins a bundle as one of
+// its variants.
+func (h *ProductHandler) SetBundleComponents(c *gin.Context) {
+	bundleID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid product ID"})
+		return
+	}
+
+	var req BundleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+
+	tx, err := h.DB.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	var version int
+	if err := tx.QueryRow("SELECT version FROM products WHERE id = ? FOR UPDATE", bundleID).Scan(&version); err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	errs := FieldErrors{}
+	if err := validateBundle(tx, bundleID, req.Components, errs); err != nil {
+		h.Logger.Printf("Error validating bundle %d: %v", bundleID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if len(errs) > 0 {
+		respondFieldErrors(c, errs)
+		return
+	}
+
+	err = func() error {
+		if _, err := tx.Exec("DELETE FROM bundle_components WHERE bundle_id = ?", bundleID); err != nil {
+			return err
+		}
+		for i, comp := range req.Components {
+			if _, err := tx.Exec("INSERT INTO bundle_components (bundle_id, product_id, variant_id, quantity, position) VALUES (?, ?, ?, ?, ?)",
+				bundleID, comp.ProductID, comp.VariantID, comp.Quantity, i); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.Exec("UPDATE products SET version = version + 1 WHERE id = ?", bundleID); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}()
+	if err != nil {
+		h.Logger.Printf("Error saving bundle %d: %v", bundleID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	h.syncSearch(bundleID)
+
+	product, err := h.currentProduct(bundleID)
+	if err == nil {
+		err = h.withBundle(&product)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	setETag(c, product.Version)
+	c.JSON(http.StatusOK, product)
+}
+
+// validateBundle checks the components of a bundle, reporting problems in
+// errs.
+func validateBundle(tx sqlExecer, bundleID int, components []BundleComponentInput, errs FieldErrors) error {
+	if len(components) == 0 {
+		return nil
+	}
+
+	var isComponent, hasVariants bool
+	err := tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM bundle_components WHERE product_id = ?),
+		EXISTS(SELECT 1 FROM product_variants WHERE product_id = ?)`, bundleID, bundleID).Scan(&isComponent, &hasVariants)
+	if err != nil {
+		return err
+	}
+	if isComponent {
+		errs.add("components", "a product that is part of a bundle cannot be a bundle")
+	}
+	if hasVariants {
+		errs.add("components", "a product sold in variants cannot be a bundle")
+	}
+
+	type componentKey struct {
+		productID int
+		variantID uint
+	}
+	seen := make(map[componentKey]bool)
+	for i, comp := range components {
+		field := fmt.Sprintf("components[%d]", i)
+		if comp.Quantity < 1 {
+			errs.add(field+".quantity", "must be at least 1")
+		}
+		if comp.ProductID == bundleID {
+			errs.add(field+".product_id", "a bundle cannot contain itself")
+			continue
+		}
+
+		var archived, isBundle, withVariants bool
+		err := tx.QueryRow(`SELECT archived_at IS NOT NULL,
+				EXISTS(SELECT 1 FROM bundle_components WHERE bundle_id = p.id),
+				EXISTS(SELECT 1 FROM product_variants WHERE product_id = p.id)
+			FROM products p WHERE p.id = ?`, comp.ProductID).Scan(&archived, &isBundle, &withVariants)
+		switch {
+		case err == sql.ErrNoRows:
+			errs.add(field+".product_id", "product does not exist")
+			continue
+		case err != nil:
+			return err
+		case archived:
+			errs.add(field+".product_id", "product is archived")
+		case isBundle:
+			errs.add(field+".product_id", "bundles cannot contain other bundles")
+		}
+
+		key := componentKey{productID: comp.ProductID}
+		if comp.VariantID != nil {
+			key.variantID = *comp.VariantID
+			var belongs bool
+			err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM product_variants WHERE id = ? AND product_id = ?)", *comp.VariantID, comp.ProductID).Scan(&belongs)
+			if err != nil {
+				return err
+			}
+			if !belongs {
+				errs.add(field+".variant_id", "variant does not belong to the product")
+			}
+		} else if withVariants {
+			errs.add(field+".variant_id", "is required for a product sold in variants")
+		}
+		if seen[key] {
+			errs.add(field, "is listed more than once")
+		}
+		seen[key] = true
+	}
+	return nil
+}
+
+// withBundle adds a bundle's components to the product and sets its stock
+// to what they cover. Other products are left as they are.
+func (h *ProductHandler) withBundle(p *models.Product) error {
+	components, stock, err := loadBundleComponents(h.DB, p.ID)
+	if err != nil {
+		return err
+	}
+	if len(components) > 0 {
+		p.Components = components
+		p.Stock = stock
+	}
+	return nil
+}
+
+// expandBundles fills in the components of every bundle in the cart, with
+// quantities for the whole line. Bundles are sold as a whole, never in
+// variants, and only while all of their components are for sale.
+func expandBundles(db *gorm.DB, items []CartItem) error {
+	for i := range items {
+		items[i].Components = nil
+		var components []models.BundleComponent
+		if err := db.Where("bundle_id = ?", items[i].ID).Order("position, id").Find(&components).Error; err != nil {
+			return err
+		}
+		if len(components) == 0 {
+			continue
+		}
+		if items[i].VariantID != nil {
+			return fmt.Errorf("%w: product %d is a bundle", errUnknownVariant, items[i].ID)
+		}
+
+		for _, comp := range components {
+			items[i].Components = append(items[i].Components, CartItem{
+				ID:        int(comp.ProductID),
+				VariantID: comp.VariantID,
+				Quantity:  comp.Quantity * items[i].Quantity,
+			})
+		}
+		if err := checkAvailability(db, items[i].Components); err != nil {
+			return err
+		}
+		if err := resolveVariants(db, items[i].Components); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordBundleComponents adds a line for each bundle component under the
+// bundle's own line. Component lines carry no price, so the order total and
+// digest are still made up of the lines the customer put in the cart.
+func recordBundleComponents(tx *gorm.DB, order *models.Order, items []CartItem) error {
+	for i, item := range items {
+		for _, comp := range item.Components {
+			line := models.OrderProduct{
+				OrderID:   order.ID,
+				ProductID: uint(comp.ID),
+				VariantID: comp.VariantID,
+				ParentID:  &order.Products[i].ID,
+				SKU:       comp.SKU,
+				Quantity:  comp.Quantity,
+			}
+			if err := tx.Create(&line).Error; err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
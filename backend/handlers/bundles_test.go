@@ -0,0 +1,214 @@
+package handlers
+
+import (
+	"errors"
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+var (
+	bundleComponentColumns = []string{"id", "bundle_id", "product_id", "variant_id", "quantity", "position"}
+	bundleComponentsQuery  = regexp.QuoteMeta("SELECT * FROM `bundle_components` WHERE bundle_id = ? ORDER BY position, id")
+	availableQuery         = regexp.QuoteMeta("SELECT `id` FROM `products` WHERE id IN ")
+)
+
+func TestExpandBundles(t *testing.T) {
+	db, mock := newMockDB(t)
+	items := []CartItem{{ID: 4, Quantity: 2}, {ID: 5, Quantity: 1}}
+
+	// Bundle 4 holds two of product 7 and one variant 31 of product 8
+	mock.ExpectQuery(bundleComponentsQuery).WithArgs(4).
+		WillReturnRows(sqlmock.NewRows(bundleComponentColumns).
+			AddRow(1, 4, 7, nil, 2, 0).
+			AddRow(2, 4, 8, 31, 1, 1))
+	mock.ExpectQuery(availableQuery).WithArgs(7, 8).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(7).AddRow(8))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT count(*) FROM `product_variants` WHERE product_id = ?")).WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM `product_variants` WHERE id = ? AND product_id = ?")).WithArgs(31, 8, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "product_id", "sku"}).AddRow(31, 8, "TEE-M"))
+	// Product 5 is not a bundle
+	mock.ExpectQuery(bundleComponentsQuery).WithArgs(5).
+		WillReturnRows(sqlmock.NewRows(bundleComponentColumns))
+
+	if err := expandBundles(db, items); err != nil {
+		t.Fatalf("expandBundles: %v", err)
+	}
+	variantID := uint(31)
+	want := []CartItem{
+		{ID: 7, Quantity: 4},
+		{ID: 8, VariantID: &variantID, SKU: "TEE-M", Quantity: 2},
+	}
+	if !reflect.DeepEqual(items[0].Components, want) {
+		t.Errorf("components = %+v, want %+v", items[0].Components, want)
+	}
+	if items[1].Components != nil {
+		t.Errorf("product 5 got components %+v", items[1].Components)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+	// Stock is taken from the components, added to what the cart takes of
+	// them directly
+	items = append(items, CartItem{ID: 7, Quantity: 1})
+	stock := cartStock(items)
+	wantStock := map[stockKey]int{{ProductID: 7}: 5, {ProductID: 8, VariantID: 31}: 2, {ProductID: 5}: 1}
+	if !reflect.DeepEqual(stock, wantStock) {
+		t.Errorf("cartStock = %v, want %v", stock, wantStock)
+	}
+}
+
+func TestExpandBundlesErrors(t *testing.T) {
+	t.Run("bundle with a variant", func(t *testing.T) {
+		db, mock := newMockDB(t)
+		mock.ExpectQuery(bundleComponentsQuery).WithArgs(4).
+			WillReturnRows(sqlmock.NewRows(bundleComponentColumns).AddRow(1, 4, 7, nil, 1, 0))
+		variantID := uint(9)
+		err := expandBundles(db, []CartItem{{ID: 4, VariantID: &variantID, Quantity: 1}})
+		if !errors.Is(err, errUnknownVariant) {
+			t.Errorf("error = %v, want errUnknownVariant", err)
+		}
+	})
+
+	t.Run("component no longer for sale", func(t *testing.T) {
+		db, mock := newMockDB(t)
+		mock.ExpectQuery(bundleComponentsQuery).WithArgs(4).
+			WillReturnRows(sqlmock.NewRows(bundleComponentColumns).AddRow(1, 4, 7, nil, 1, 0))
+		mock.ExpectQuery(availableQuery).WithArgs(7).
+			WillReturnRows(sqlmock.NewRows([]string{"id"}))
+		err := expandBundles(db, []CartItem{{ID: 4, Quantity: 1}})
+		if !errors.Is(err, errUnavailableProduct) {
+			t.Errorf("error = %v, want errUnavailableProduct", err)
+		}
+	})
+}
+
+func TestValidateBundle(t *testing.T) {
+	conn, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	componentQuery := `SELECT archived_at IS NOT NULL`
+	componentColumns := []string{"archived", "is_bundle", "with_variants"}
+
+	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM bundle_components WHERE product_id = \?\)`).WithArgs(4, 4).
+		WillReturnRows(sqlmock.NewRows([]string{"is_component", "has_variants"}).AddRow(false, false))
+	// components[1]: missing
+	mock.ExpectQuery(componentQuery).WithArgs(20).WillReturnRows(sqlmock.NewRows(componentColumns))
+	// components[2]: archived
+	mock.ExpectQuery(componentQuery).WithArgs(21).WillReturnRows(sqlmock.NewRows(componentColumns).AddRow(true, false, false))
+	// components[3]: another bundle
+	mock.ExpectQuery(componentQuery).WithArgs(22).WillReturnRows(sqlmock.NewRows(componentColumns).AddRow(false, true, false))
+	// components[4]: sold in variants, none named
+	mock.ExpectQuery(componentQuery).WithArgs(23).WillReturnRows(sqlmock.NewRows(componentColumns).AddRow(false, false, true))
+	// components[5]: a variant of another product
+	mock.ExpectQuery(componentQuery).WithArgs(23).WillReturnRows(sqlmock.NewRows(componentColumns).AddRow(false, false, true))
+	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM product_variants WHERE id = \? AND product_id = \?\)`).WithArgs(99, 23).
+		WillReturnRows(sqlmock.NewRows([]string{"belongs"}).AddRow(false))
+	// components[6] and [7]: fine, then the same again
+	for i := 0; i < 2; i++ {
+		mock.ExpectQuery(componentQuery).WithArgs(24).WillReturnRows(sqlmock.NewRows(componentColumns).AddRow(false, false, false))
+	}
+
+	otherVariant := uint(99)
+	errs := FieldErrors{}
+	err = validateBundle(conn, 4, []BundleComponentInput{
+		{ProductID: 4, Quantity: 1},
+		{ProductID: 20, Quantity: 0},
+		{ProductID: 21, Quantity: 1},
+		{ProductID: 22, Quantity: 1},
+		{ProductID: 23, Quantity: 1},
+		{ProductID: 23, VariantID: &otherVariant, Quantity: 1},
+		{ProductID: 24, Quantity: 2},
+		{ProductID: 24, Quantity: 1},
+	}, errs)
+	if err != nil {
+		t.Fatalf("validateBundle: %v", err)
+	}
+	want := FieldErrors{
+		"components[0].product_id": "a bundle cannot contain itself",
+		"components[1].quantity":   "must be at least 1",
+		"components[1].product_id": "product does not exist",
+		"components[2].product_id": "product is archived",
+		"components[3].product_id": "bundles cannot contain other bundles",
+		"components[4].variant_id": "is required for a product sold in variants",
+		"components[5].variant_id": "variant does not belong to the product",
+		"components[7]":            "is listed more than once",
+	}
+	if !reflect.DeepEqual(errs, want) {
+		t.Errorf("errors = %v, want %v", errs, want)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestValidateBundleOfComponent(t *testing.T) {
+	conn, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM bundle_components WHERE product_id = \?\)`).WithArgs(4, 4).
+		WillReturnRows(sqlmock.NewRows([]string{"is_component", "has_variants"}).AddRow(true, false))
+	mock.ExpectQuery(`SELECT archived_at IS NOT NULL`).WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"archived", "is_bundle", "with_variants"}).AddRow(false, false, false))
+
+	errs := FieldErrors{}
+	if err := validateBundle(conn, 4, []BundleComponentInput{{ProductID: 7, Quantity: 1}}, errs); err != nil {
+		t.Fatal(err)
+	}
+	if errs["components"] != "a product that is part of a bundle cannot be a bundle" {
+		t.Errorf("errors = %v", errs)
+	}
+}
+
+func TestLoadBundleComponentsStock(t *testing.T) {
+	conn, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	columns := []string{"id", "bundle_id", "product_id", "variant_id", "quantity", "position", "name", "sku", "stock", "for_sale"}
+
+	tests := []struct {
+		name string
+		rows *sqlmock.Rows
+		want int
+	}{
+		{
+			name: "the scarcest component decides",
+			rows: sqlmock.NewRows(columns).
+				AddRow(1, 4, 7, nil, 2, 0, "Mug", "MUG", 9, true).
+				AddRow(2, 4, 8, 31, 1, 1, "Tee", "TEE-M", 6, true),
+			want: 4,
+		},
+		{
+			name: "a component no longer for sale",
+			rows: sqlmock.NewRows(columns).
+				AddRow(1, 4, 7, nil, 1, 0, "Mug", "MUG", 9, false),
+			want: 0,
+		},
+		{
+			name: "oversold component",
+			rows: sqlmock.NewRows(columns).
+				AddRow(1, 4, 7, nil, 1, 0, "Mug", "MUG", -2, true),
+			want: 0,
+		},
+	}
+	for _, tt := range tests {
+		mock.ExpectQuery(`FROM bundle_components bc`).WithArgs(4).WillReturnRows(tt.rows)
+		_, available, err := loadBundleComponents(conn, 4)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if available != tt.want {
+			t.Errorf("%s: %d bundles available, want %d", tt.name, available, tt.want)
+		}
+	}
+}
@@ -11,15 +11,71 @@ import (
 )
 
 type CategoryHandler struct {
-	DB     *sql.DB
-	Logger *log.Logger
+	DB      *sql.DB
+	Logger  *log.Logger
+	Catalog *CatalogCache
 }
 
+// categoryIDParam reads the category id from the URL, falling back to an "id"
+// form field for clients that post it in the body.
+func categoryIDParam(c *gin.Context) (int, error) {
+	id := c.Param("id")
+	if id == "" {
+		id = c.PostForm("id")
+	}
+	return strconv.Atoi(id)
+}
+
+// parseParentID reads an optional parent_id form field. An empty value or 0
+// means the category sits at the top level.
+func parseParentID(c *gin.Context) (parentID *int, present bool, err error) {
+	s, present := c.GetPostForm("parent_id")
+	if !present || s == "" || s == "0" {
+		return nil, present, nil
+	}
+	id, err := strconv.Atoi(s)
+	if err != nil {
+		return nil, true, err
+	}
+	return &id, true, nil
+}
+
+// CreateCategory adds a category. Translated names are given as
+// name[<locale>] form fields.
 func (h *CategoryHandler) CreateCategory(c *gin.Context) {
 	name := c.PostForm("name")
+	translations, err := parseCategoryTranslations(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	parentID, _, err := parseParentID(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid parent ID"})
+		return
+	}
+	if parentID != nil {
+		var exists bool
+		if err := h.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM categories WHERE catid = ?)", *parentID).Scan(&exists); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		if !exists {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Parent category not found"})
+			return
+		}
+	}
+
+	tx, err := h.DB.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
 
-	query := `INSERT INTO categories (name) VALUES (?)`
-	result, err := h.DB.Exec(query, name)
+	query := `INSERT INTO categories (name, parent_id) VALUES (?, ?)`
+	result, err := tx.Exec(query, name, parentID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 		return
@@ -31,58 +87,216 @@ func (h *CategoryHandler) CreateCategory(c *gin.Context) {
 		return
 	}
 
+	slug, err := assignSlug(tx, models.SlugCategory, int(categoryID), name)
+	if err != nil {
+		h.Logger.Printf("Error setting category slug: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if err := saveCategoryTranslations(tx, int(categoryID), translations); err != nil {
+		h.Logger.Printf("Error saving category translations: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
 	category := models.Category{
-		ID:   int(categoryID),
-		Name: name,
+		ID:       int(categoryID),
+		Name:     name,
+		Slug:     slug,
+		ParentID: parentID,
+		Version:  1,
+	}
+	for locale, name := range translations {
+		if name != "" {
+			if category.Translations == nil {
+				category.Translations = make(map[string]string)
+			}
+			category.Translations[locale] = name
+		}
 	}
 
+	setETag(c, category.Version)
 	c.JSON(http.StatusOK, category)
 }
 
+// UpdateCategory renames a category and/or moves it under a new parent.
+// Moves that would place a category beneath itself are rejected. A rename
+// changes the slug; the old one still resolves. Translated names are
+// set with name[<locale>] form fields, and an empty one removes a
+// translation. Like UpdateProduct it needs If-Match or a version field and
+// refuses to overwrite a category changed since.
 func (h *CategoryHandler) UpdateCategory(c *gin.Context) {
-	categoryID, err := strconv.Atoi(c.Param("id"))
+	categoryID, err := categoryIDParam(c)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid category ID"})
 		return
 	}
 
-	name := c.PostForm("name")
+	name, hasName := c.GetPostForm("name")
+	parentID, hasParent, err := parseParentID(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid parent ID"})
+		return
+	}
+	translations, err := parseCategoryTranslations(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !hasName && !hasParent && len(translations) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name, parent_id or a translated name is required"})
+		return
+	}
+	pre, err := parsePrecondition(c)
+	if err != nil {
+		respondPrecondition(c, err)
+		return
+	}
 
-	query := `UPDATE categories SET name = ? WHERE catid = ?`
-	result, err := h.DB.Exec(query, name, categoryID)
+	tx, err := h.DB.Begin()
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 		return
 	}
+	defer tx.Rollback()
 
-	rowsAffected, err := result.RowsAffected()
+	// Lock the table so concurrent moves cannot combine into a cycle
+	if _, err := tx.Exec("SELECT catid FROM categories FOR UPDATE"); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	tree, err := loadCategoryTree(tx)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 		return
 	}
-
-	if rowsAffected == 0 {
+	category, ok := tree.byID[categoryID]
+	if !ok {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Category not found"})
 		return
 	}
+	if !pre.matches(category.Version) {
+		names, err := loadCategoryTranslations(tx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		category.Translations = names[categoryID]
+		pre.respondStale(c, category.Version, category)
+		return
+	}
 
-	category := models.Category{
-		ID:   categoryID,
-		Name: name,
+	if hasName {
+		category.Name = name
+	}
+	if hasParent {
+		if parentID != nil {
+			if _, ok := tree.byID[*parentID]; !ok {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Parent category not found"})
+				return
+			}
+			if tree.isAncestor(categoryID, *parentID) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "A category cannot be moved under itself or one of its subcategories"})
+				return
+			}
+		}
+		category.ParentID = parentID
+	}
+
+	query := `UPDATE categories SET name = ?, parent_id = ?, version = version + 1 WHERE catid = ?`
+	category.Version++
+	if _, err := tx.Exec(query, category.Name, category.ParentID, categoryID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if hasName {
+		if category.Slug, err = assignSlug(tx, models.SlugCategory, categoryID, category.Name); err != nil {
+			h.Logger.Printf("Error setting category slug: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+	}
+	if hasParent {
+		// Products below the category lose the attributes of its old
+		// ancestors
+		tree.byID[categoryID] = category
+		for _, id := range tree.descendants(categoryID) {
+			if err := pruneAttributeValues(tx, tree, id); err != nil {
+				h.Logger.Printf("Error removing attribute values: %v", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+				return
+			}
+		}
+	}
+	if err := saveCategoryTranslations(tx, categoryID, translations); err != nil {
+		h.Logger.Printf("Error saving category translations: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
 	}
+	names, err := loadCategoryTranslations(tx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	category.Translations = names[categoryID]
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	setETag(c, category.Version)
 
 	c.JSON(http.StatusOK, category)
 }
 
+// DeleteCategory removes a category along with its translations, old slugs
+// and attributes. Categories that still have subcategories or products,
+// archived ones included, cannot be deleted.
 func (h *CategoryHandler) DeleteCategory(c *gin.Context) {
-	categoryID, err := strconv.Atoi(c.Param("id"))
+	categoryID, err := categoryIDParam(c)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid category ID"})
 		return
 	}
 
+	tx, err := h.DB.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	// Lock the table so no subcategory can be moved under it meanwhile
+	if _, err := tx.Exec("SELECT catid FROM categories FOR UPDATE"); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	var hasChildren bool
+	if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM categories WHERE parent_id = ?)", categoryID).Scan(&hasChildren); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if hasChildren {
+		c.JSON(http.StatusConflict, gin.H{"error": "Category has subcategories"})
+		return
+	}
+
+	var hasProducts bool
+	if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM products WHERE catid = ? FOR UPDATE)", categoryID).Scan(&hasProducts); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if hasProducts {
+		c.JSON(http.StatusConflict, gin.H{"error": "Category has products"})
+		return
+	}
+
 	query := `DELETE FROM categories WHERE catid = ?`
-	result, err := h.DB.Exec(query, categoryID)
+	result, err := tx.Exec(query, categoryID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 		return
@@ -98,10 +312,38 @@ func (h *CategoryHandler) DeleteCategory(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Category not found"})
 		return
 	}
+	if _, err := tx.Exec("DELETE FROM slug_redirects WHERE kind = ? AND target_id = ?", models.SlugCategory, categoryID); err != nil {
+		h.Logger.Printf("Error removing category slug redirects: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if _, err := tx.Exec("DELETE FROM category_translations WHERE category_id = ?", categoryID); err != nil {
+		h.Logger.Printf("Error removing category translations: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	// With no products or subcategories left, nothing has values for the
+	// category's attributes
+	if _, err := tx.Exec("DELETE FROM attribute_options WHERE attribute_id IN (SELECT id FROM attributes WHERE category_id = ?)", categoryID); err != nil {
+		h.Logger.Printf("Error removing category attributes: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if _, err := tx.Exec("DELETE FROM attributes WHERE category_id = ?", categoryID); err != nil {
+		h.Logger.Printf("Error removing category attributes: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
 
 	c.Status(http.StatusNoContent)
 }
 
+// GetCategoryIDByName looks a category up by its exact name. New clients
+// should request /categories/<slug> instead.
 func (h *CategoryHandler) GetCategoryIDByName(c *gin.Context) {
 	name := c.Query("name")
 	if name == "" {
@@ -110,7 +352,8 @@ func (h *CategoryHandler) GetCategoryIDByName(c *gin.Context) {
 	}
 
 	var categoryID int
-	err := h.DB.QueryRow("SELECT catid FROM categories WHERE name = ?", name).Scan(&categoryID)
+	var slug string
+	err := h.DB.QueryRow("SELECT catid, COALESCE(slug, '') FROM categories WHERE name = ?", name).Scan(&categoryID, &slug)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Category not found"})
@@ -120,54 +363,93 @@ func (h *CategoryHandler) GetCategoryIDByName(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"category_id": categoryID})
+	c.JSON(http.StatusOK, gin.H{"category_id": categoryID, "slug": slug})
 }
 
+// GetCategory returns a category by ID or slug, named in the requested
+// locale. A slug the category had before a rename still finds it, with a
+// canonical Link to its current one.
 func (h *CategoryHandler) GetCategory(c *gin.Context) {
-	categoryID, err := strconv.Atoi(c.Param("id"))
+	categoryID, redirectTo, err := resolveSlug(h.DB, models.SlugCategory, c.Param("id"))
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid category ID"})
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Category not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 		return
 	}
+	if redirectTo != "" {
+		setCanonicalLink(c, models.SlugCategory, redirectTo)
+	}
 
-	var category models.Category
-	err = h.DB.QueryRow("SELECT catid, name FROM categories WHERE catid = ?", categoryID).Scan(&category.ID, &category.Name)
+	tree, err := loadCategoryTree(h.DB)
+	if err == nil {
+		err = tree.localize(h.DB, requestLocale(c))
+	}
 	if err != nil {
-		if err == sql.ErrNoRows {
-			c.JSON(http.StatusNotFound, gin.H{"error": "Category not found"})
-		} else {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
-		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	category, ok := tree.byID[categoryID]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Category not found"})
 		return
 	}
 
+	// Direct subcategories and the path from the root, for navigation
+	for _, childID := range tree.children[categoryID] {
+		category.Children = append(category.Children, tree.byID[childID])
+	}
+	category.Breadcrumbs = tree.breadcrumbs(categoryID)
+
+	setETag(c, category.Version)
 	c.JSON(http.StatusOK, category)
 }
 
+// ListCategories returns every category, named in the requested locale.
 func (h *CategoryHandler) ListCategories(c *gin.Context) {
 	h.Logger.Printf("Handling ListCategories request")
-	rows, err := h.DB.Query("SELECT DISTINCT catid, name FROM categories")
+	locale := requestLocale(c)
+	categories, err := h.Catalog.Fetch("categories#"+locale, func() (interface{}, error) {
+		return h.listCategories(locale)
+	})
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 		return
 	}
+
+	c.JSON(http.StatusOK, categories)
+}
+
+// listCategories loads every category, localized to locale.
+func (h *CategoryHandler) listCategories(locale string) ([]models.Category, error) {
+	names, err := loadCategoryTranslations(h.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := h.DB.Query("SELECT DISTINCT catid, name, COALESCE(slug, ''), parent_id, version FROM categories")
+	if err != nil {
+		return nil, err
+	}
 	defer rows.Close()
 
 	var categories []models.Category
 	for rows.Next() {
 		var category models.Category
-		err := rows.Scan(&category.ID, &category.Name)
+		var parentID sql.NullInt64
+		err := rows.Scan(&category.ID, &category.Name, &category.Slug, &parentID, &category.Version)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
-			return
+			return nil, err
+		}
+		if parentID.Valid {
+			id := int(parentID.Int64)
+			category.ParentID = &id
 		}
+		category.Translations = names[category.ID]
+		localizeCategory(&category, locale)
 		categories = append(categories, category)
 	}
-
-	if err = rows.Err(); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
-		return
-	}
-
-	c.JSON(http.StatusOK, categories)
+	return categories, rows.Err()
 }
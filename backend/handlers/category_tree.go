@@ -0,0 +1,155 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"time"
+
+	"backend/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// categoryTree is a snapshot of the whole categories table. The table is
+// small, so requests that need the hierarchy load it in one query.
+type categoryTree struct {
+	byID     map[int]models.Category
+	children map[int][]int // parent id -> child ids; roots are under 0
+}
+
+func loadCategoryTree(db sqlExecer) (*categoryTree, error) {
+	rows, err := db.Query("SELECT catid, name, COALESCE(slug, ''), parent_id, version, UNIX_TIMESTAMP(updated_at) FROM categories ORDER BY name, catid")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tree := &categoryTree{
+		byID:     make(map[int]models.Category),
+		children: make(map[int][]int),
+	}
+	var order []models.Category
+	for rows.Next() {
+		var cat models.Category
+		var parentID sql.NullInt64
+		var updated int64
+		if err := rows.Scan(&cat.ID, &cat.Name, &cat.Slug, &parentID, &cat.Version, &updated); err != nil {
+			return nil, err
+		}
+		cat.UpdatedAt = time.Unix(updated, 0).UTC()
+		if parentID.Valid {
+			id := int(parentID.Int64)
+			cat.ParentID = &id
+		}
+		tree.byID[cat.ID] = cat
+		order = append(order, cat)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, cat := range order {
+		parent := 0
+		// Categories whose parent has gone missing are shown as roots
+		if cat.ParentID != nil {
+			if _, ok := tree.byID[*cat.ParentID]; ok {
+				parent = *cat.ParentID
+			}
+		}
+		tree.children[parent] = append(tree.children[parent], cat.ID)
+	}
+	return tree, nil
+}
+
+// localize attaches every category's translated names and switches its name
+// to the one for locale.
+func (t *categoryTree) localize(db sqlExecer, locale string) error {
+	names, err := loadCategoryTranslations(db)
+	if err != nil {
+		return err
+	}
+	for id, cat := range t.byID {
+		cat.Translations = names[id]
+		localizeCategory(&cat, locale)
+		t.byID[id] = cat
+	}
+	return nil
+}
+
+// subtree returns a category with all of its descendants nested under it.
+func (t *categoryTree) subtree(id int) models.Category {
+	cat := t.byID[id]
+	for _, childID := range t.children[id] {
+		cat.Children = append(cat.Children, t.subtree(childID))
+	}
+	return cat
+}
+
+// roots returns every top-level category with its descendants nested.
+func (t *categoryTree) roots() []models.Category {
+	roots := []models.Category{}
+	for _, id := range t.children[0] {
+		roots = append(roots, t.subtree(id))
+	}
+	return roots
+}
+
+// breadcrumbs returns the path from the root down to and including id.
+func (t *categoryTree) breadcrumbs(id int) []models.Breadcrumb {
+	var path []models.Breadcrumb
+	seen := make(map[int]bool)
+	for {
+		cat, ok := t.byID[id]
+		if !ok || seen[id] {
+			break
+		}
+		seen[id] = true
+		path = append([]models.Breadcrumb{{ID: cat.ID, Name: cat.Name, Slug: cat.Slug}}, path...)
+		if cat.ParentID == nil {
+			break
+		}
+		id = *cat.ParentID
+	}
+	return path
+}
+
+// descendants returns id followed by the ids of every category below it.
+func (t *categoryTree) descendants(id int) []int {
+	ids := []int{id}
+	seen := map[int]bool{id: true}
+	for i := 0; i < len(ids); i++ {
+		for _, childID := range t.children[ids[i]] {
+			if !seen[childID] {
+				seen[childID] = true
+				ids = append(ids, childID)
+			}
+		}
+	}
+	return ids
+}
+
+// isAncestor reports whether ancestor is id itself or lies on its path to
+// the root. Moving ancestor under id would then create a cycle.
+func (t *categoryTree) isAncestor(ancestor, id int) bool {
+	for _, crumb := range t.breadcrumbs(id) {
+		if crumb.ID == ancestor {
+			return true
+		}
+	}
+	return false
+}
+
+// GetCategoryTree returns every category nested under its parent, named in
+// the requested locale.
+func (h *CategoryHandler) GetCategoryTree(c *gin.Context) {
+	tree, err := loadCategoryTree(h.DB)
+	if err == nil {
+		err = tree.localize(h.DB, requestLocale(c))
+	}
+	if err != nil {
+		h.Logger.Printf("Error loading category tree: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	c.JSON(http.StatusOK, tree.roots())
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -28,10 +29,13 @@ type PayPalOrderRequest struct {
 }
 
 type CartItem struct {
-	ID       int     `json:"id" binding:"required"`
-	Name     string  `json:"name" binding:"required"`
-	Price    float64 `json:"price" binding:"required,min=0.01"`
-	Quantity int     `json:"quantity" binding:"required,min=1"`
+	ID        int     `json:"id" binding:"required"`
+	VariantID *uint   `json:"variant_id"` // Set when the product is sold in variants
+	SKU       string  `json:"-"`          // Filled in from the variant, never trusted from the client
+	Components []CartItem `json:"-"`       // Filled in for bundles; see expandBundles
+	Name      string  `json:"name" binding:"required"`
+	Price     float64 `json:"price" binding:"required,min=0.01"`
+	Quantity  int     `json:"quantity" binding:"required,min=1"`
 }
 
 func generateDigest(currency string, merchantEmail string, salt string, cartItems []CartItem, totalPrice float64) string {
@@ -41,6 +45,9 @@ func generateDigest(currency string, merchantEmail string, salt string, cartItem
 	var productParts []string
 	for _, item := range cartItems {
 		productStr := fmt.Sprintf("%d:%d:%.2f", item.ID, item.Quantity, item.Price)
+		if item.VariantID != nil {
+			productStr += fmt.Sprintf(":v%d", *item.VariantID)
+		}
 		productParts = append(productParts, productStr)
 		log.Printf("CartItem - ID: %d, Price: %.2f, Quantity: %d", item.ID, item.Price, item.Quantity)
 	}
@@ -74,17 +81,81 @@ func calculateTotal(items []CartItem) float64 {
 func buildPayPalItems(items []CartItem) []paypal.Item {
 	var paypalItems []paypal.Item
 	for _, item := range items {
+		sku := item.SKU
+		if sku == "" {
+			sku = fmt.Sprintf("%d", item.ID)
+		}
 		paypalItems = append(paypalItems, paypal.Item{
 			Name:        item.Name,
-			UnitAmount:  &paypal.Money{Currency: "HKD", Value: fmt.Sprintf("%.2f", item.Price)},
+			UnitAmount:  &paypal.Money{Currency: storeCurrency, Value: fmt.Sprintf("%.2f", item.Price)},
 			Quantity:    fmt.Sprintf("%d", item.Quantity),
-			SKU:         fmt.Sprintf("%d", item.ID),
+			SKU:         sku,
 			Description: item.Name,
 		})
 	}
 	return paypalItems
 }
 
+// storeCurrency is the currency prices are kept in and orders are charged
+// in.
+const storeCurrency = "HKD"
+
+var errUnknownVariant = errors.New("unknown variant")
+
+// resolveVariants checks that every variant in the cart belongs to its
+// product, and that products sold in variants name one, and fills in the
+// variant SKU.
+func resolveVariants(db *gorm.DB, items []CartItem) error {
+	for i := range items {
+		items[i].SKU = ""
+		if items[i].VariantID == nil {
+			var variants int64
+			if err := db.Model(&models.ProductVariant{}).Where("product_id = ?", items[i].ID).Count(&variants).Error; err != nil {
+				return err
+			}
+			if variants > 0 {
+				return fmt.Errorf("%w: product %d is sold in variants, variant_id is required", errUnknownVariant, items[i].ID)
+			}
+			continue
+		}
+		var variant models.ProductVariant
+		err := db.Where("id = ? AND product_id = ?", *items[i].VariantID, items[i].ID).First(&variant).Error
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return fmt.Errorf("%w: variant %d does not belong to product %d", errUnknownVariant, *items[i].VariantID, items[i].ID)
+			}
+			return err
+		}
+		items[i].SKU = variant.SKU
+	}
+	return nil
+}
+
+var errUnavailableProduct = errors.New("product is no longer available")
+
+// checkAvailability rejects carts holding products that do not exist, have
+// been archived since they were added or are not published.
+func checkAvailability(db *gorm.DB, items []CartItem) error {
+	ids := make([]int, 0, len(items))
+	for _, item := range items {
+		ids = append(ids, item.ID)
+	}
+	var live []int
+	if err := db.Table("products").Where("id IN ? AND archived_at IS NULL AND "+publishedCond, ids).Pluck("id", &live).Error; err != nil {
+		return err
+	}
+	available := make(map[int]bool, len(live))
+	for _, id := range live {
+		available[id] = true
+	}
+	for _, item := range items {
+		if !available[item.ID] {
+			return fmt.Errorf("%w: product %d", errUnavailableProduct, item.ID)
+		}
+	}
+	return nil
+}
+
 type PayPalWebhookEvent struct {
 	EventType string `json:"event_type"`
 	Resource  struct {
@@ -98,7 +169,12 @@ type PayPalWebhookEvent struct {
 	} `json:"resource"`
 }
 
-func PayPalWebhookHandler(db *gorm.DB) http.HandlerFunc {
+// PayPalWebhookHandler approves an order once PayPal reports it paid and its
+// digest checks out, granting downloads of any digital products on it. The
+// catalog is invalidated when a late payment sells out the stock it takes
+// again; co-purchase counts for related products catch up with the next
+// catalog change.
+func PayPalWebhookHandler(db *gorm.DB, downloads *Downloads, catalog *CatalogCache) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Read the request body
 		body, err := io.ReadAll(r.Body)
@@ -151,19 +227,25 @@ func PayPalWebhookHandler(db *gorm.DB) http.HandlerFunc {
 			order.Order.CreatedAt = createdAt
 			order.Order.UpdatedAt = updatedAt
 
-			// Check if already processed
+			// Check if already processed. This only saves work; the
+			// conditional approval below is what stops duplicates
 			if order.Status == "approved" {
 				log.Printf("Order %d already approved, skipping", order.ID)
 				return
 			}
 
-			// Rebuild cart items from order products
+			// Rebuild cart items from order products. Bundle components
+			// were not in the cart, so they are not part of the digest
 			var cartItems []CartItem
 			for _, p := range order.Products {
+				if p.ParentID != nil {
+					continue
+				}
 				cartItems = append(cartItems, CartItem{
-					ID:       int(p.ProductID),
-					Price:    p.Price,
-					Quantity: p.Quantity,
+					ID:        int(p.ProductID),
+					VariantID: p.VariantID,
+					Price:     p.Price,
+					Quantity:  p.Quantity,
 				})
 			}
 
@@ -176,14 +258,7 @@ func PayPalWebhookHandler(db *gorm.DB) http.HandlerFunc {
 				return
 			}
 			
-			// Update status using the original Order model
-			if err := db.Model(&order.Order).Where("id = ?", order.ID).Update("status", "approved").Error; err != nil {
-				log.Printf("Failed to update order status: %v", err)
-				return
-			}
-			log.Printf("Successfully updated order %d status to approved", order.ID)
-
-			// Save verified order record
+			// Verified order record, with bundles as the bundle itself
 			verifiedOrder := models.VerifiedOrder{
 				OrderID:    order.ID,
 				Invoice:    order.Invoice,
@@ -194,22 +269,66 @@ func PayPalWebhookHandler(db *gorm.DB) http.HandlerFunc {
 				Currency:   order.Currency,
 				Status:     "approved",
 			}
-
-			// Add products to verified order
 			for _, p := range order.Products {
+				if p.ParentID != nil {
+					continue
+				}
 				verifiedOrder.Products = append(verifiedOrder.Products, models.VerifiedOrderProduct{
 					ProductID: p.ProductID,
+					VariantID: p.VariantID,
+					SKU:       p.SKU,
 					Quantity:  p.Quantity,
 					Price:     p.Price,
 				})
 			}
 
-			// Save to database
-			if err := db.Create(&verifiedOrder).Error; err != nil {
-				log.Printf("Failed to save verified order: %v", err)
+			// Approve the order, commit its reserved stock, save the verified
+			// order, count it towards related products and grant the buyer
+			// its downloads, all or nothing. The conditional UPDATE lets only
+			// one of several concurrent deliveries through; a failure leaves
+			// the order pending so PayPal's retry can finish the job.
+			approved := false
+			var retaken []stockKey
+			err := db.Transaction(func(tx *gorm.DB) error {
+				res := tx.Model(&models.Order{}).Where("id = ? AND status <> ?", order.ID, "approved").Update("status", "approved")
+				if res.Error != nil {
+					return res.Error
+				}
+				if res.RowsAffected != 1 {
+					return nil
+				}
+				var err error
+				if retaken, err = commitReservations(tx, order.ID); err != nil {
+					return err
+				}
+				if err := tx.Create(&verifiedOrder).Error; err != nil {
+					return err
+				}
+				if err := recordCoPurchases(tx, verifiedOrder.Products); err != nil {
+					return err
+				}
+				if err := downloads.issueGrants(tx, order.ID, order.Products); err != nil {
+					return err
+				}
+				approved = true
+				return nil
+			})
+			if err != nil {
+				log.Printf("Failed to approve order %d: %v", order.ID, err)
+				http.Error(w, "Failed to approve order", http.StatusInternalServerError)
+				return
+			}
+			if !approved {
+				log.Printf("Order %d already approved, skipping", order.ID)
+				w.WriteHeader(http.StatusOK)
 				return
 			}
 			log.Printf("Successfully saved verified order %d with %d products", verifiedOrder.ID, len(verifiedOrder.Products))
+			if len(retaken) > 0 {
+				if out, err := soldOut(db, retaken); err != nil || out {
+					catalog.Invalidate()
+				}
+			}
 		}
 		//todo end
 
@@ -218,7 +337,10 @@ func PayPalWebhookHandler(db *gorm.DB) http.HandlerFunc {
 	}
 }
 
-func CheckoutHandler(db *gorm.DB) http.HandlerFunc {
+// CheckoutHandler creates a pending order for the cart, reserving its stock,
+// and a PayPal order to pay for it. Taking the last units of anything
+// invalidates the catalog, as does giving them back when PayPal fails.
+func CheckoutHandler(db *gorm.DB, catalog *CatalogCache) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Parse request body
 		var orderReq PayPalOrderRequest
@@ -227,6 +349,58 @@ func CheckoutHandler(db *gorm.DB) http.HandlerFunc {
 			return
 		}
 
+		if err := checkAvailability(db, orderReq.CartItems); err != nil {
+			if errors.Is(err, errUnavailableProduct) {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			http.Error(w, "Failed to load products", http.StatusInternalServerError)
+			return
+		}
+
+		// Look up variant SKUs before anything is priced or stored
+		if err := resolveVariants(db, orderReq.CartItems); err != nil {
+			if errors.Is(err, errUnknownVariant) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			http.Error(w, "Failed to load product variants", http.StatusInternalServerError)
+			return
+		}
+
+		// Bundles are priced as one item but take their components' stock
+		if err := expandBundles(db, orderReq.CartItems); err != nil {
+			switch {
+			case errors.Is(err, errUnknownVariant):
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			case errors.Is(err, errUnavailableProduct):
+				http.Error(w, err.Error(), http.StatusConflict)
+			default:
+				http.Error(w, "Failed to load product bundles", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		// Files are only delivered to accounts
+		if err := checkGuestDigital(db, orderReq.UserID, orderReq.CartItems); err != nil {
+			if errors.Is(err, errGuestDigital) {
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+			http.Error(w, "Failed to load product files", http.StatusInternalServerError)
+			return
+		}
+
+		// Charge the prices in effect now, whatever the client sent
+		if err := priceCart(db, orderReq.CartItems, time.Now()); err != nil {
+			if errors.Is(err, errUnavailableProduct) {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			http.Error(w, "Failed to load product prices", http.StatusInternalServerError)
+			return
+		}
+
 		// Calculate total price
 		totalPrice := calculateTotal(orderReq.CartItems)
 		fmt.Println(orderReq.Email)
@@ -234,13 +408,13 @@ func CheckoutHandler(db *gorm.DB) http.HandlerFunc {
 		// Generate and store order
 		var timesalt = time.Now().UnixNano();
 		order := models.Order{
-			Currency:      "HKD",
+			Currency:      storeCurrency,
 			MerchantEmail: orderReq.Email,
 			Salt:          fmt.Sprintf("%d", timesalt),
 			TotalPrice:    totalPrice,
 			UserID:        orderReq.UserID,
 			Username:      orderReq.Username,
-			Digest:        generateDigest("HKD", orderReq.Email, fmt.Sprintf("%d", timesalt), orderReq.CartItems, totalPrice),
+			Digest:        generateDigest(storeCurrency, orderReq.Email, fmt.Sprintf("%d", timesalt), orderReq.CartItems, totalPrice),
 			Invoice:       orderReq.Invoice,
 			CreatedAt:     time.Now(),
 		}
@@ -249,22 +423,72 @@ func CheckoutHandler(db *gorm.DB) http.HandlerFunc {
 		for _, item := range orderReq.CartItems {
 			order.Products = append(order.Products, models.OrderProduct{
 				ProductID: uint(item.ID),
+				VariantID: item.VariantID,
+				SKU:       item.SKU,
 				Quantity:  item.Quantity,
 				Price:     item.Price,
 			})
 		}
 
-		// Save order to database
-		if err := db.Create(&order).Error; err != nil {
+		// Save order to database and reserve its stock in one transaction
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Create(&order).Error; err != nil {
+				return err
+			}
+			if err := recordBundleComponents(tx, &order, orderReq.CartItems); err != nil {
+				return err
+			}
+			return reserveStock(tx, order.ID, orderReq.CartItems)
+		})
+		if err != nil {
+			var stockErr *InsufficientStockError
+			if errors.As(err, &stockErr) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusConflict)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"error":      "Insufficient stock",
+					"product_id": stockErr.ProductID,
+					"variant_id": stockErr.VariantID,
+				})
+				return
+			}
 			http.Error(w, "Failed to create order", http.StatusInternalServerError)
 			return
 		}
 
+		// Listings only change when a product sells out
+		soldOutNow, err := soldOut(db, sortedStockKeys(cartStock(orderReq.CartItems)))
+		if err != nil {
+			log.Printf("Failed to check stock of order %d: %v", order.ID, err)
+			soldOutNow = true
+		}
+		if soldOutNow {
+			catalog.Invalidate()
+		}
+
+		// Give the stock back if the PayPal order cannot be created
+		cancelOrder := func() {
+			err := db.Transaction(func(tx *gorm.DB) error {
+				if err := releaseReservations(tx, order.ID); err != nil {
+					return err
+				}
+				return tx.Model(&models.Order{}).Where("id = ?", order.ID).Update("status", "cancelled").Error
+			})
+			if err != nil {
+				log.Printf("Failed to cancel order %d: %v", order.ID, err)
+				return
+			}
+			if soldOutNow {
+				catalog.Invalidate()
+			}
+		}
+
 		// Initialize PayPal client
 		clientID := os.Getenv("PAYPAL_CLIENT_ID")
 		secret := os.Getenv("PAYPAL_SECRET")
 		client, err := paypal.NewClient(clientID, secret, paypal.APIBaseSandBox)
 		if err != nil {
+			cancelOrder()
 			http.Error(w, "Failed to initialize PayPal client", http.StatusInternalServerError)
 			return
 		}
@@ -272,6 +496,7 @@ func CheckoutHandler(db *gorm.DB) http.HandlerFunc {
 		// Get access token
 		_, err = client.GetAccessToken(context.Background())
 		if err != nil {
+			cancelOrder()
 			http.Error(w, "Failed to authenticate with PayPal", http.StatusInternalServerError)
 			return
 		}
@@ -283,11 +508,11 @@ func CheckoutHandler(db *gorm.DB) http.HandlerFunc {
 				ReferenceID: orderReq.Invoice,
 				Description: item.Name,
 				Amount: &paypal.PurchaseUnitAmount{
-					Currency: "HKD",
+					Currency: storeCurrency,
 					Value:    fmt.Sprintf("%.2f", item.Price*float64(item.Quantity)),
 					Breakdown: &paypal.PurchaseUnitAmountBreakdown{
 						ItemTotal: &paypal.Money{
-							Currency: "HKD",
+							Currency: storeCurrency,
 							Value:    fmt.Sprintf("%.2f", calculateTotal(orderReq.CartItems)),
 						},
 					},
@@ -308,6 +533,7 @@ func CheckoutHandler(db *gorm.DB) http.HandlerFunc {
 			},
 		)
 		if err != nil {
+			cancelOrder()
 			http.Error(w, "Failed to create PayPal order", http.StatusInternalServerError)
 			return
 		}
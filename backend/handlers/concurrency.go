@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+var errMissingPrecondition = errors.New("send If-Match with the ETag you last read, or the version field")
+
+// precondition is the version of a record an admin last read, taken from an
+// If-Match header or a version form field. Updates only go through while the
+// record is still at that version.
+type precondition struct {
+	version int
+	any     bool // If-Match: *
+	header  bool
+}
+
+// etag is the entity tag of a record at a version.
+func etag(version int) string {
+	return `"` + strconv.Itoa(version) + `"`
+}
+
+// setETag sets a record's ETag. On public catalog routes it also carries the
+// catalog validator, after a "+", so that the one header serves both
+// If-Match and If-None-Match.
+func setETag(c *gin.Context, version int) {
+	tag := etag(version)
+	if catalog, ok := c.Get(catalogTagKey); ok {
+		tag = `"` + strconv.Itoa(version) + "+" + catalog.(string) + `"`
+	}
+	c.Header("ETag", tag)
+}
+
+// parsePrecondition reads If-Match, falling back to the version form field.
+// A request with neither is refused so that a client that never read the
+// record cannot overwrite it blindly.
+func parsePrecondition(c *gin.Context) (precondition, error) {
+	if match := strings.TrimSpace(c.GetHeader("If-Match")); match != "" {
+		if match == "*" {
+			return precondition{any: true, header: true}, nil
+		}
+		tag, _, _ := strings.Cut(strings.Trim(strings.TrimPrefix(match, "W/"), `"`), "+")
+		v, err := strconv.Atoi(tag)
+		if err != nil || v < 1 {
+			return precondition{}, errors.New("If-Match must be a single ETag")
+		}
+		return precondition{version: v, header: true}, nil
+	}
+	if s := c.PostForm("version"); s != "" {
+		v, err := strconv.Atoi(s)
+		if err != nil || v < 1 {
+			return precondition{}, errors.New("Invalid version")
+		}
+		return precondition{version: v}, nil
+	}
+	return precondition{}, errMissingPrecondition
+}
+
+// respondPrecondition writes the error for a request parsePrecondition
+// rejected.
+func respondPrecondition(c *gin.Context, err error) {
+	status := http.StatusBadRequest
+	if errors.Is(err, errMissingPrecondition) {
+		status = http.StatusPreconditionRequired
+	}
+	c.JSON(status, gin.H{"error": err.Error()})
+}
+
+func (p precondition) matches(version int) bool {
+	return p.any || p.version == version
+}
+
+// respondStale tells the client the record changed since it was read and
+// sends the current state so it can merge and retry: 412 for If-Match, 409
+// for the version field.
+func (p precondition) respondStale(c *gin.Context, version int, current interface{}) {
+	status := http.StatusConflict
+	if p.header {
+		status = http.StatusPreconditionFailed
+	}
+	setETag(c, version)
+	c.JSON(status, gin.H{
+		"error":   "The record was changed by someone else; review the current version and try again",
+		"current": current,
+	})
+}
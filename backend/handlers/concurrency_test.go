@@ -0,0 +1,162 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+)
+
+func TestParsePrecondition(t *testing.T) {
+	tests := []struct {
+		name       string
+		ifMatch    string
+		version    string
+		want       precondition
+		wantStatus int // of respondPrecondition, when parsing fails
+	}{
+		{name: "strong ETag", ifMatch: `"3"`, want: precondition{version: 3, header: true}},
+		{name: "weak ETag", ifMatch: `W/"3"`, want: precondition{version: 3, header: true}},
+		{name: "ETag with the catalog validator", ifMatch: `"3+c17"`, want: precondition{version: 3, header: true}},
+		{name: "any version", ifMatch: "*", want: precondition{any: true, header: true}},
+		{name: "header wins over the field", ifMatch: `"3"`, version: "2", want: precondition{version: 3, header: true}},
+		{name: "version field", version: "2", want: precondition{version: 2}},
+		{name: "list of ETags", ifMatch: `"2", "3"`, wantStatus: http.StatusBadRequest},
+		{name: "version zero", version: "0", wantStatus: http.StatusBadRequest},
+		{name: "neither", wantStatus: http.StatusPreconditionRequired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			form := url.Values{}
+			if tt.version != "" {
+				form.Set("version", tt.version)
+			}
+			c.Request = httptest.NewRequest("POST", "/", strings.NewReader(form.Encode()))
+			c.Request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tt.ifMatch != "" {
+				c.Request.Header.Set("If-Match", tt.ifMatch)
+			}
+
+			pre, err := parsePrecondition(c)
+			if tt.wantStatus != 0 {
+				if err == nil {
+					t.Fatalf("accepted as %+v", pre)
+				}
+				respondPrecondition(c, err)
+				if w.Code != tt.wantStatus {
+					t.Errorf("status %d, want %d", w.Code, tt.wantStatus)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pre != tt.want {
+				t.Errorf("precondition = %+v, want %+v", pre, tt.want)
+			}
+		})
+	}
+
+	if pre := (precondition{any: true}); !pre.matches(9) {
+		t.Error("If-Match: * did not match")
+	}
+	if pre := (precondition{version: 2}); pre.matches(3) || !pre.matches(2) {
+		t.Error("version 2 matched the wrong versions")
+	}
+}
+
+func TestSetETag(t *testing.T) {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	setETag(c, 4)
+	if got := w.Header().Get("ETag"); got != `"4"` {
+		t.Errorf("ETag = %s, want \"4\"", got)
+	}
+
+	// On catalog routes the same tag also validates If-None-Match
+	w = httptest.NewRecorder()
+	c, _ = gin.CreateTestContext(w)
+	c.Set(catalogTagKey, "c17")
+	setETag(c, 4)
+	if got := w.Header().Get("ETag"); got != `"4+c17"` {
+		t.Errorf("ETag = %s, want \"4+c17\"", got)
+	}
+}
+
+// TestUpdateCategoryStale updates a category that has moved on to version 3
+// since the admin read it at version 2.
+func TestUpdateCategoryStale(t *testing.T) {
+	tests := []struct {
+		name    string
+		ifMatch string
+		version string
+		want    int
+	}{
+		{name: "If-Match", ifMatch: `"2"`, want: http.StatusPreconditionFailed},
+		{name: "version field", version: "2", want: http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			mock.ExpectBegin()
+			mock.ExpectExec(`SELECT catid FROM categories FOR UPDATE`).WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectQuery(`SELECT catid, name, COALESCE\(slug, ''\), parent_id, version`).
+				WillReturnRows(sqlmock.NewRows([]string{"catid", "name", "slug", "parent_id", "version", "updated"}).
+					AddRow(5, "Kitchen", "kitchen", nil, 3, 1700000000))
+			mock.ExpectQuery(`SELECT category_id, locale, name FROM category_translations`).
+				WillReturnRows(sqlmock.NewRows([]string{"category_id", "locale", "name"}).AddRow(5, "de", "Küche"))
+			mock.ExpectRollback()
+
+			form := url.Values{"name": {"Cookware"}}
+			if tt.version != "" {
+				form.Set("version", tt.version)
+			}
+			h := &CategoryHandler{DB: conn, Logger: log.New(io.Discard, "", 0)}
+			router := gin.New()
+			router.POST("/categories/update/:id", h.UpdateCategory)
+			req := httptest.NewRequest("POST", "/categories/update/5", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tt.ifMatch != "" {
+				req.Header.Set("If-Match", tt.ifMatch)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if got := w.Header().Get("ETag"); got != `"3"` {
+				t.Errorf("ETag = %s, want the current version", got)
+			}
+			var resp struct {
+				Current struct {
+					Name         string            `json:"name"`
+					Version      int               `json:"version"`
+					Translations map[string]string `json:"translations"`
+				} `json:"current"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Current.Name != "Kitchen" || resp.Current.Version != 3 || resp.Current.Translations["de"] != "Küche" {
+				t.Errorf("current = %+v, want the stored category", resp.Current)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
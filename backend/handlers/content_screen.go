@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Screening findings stored in Review.Flags.
+const (
+	flagBannedWords    = "banned_words"
+	flagLinks          = "links"
+	flagContactDetails = "contact_details"
+	flagShouting       = "shouting"
+	flagRepetition     = "repetition"
+)
+
+var (
+	linkPattern  = regexp.MustCompile(`(?i)\bhttps?://|\bwww\.`)
+	emailPattern = regexp.MustCompile(`[\w.+-]+@[\w-]+\.[\w.-]+`)
+	phonePattern = regexp.MustCompile(`\+?\d[\d\s-]{7,}\d`)
+)
+
+// ContentScreener flags user-submitted text for a moderator to look at. It
+// never rejects anything itself.
+type ContentScreener struct {
+	bannedWords []bannedWord
+	maxLinks    int
+}
+
+// bannedWord is a word list entry, tokenized so phrases match as a whole.
+type bannedWord struct {
+	text   string
+	tokens []string
+}
+
+// ScreenResult lists why a text was flagged. Matched holds the banned words
+// found, for the moderation log.
+type ScreenResult struct {
+	Flags   []string
+	Matched []string
+}
+
+func (r ScreenResult) Flagged() bool {
+	return len(r.Flags) > 0
+}
+
+// NewContentScreener builds a screener from a list of banned words or
+// phrases. Texts with more than maxLinks links are flagged.
+func NewContentScreener(words []string, maxLinks int) *ContentScreener {
+	s := &ContentScreener{maxLinks: maxLinks}
+	for _, w := range words {
+		if tokens := tokenize(w); len(tokens) > 0 {
+			s.bannedWords = append(s.bannedWords, bannedWord{text: strings.TrimSpace(w), tokens: tokens})
+		}
+	}
+	return s
+}
+
+// NewContentScreenerFromEnv reads the banned words from MODERATION_WORDS
+// (comma-separated) and MODERATION_WORDS_FILE (one per line, # starts a
+// comment) and the link limit from MODERATION_MAX_LINKS (default 0).
+func NewContentScreenerFromEnv() (*ContentScreener, error) {
+	var words []string
+	for _, w := range strings.Split(os.Getenv("MODERATION_WORDS"), ",") {
+		words = append(words, strings.TrimSpace(w))
+	}
+
+	if path := os.Getenv("MODERATION_WORDS_FILE"); path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("open moderation word list: %w", err)
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line != "" && !strings.HasPrefix(line, "#") {
+				words = append(words, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("read moderation word list: %w", err)
+		}
+	}
+
+	maxLinks := 0
+	if s := os.Getenv("MODERATION_MAX_LINKS"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid MODERATION_MAX_LINKS: %q", s)
+		}
+		maxLinks = n
+	}
+	return NewContentScreener(words, maxLinks), nil
+}
+
+// Screen checks text against the word list and a few spam heuristics.
+func (s *ContentScreener) Screen(text string) ScreenResult {
+	var result ScreenResult
+	if s == nil {
+		return result
+	}
+
+	tokens := tokenize(text)
+	for _, banned := range s.bannedWords {
+		if containsSequence(tokens, banned.tokens) {
+			result.Matched = append(result.Matched, banned.text)
+		}
+	}
+	if len(result.Matched) > 0 {
+		result.Flags = append(result.Flags, flagBannedWords)
+	}
+
+	if len(linkPattern.FindAllStringIndex(text, -1)) > s.maxLinks {
+		result.Flags = append(result.Flags, flagLinks)
+	}
+	if emailPattern.MatchString(text) || phonePattern.MatchString(text) {
+		result.Flags = append(result.Flags, flagContactDetails)
+	}
+	if isShouting(text) {
+		result.Flags = append(result.Flags, flagShouting)
+	}
+	if hasRepetition(text, 6) {
+		result.Flags = append(result.Flags, flagRepetition)
+	}
+	return result
+}
+
+func containsSequence(tokens, seq []string) bool {
+	for i := 0; i+len(seq) <= len(tokens); i++ {
+		match := true
+		for j := range seq {
+			if tokens[i+j] != seq[j] {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+// isShouting reports whether a reasonably long text is mostly capitals.
+func isShouting(text string) bool {
+	var letters, upper int
+	for _, r := range text {
+		if unicode.IsLetter(r) && (unicode.IsUpper(r) || unicode.IsLower(r)) {
+			letters++
+			if unicode.IsUpper(r) {
+				upper++
+			}
+		}
+	}
+	return letters >= 20 && float64(upper)/float64(letters) > 0.7
+}
+
+// hasRepetition reports whether any character other than a space repeats n
+// times in a row, as in "!!!!!!" or "sooooooo".
+func hasRepetition(text string, n int) bool {
+	var last rune
+	run := 0
+	for _, r := range text {
+		if r == last && !unicode.IsSpace(r) {
+			run++
+			if run >= n {
+				return true
+			}
+		} else {
+			last, run = r, 1
+		}
+	}
+	return false
+}
@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestContentScreenerScreen(t *testing.T) {
+	screener := NewContentScreener([]string{"scam", "  free money ", ""}, 1)
+	tests := []struct {
+		text        string
+		wantFlags   []string
+		wantMatched []string
+	}{
+		{text: "Works well, sturdy and quiet."},
+		{text: "Total SCAM, avoid.", wantFlags: []string{flagBannedWords}, wantMatched: []string{"scam"}},
+		{text: "Get free money now", wantFlags: []string{flagBannedWords}, wantMatched: []string{"free money"}},
+		{text: "It was free, and money well spent."},
+		{text: "Scammer-proof lock."},
+		{text: "See https://example.com for details."},
+		{text: "See https://a.example and www.b.example", wantFlags: []string{flagLinks}},
+		{text: "Mail me at someone@example.com", wantFlags: []string{flagContactDetails}},
+		{text: "Call +1 555-123-4567 today", wantFlags: []string{flagContactDetails}},
+		{text: "THIS IS THE BEST PRODUCT I HAVE EVER BOUGHT", wantFlags: []string{flagShouting}},
+		{text: "OK BUT SHORT"},
+		{text: "Sooooooo good!!!!!!", wantFlags: []string{flagRepetition}},
+		{
+			text:        "SCAM SCAM SCAM, VISIT WWW.X.EXAMPLE AND WWW.Y.EXAMPLE!!!!!!",
+			wantFlags:   []string{flagBannedWords, flagLinks, flagShouting, flagRepetition},
+			wantMatched: []string{"scam"},
+		},
+	}
+	for _, tt := range tests {
+		got := screener.Screen(tt.text)
+		if !reflect.DeepEqual(got.Flags, tt.wantFlags) {
+			t.Errorf("Screen(%q).Flags = %v, want %v", tt.text, got.Flags, tt.wantFlags)
+		}
+		if !reflect.DeepEqual(got.Matched, tt.wantMatched) {
+			t.Errorf("Screen(%q).Matched = %v, want %v", tt.text, got.Matched, tt.wantMatched)
+		}
+		if got.Flagged() != (len(tt.wantFlags) > 0) {
+			t.Errorf("Screen(%q).Flagged() = %v", tt.text, got.Flagged())
+		}
+	}
+}
+
+func TestContentScreenerNil(t *testing.T) {
+	var screener *ContentScreener
+	if got := screener.Screen("SCAM!!!!!! www.example.com"); got.Flagged() {
+		t.Errorf("nil screener flagged %v", got.Flags)
+	}
+}
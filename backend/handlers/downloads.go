@@ -0,0 +1,499 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"backend/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// downloadsDir is where the files of digital products are kept unless
+	// DOWNLOADS_DIR says otherwise. Unlike imagesDir it is not served by
+	// the frontend; files only leave it through Downloads.Download.
+	downloadsDir = "/home/caijiayi/online-shopping-mall/private/downloads"
+
+	defaultDownloadLinkTTL = 72 * time.Hour
+	defaultDownloadLimit   = 5
+)
+
+// Downloads stores the private files of digital products and serves them to
+// buyers. When an order is approved its buyer is granted Limit downloads of
+// each file within LinkTTL, through links signed with Secret. Links point at
+// BaseURL, where browsers reach this server.
+type Downloads struct {
+	DB      *gorm.DB
+	Logger  *log.Logger
+	Dir     string
+	Secret  []byte
+	BaseURL string
+	LinkTTL time.Duration
+	Limit   int
+}
+
+// DownloadLink is a download granted with an order. URL is left out once
+// the grant has expired or been used up.
+type DownloadLink struct {
+	ProductID     uint      `json:"product_id"`
+	FileName      string    `json:"file_name"`
+	URL           string    `json:"url,omitempty"`
+	ExpiresAt     time.Time `json:"expires_at"`
+	DownloadsLeft int       `json:"downloads_left"`
+}
+
+// NewDownloadsFromEnv creates Downloads keeping files in DOWNLOADS_DIR
+// (default downloadsDir), which must be outside the public images. Links
+// are signed with DOWNLOAD_SECRET and last DOWNLOAD_LINK_TTL (default 72h)
+// for DOWNLOAD_LIMIT downloads (default 5). They are built on
+// DOWNLOAD_BASE_URL, by default STORE_URL with the /api prefix the
+// storefront forwards to this server. Without DOWNLOAD_SECRET or a base
+// URL, orders still get their grants but no links are handed out or served.
+func NewDownloadsFromEnv(db *gorm.DB, logger *log.Logger) (*Downloads, error) {
+	dir := os.Getenv("DOWNLOADS_DIR")
+	if dir == "" {
+		dir = downloadsDir
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DOWNLOADS_DIR: %v", err)
+	}
+	if rel, err := filepath.Rel(imagesDir, dir); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, fmt.Errorf("DOWNLOADS_DIR must be outside the public images directory %s", imagesDir)
+	}
+
+	ttl := defaultDownloadLinkTTL
+	if s := os.Getenv("DOWNLOAD_LINK_TTL"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid DOWNLOAD_LINK_TTL: %q", s)
+		}
+		ttl = d
+	}
+	limit := defaultDownloadLimit
+	if s := os.Getenv("DOWNLOAD_LIMIT"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid DOWNLOAD_LIMIT: %q", s)
+		}
+		limit = n
+	}
+	baseURL := strings.TrimSuffix(os.Getenv("DOWNLOAD_BASE_URL"), "/")
+	if baseURL != "" {
+		if u, err := url.Parse(baseURL); err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("invalid DOWNLOAD_BASE_URL: %q", baseURL)
+		}
+	} else {
+		u, err := storeURLFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		if u != nil {
+			baseURL = u.String() + "/api"
+		}
+	}
+	return &Downloads{
+		DB:      db,
+		Logger:  logger,
+		Dir:     dir,
+		Secret:  []byte(os.Getenv("DOWNLOAD_SECRET")),
+		BaseURL: baseURL,
+		LinkTTL: ttl,
+		Limit:   limit,
+	}, nil
+}
+
+// UploadProductFile attaches the file sent as "file" to a product, making
+// it a digital product. A file it already had is replaced, including for
+// orders that were granted it earlier.
+func (d *Downloads) UploadProductFile(c *gin.Context) {
+	productID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid product ID"})
+		return
+	}
+	var count int64
+	if err := d.DB.Table("products").Where("id = ?", productID).Count(&count).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if count == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+		return
+	}
+
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A file is required"})
+		return
+	}
+	stored, contentType, err := d.saveFile(fileHeader)
+	if err != nil {
+		d.Logger.Printf("Error saving file for product %d: %v", productID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unable to save file"})
+		return
+	}
+
+	file := models.ProductFile{
+		ProductID:   uint(productID),
+		FileName:    filepath.Base(fileHeader.Filename),
+		StoredName:  stored,
+		ContentType: contentType,
+		Size:        fileHeader.Size,
+	}
+	var previous string
+	err = d.DB.Transaction(func(tx *gorm.DB) error {
+		var existing models.ProductFile
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("product_id = ?", productID).First(&existing).Error
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			return tx.Create(&file).Error
+		case err != nil:
+			return err
+		}
+		previous = existing.StoredName
+		file.ID = existing.ID
+		file.CreatedAt = existing.CreatedAt
+		return tx.Save(&file).Error
+	})
+	if err != nil {
+		d.removeFile(stored)
+		d.Logger.Printf("Error recording file for product %d: %v", productID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if previous != "" {
+		d.removeFile(previous)
+	}
+
+	d.Logger.Printf("Saved file %s (%d bytes) for product %d", file.FileName, file.Size, productID)
+	c.JSON(http.StatusOK, file)
+}
+
+// RemoveProductFile detaches a product's file, so it is no longer a digital
+// product. Links already handed out for it stop working.
+func (d *Downloads) RemoveProductFile(c *gin.Context) {
+	productID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid product ID"})
+		return
+	}
+
+	var file models.ProductFile
+	if err := d.DB.Where("product_id = ?", productID).First(&file).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product has no file"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if err := d.DB.Delete(&file).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	d.removeFile(file.StoredName)
+
+	c.Status(http.StatusNoContent)
+}
+
+// saveFile copies an upload into Dir under a random name, returning that
+// name and the content type sniffed from the file.
+func (d *Downloads) saveFile(fileHeader *multipart.FileHeader) (string, string, error) {
+	src, err := fileHeader.Open()
+	if err != nil {
+		return "", "", err
+	}
+	defer src.Close()
+
+	if err := os.MkdirAll(d.Dir, 0700); err != nil {
+		return "", "", err
+	}
+	name := make([]byte, 16)
+	if _, err := rand.Read(name); err != nil {
+		return "", "", err
+	}
+	stored := hex.EncodeToString(name)
+	dst, err := os.OpenFile(filepath.Join(d.Dir, stored), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", "", err
+	}
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(src, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		dst.Close()
+		d.removeFile(stored)
+		return "", "", err
+	}
+	head = head[:n]
+	_, err = dst.Write(head)
+	if err == nil {
+		_, err = io.Copy(dst, src)
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		d.removeFile(stored)
+		return "", "", err
+	}
+	return stored, http.DetectContentType(head), nil
+}
+
+func (d *Downloads) removeFile(stored string) {
+	path := filepath.Join(d.Dir, filepath.Base(stored))
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		d.Logger.Printf("Error removing file %s: %v", path, err)
+	}
+}
+
+// issueGrants grants an approved order's buyer the files of the digital
+// products on it, bundle components included. It does nothing on nil
+// Downloads.
+func (d *Downloads) issueGrants(tx *gorm.DB, orderID uint, lines []models.OrderProduct) error {
+	if d == nil || len(lines) == 0 {
+		return nil
+	}
+	productIDs := make([]uint, 0, len(lines))
+	for _, line := range lines {
+		productIDs = append(productIDs, line.ProductID)
+	}
+	var files []models.ProductFile
+	if err := tx.Where("product_id IN ?", productIDs).Find(&files).Error; err != nil {
+		return err
+	}
+
+	expires := time.Now().Add(d.LinkTTL).Truncate(time.Second)
+	for _, file := range files {
+		grant := models.DownloadGrant{
+			OrderID:      orderID,
+			ProductID:    file.ProductID,
+			MaxDownloads: d.Limit,
+			ExpiresAt:    expires,
+		}
+		// A webhook delivered twice must not reset the count
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&grant).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var errGuestDigital = errors.New("digital products need an account")
+
+// checkGuestDigital rejects guest carts holding digital products, bundle
+// components included. Download links are only handed to the account that
+// placed the order, so a guest would pay for a file they cannot fetch.
+func checkGuestDigital(db *gorm.DB, userID *uint, items []CartItem) error {
+	if userID != nil {
+		return nil
+	}
+	var ids []int
+	for _, item := range items {
+		ids = append(ids, item.ID)
+		for _, comp := range item.Components {
+			ids = append(ids, comp.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	var digital []int
+	if err := db.Model(&models.ProductFile{}).Where("product_id IN ?", ids).Limit(1).Pluck("product_id", &digital).Error; err != nil {
+		return err
+	}
+	if len(digital) > 0 {
+		return fmt.Errorf("%w: log in to buy product %d", errGuestDigital, digital[0])
+	}
+	return nil
+}
+
+// links returns the downloads granted with each of the orders. It returns
+// nothing while DOWNLOAD_SECRET or the base URL is not set.
+func (d *Downloads) links(orderIDs []uint) (map[uint][]DownloadLink, error) {
+	if d == nil || len(d.Secret) == 0 || d.BaseURL == "" || len(orderIDs) == 0 {
+		return nil, nil
+	}
+	var grants []struct {
+		models.DownloadGrant
+		FileName string
+	}
+	err := d.DB.Table("download_grants").
+		Select("download_grants.*, product_files.file_name").
+		Joins("JOIN product_files ON product_files.product_id = download_grants.product_id").
+		Where("download_grants.order_id IN ?", orderIDs).
+		Order("download_grants.id").
+		Scan(&grants).Error
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	links := make(map[uint][]DownloadLink)
+	for _, g := range grants {
+		link := DownloadLink{
+			ProductID:     g.ProductID,
+			FileName:      g.FileName,
+			ExpiresAt:     g.ExpiresAt,
+			DownloadsLeft: max(g.MaxDownloads-g.Downloads, 0),
+		}
+		if link.DownloadsLeft > 0 && now.Before(g.ExpiresAt) {
+			expires := g.ExpiresAt.Unix()
+			link.URL = fmt.Sprintf("%s/downloads/%d?expires=%d&sig=%s", d.BaseURL, g.ID, expires, d.sign(g.ID, expires))
+		}
+		links[g.OrderID] = append(links[g.OrderID], link)
+	}
+	return links, nil
+}
+
+// OrderDownloads is the downloads granted with one of a customer's orders.
+type OrderDownloads struct {
+	OrderID   uint           `json:"order_id"`
+	Invoice   string         `json:"invoice"`
+	Downloads []DownloadLink `json:"downloads"`
+}
+
+// MyDownloads returns the download links of the logged-in user's approved
+// orders, newest first. Links are only handed out here, to the account that
+// placed the order; guest orders have no account to hand them to.
+func (d *Downloads) MyDownloads(c *gin.Context) {
+	user := c.MustGet("user").(models.User)
+
+	var orders []models.Order
+	err := d.DB.Select("id", "invoice").
+		Where("user_id = ? AND status = ?", user.ID, "approved").
+		Order("created_at DESC, id DESC").
+		Find(&orders).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	orderIDs := make([]uint, 0, len(orders))
+	for _, o := range orders {
+		orderIDs = append(orderIDs, o.ID)
+	}
+	links, err := d.links(orderIDs)
+	if err != nil {
+		d.Logger.Printf("Error loading downloads of user %d: %v", user.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	result := []OrderDownloads{}
+	for _, o := range orders {
+		if len(links[o.ID]) > 0 {
+			result = append(result, OrderDownloads{OrderID: o.ID, Invoice: o.Invoice, Downloads: links[o.ID]})
+		}
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// sign is the signature of the download link for a grant.
+func (d *Downloads) sign(grantID uint, expires int64) string {
+	mac := hmac.New(sha256.New, d.Secret)
+	fmt.Fprintf(mac, "%d:%d", grantID, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Download serves the file behind a signed download link, counting the
+// download against its grant. Files are sent whole, without range support,
+// so that every request is one download.
+func (d *Downloads) Download(c *gin.Context) {
+	if len(d.Secret) == 0 {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Downloads need DOWNLOAD_SECRET to be set"})
+		return
+	}
+	grantID, err := strconv.ParseUint(c.Param("id"), 10, 0)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Download not found"})
+		return
+	}
+	expires, err := strconv.ParseInt(c.Query("expires"), 10, 64)
+	if err != nil || !hmac.Equal([]byte(c.Query("sig")), []byte(d.sign(uint(grantID), expires))) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid download link"})
+		return
+	}
+	if time.Now().Unix() >= expires {
+		c.JSON(http.StatusGone, gin.H{"error": "Download link has expired"})
+		return
+	}
+
+	var grant models.DownloadGrant
+	if err := d.DB.First(&grant, grantID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Download not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if grant.ExpiresAt.Unix() != expires {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid download link"})
+		return
+	}
+
+	var file models.ProductFile
+	if err := d.DB.Where("product_id = ?", grant.ProductID).First(&file).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusGone, gin.H{"error": "File is no longer available"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	f, err := os.Open(filepath.Join(d.Dir, filepath.Base(file.StoredName)))
+	if err != nil {
+		d.Logger.Printf("Error opening file for product %d: %v", file.ProductID, err)
+		c.JSON(http.StatusGone, gin.H{"error": "File is no longer available"})
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unable to read file"})
+		return
+	}
+
+	// Counted only once the file is known to be there
+	result := d.DB.Model(&models.DownloadGrant{}).
+		Where("id = ? AND downloads < max_downloads", grant.ID).
+		UpdateColumn("downloads", gorm.Expr("downloads + 1"))
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusGone, gin.H{"error": "Download limit reached"})
+		return
+	}
+
+	contentType := file.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	c.Header("Cache-Control", "private, no-store")
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.DataFromReader(http.StatusOK, info.Size(), contentType, f, map[string]string{
+		"Content-Disposition": mime.FormatMediaType("attachment", map[string]string{"filename": file.FileName}),
+	})
+}
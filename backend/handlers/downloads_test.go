@@ -0,0 +1,206 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+)
+
+func TestDownloadsSign(t *testing.T) {
+	d := &Downloads{Secret: []byte("secret")}
+	sig := d.sign(7, 1700000000)
+	if sig != d.sign(7, 1700000000) {
+		t.Fatal("sign is not deterministic")
+	}
+	for _, other := range []string{
+		d.sign(8, 1700000000),
+		d.sign(7, 1700000001),
+		(&Downloads{Secret: []byte("other")}).sign(7, 1700000000),
+	} {
+		if other == sig {
+			t.Errorf("signature %q does not depend on the grant, expiry and secret", sig)
+		}
+	}
+}
+
+var (
+	grantColumns = []string{"id", "order_id", "product_id", "downloads", "max_downloads", "expires_at", "created_at"}
+	fileColumns  = []string{"id", "product_id", "file_name", "stored_name", "content_type", "size", "created_at", "updated_at"}
+)
+
+func TestDownload(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "abc123.pdf"), []byte("%PDF-1.7"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	expiresAt := time.Now().Add(time.Hour).Truncate(time.Second)
+	expires := expiresAt.Unix()
+
+	// expectGrant expects grant 7 to be looked up with its file
+	expectGrant := func(mock sqlmock.Sqlmock, storedName string) {
+		mock.ExpectQuery("SELECT \\* FROM `download_grants` WHERE `download_grants`.`id` = \\?").
+			WithArgs(7, 1).
+			WillReturnRows(sqlmock.NewRows(grantColumns).AddRow(7, 3, 12, 1, 5, expiresAt, expiresAt))
+		mock.ExpectQuery("SELECT \\* FROM `product_files` WHERE product_id = \\?").
+			WithArgs(12, 1).
+			WillReturnRows(sqlmock.NewRows(fileColumns).AddRow(2, 12, "Guide.pdf", storedName, "application/pdf", 8, expiresAt, expiresAt))
+	}
+	countDownload := regexp.QuoteMeta("UPDATE `download_grants` SET `downloads`=downloads + 1 WHERE id = ? AND downloads < max_downloads")
+
+	d := &Downloads{Dir: dir, Secret: []byte("secret"), Logger: log.New(io.Discard, "", 0)}
+	tests := []struct {
+		name    string
+		path    string
+		expect  func(mock sqlmock.Sqlmock)
+		want    int
+		secret  []byte
+		wantErr string
+	}{
+		{
+			name: "valid link",
+			path: fmt.Sprintf("/downloads/7?expires=%d&sig=%s", expires, d.sign(7, expires)),
+			expect: func(mock sqlmock.Sqlmock) {
+				expectGrant(mock, "abc123.pdf")
+				mock.ExpectExec(countDownload).WithArgs(7).WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			want: http.StatusOK,
+		},
+		{
+			name:    "bad signature",
+			path:    fmt.Sprintf("/downloads/7?expires=%d&sig=%s", expires, d.sign(8, expires)),
+			want:    http.StatusForbidden,
+			wantErr: "Invalid download link",
+		},
+		{
+			name:    "expiry moved",
+			path:    fmt.Sprintf("/downloads/7?expires=%d&sig=%s", expires+3600, d.sign(7, expires)),
+			want:    http.StatusForbidden,
+			wantErr: "Invalid download link",
+		},
+		{
+			name:    "expired",
+			path:    fmt.Sprintf("/downloads/7?expires=%d&sig=%s", expires-7200, d.sign(7, expires-7200)),
+			want:    http.StatusGone,
+			wantErr: "Download link has expired",
+		},
+		{
+			name: "signed for another expiry",
+			path: fmt.Sprintf("/downloads/7?expires=%d&sig=%s", expires+60, d.sign(7, expires+60)),
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT \\* FROM `download_grants`").
+					WillReturnRows(sqlmock.NewRows(grantColumns).AddRow(7, 3, 12, 1, 5, expiresAt, expiresAt))
+			},
+			want:    http.StatusForbidden,
+			wantErr: "Invalid download link",
+		},
+		{
+			name: "limit reached",
+			path: fmt.Sprintf("/downloads/7?expires=%d&sig=%s", expires, d.sign(7, expires)),
+			expect: func(mock sqlmock.Sqlmock) {
+				expectGrant(mock, "abc123.pdf")
+				mock.ExpectExec(countDownload).WithArgs(7).WillReturnResult(sqlmock.NewResult(0, 0))
+			},
+			want:    http.StatusGone,
+			wantErr: "Download limit reached",
+		},
+		{
+			name: "file missing on disk",
+			path: fmt.Sprintf("/downloads/7?expires=%d&sig=%s", expires, d.sign(7, expires)),
+			expect: func(mock sqlmock.Sqlmock) {
+				expectGrant(mock, "gone.pdf")
+			},
+			want:    http.StatusGone,
+			wantErr: "File is no longer available",
+		},
+		{
+			name:    "no secret",
+			path:    fmt.Sprintf("/downloads/7?expires=%d&sig=%s", expires, (&Downloads{}).sign(7, expires)),
+			secret:  []byte{},
+			want:    http.StatusServiceUnavailable,
+			wantErr: "Downloads need DOWNLOAD_SECRET to be set",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := newMockDB(t)
+			if tt.expect != nil {
+				tt.expect(mock)
+			}
+			downloads := *d
+			downloads.DB = db
+			if tt.secret != nil {
+				downloads.Secret = tt.secret
+			}
+			router := gin.New()
+			router.GET("/downloads/:id", downloads.Download)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+
+			if w.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if tt.wantErr != "" {
+				if want := `{"error":"` + tt.wantErr + `"}`; w.Body.String() != want {
+					t.Errorf("body %s, want %s", w.Body, want)
+				}
+			} else if w.Body.String() != "%PDF-1.7" || w.Header().Get("Cache-Control") != "private, no-store" {
+				t.Errorf("served %q with Cache-Control %q", w.Body, w.Header().Get("Cache-Control"))
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestCheckGuestDigital(t *testing.T) {
+	fileLookup := regexp.QuoteMeta("SELECT `product_id` FROM `product_files` WHERE product_id IN (?,?,?) LIMIT ?")
+	bundle := []CartItem{{ID: 4, Quantity: 1, Components: []CartItem{{ID: 12, Quantity: 1}}}, {ID: 5, Quantity: 2}}
+
+	t.Run("guest with a file in a bundle", func(t *testing.T) {
+		db, mock := newMockDB(t)
+		mock.ExpectQuery(fileLookup).WithArgs(4, 12, 5, 1).
+			WillReturnRows(sqlmock.NewRows([]string{"product_id"}).AddRow(12))
+		err := checkGuestDigital(db, nil, bundle)
+		if !errors.Is(err, errGuestDigital) {
+			t.Errorf("error = %v, want errGuestDigital", err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("guest without files", func(t *testing.T) {
+		db, mock := newMockDB(t)
+		mock.ExpectQuery(fileLookup).WithArgs(4, 12, 5, 1).
+			WillReturnRows(sqlmock.NewRows([]string{"product_id"}))
+		if err := checkGuestDigital(db, nil, bundle); err != nil {
+			t.Errorf("error = %v, want none", err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("logged in", func(t *testing.T) {
+		db, mock := newMockDB(t)
+		userID := uint(1)
+		if err := checkGuestDigital(db, &userID, bundle); err != nil {
+			t.Errorf("error = %v, want none", err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+}
@@ -0,0 +1,259 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// catalogTagKey is the context key under which Conditional leaves the
+// catalog validator for setETag.
+const catalogTagKey = "catalogTag"
+
+const (
+	defaultCatalogCacheControl = "public, max-age=60"
+	defaultCatalogCacheSize    = 1000
+	defaultCatalogCacheTTL     = 5 * time.Minute
+
+	// scheduleRetryDelay is how long to wait before looking up scheduled
+	// changes again after the lookup failed.
+	scheduleRetryDelay = 30 * time.Second
+)
+
+// CatalogCache hands out HTTP validators for the public catalog routes. Every
+// change to the catalog starts a new generation, which changes the ETag and
+// Last-Modified of all catalog responses at once. Changes that happen with
+// the passing of time, such as sales starting and ending or scheduled
+// products going live, start one when they are due. Query results cached
+// with Fetch are dropped with each new generation.
+type CatalogCache struct {
+	DB           *sql.DB
+	Logger       *log.Logger
+	CacheControl string
+
+	mu         sync.Mutex
+	generation int64
+	modified   time.Time
+	nextChange time.Time // zero when nothing is scheduled
+	stale      bool      // nextChange needs looking up again
+	lookingUp  bool      // a request is looking nextChange up
+	retryAt    time.Time // when to look it up again after a failure
+	queries    *queryCache
+}
+
+// NewCatalogCacheFromEnv creates a CatalogCache whose Cache-Control header
+// comes from CATALOG_CACHE_CONTROL (default "public, max-age=60"). The query
+// cache holds up to CATALOG_CACHE_SIZE results (default 1000, 0 disables
+// it) for at most CATALOG_CACHE_TTL (default 5m), which bounds how stale a
+// result can get from changes made by another server.
+func NewCatalogCacheFromEnv(db *sql.DB, logger *log.Logger) (*CatalogCache, error) {
+	cacheControl := os.Getenv("CATALOG_CACHE_CONTROL")
+	if cacheControl == "" {
+		cacheControl = defaultCatalogCacheControl
+	}
+
+	size := defaultCatalogCacheSize
+	if s := os.Getenv("CATALOG_CACHE_SIZE"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid CATALOG_CACHE_SIZE: %q", s)
+		}
+		size = n
+	}
+	ttl := defaultCatalogCacheTTL
+	if s := os.Getenv("CATALOG_CACHE_TTL"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid CATALOG_CACHE_TTL: %q", s)
+		}
+		ttl = d
+	}
+	now := time.Now().UTC()
+	// Generations start from the clock so a restart never reuses an ETag
+	// handed out before it
+	return &CatalogCache{
+		DB:           db,
+		Logger:       logger,
+		CacheControl: cacheControl,
+		generation:   now.UnixNano(),
+		modified:     now,
+		stale:        true,
+		queries:      newQueryCache(size, ttl),
+	}, nil
+}
+
+// Invalidate starts a new generation. It is safe to call on a nil cache.
+func (cc *CatalogCache) Invalidate() {
+	if cc == nil {
+		return
+	}
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.bump(time.Now().UTC())
+}
+
+func (cc *CatalogCache) bump(now time.Time) {
+	cc.generation++
+	cc.modified = now
+	cc.stale = true
+	cc.queries.clear()
+}
+
+// current returns the generation and when it started, first moving on to a
+// new one if a scheduled change has come due. One request at a time looks up
+// the next scheduled change, outside the lock; the others carry on with the
+// current generation meanwhile.
+func (cc *CatalogCache) current() (int64, time.Time) {
+	cc.mu.Lock()
+	now := time.Now().UTC()
+	if due := cc.nextChange; !due.IsZero() && !now.Before(due) {
+		// Fire each scheduled change once; the lookup below finds the next
+		cc.nextChange = time.Time{}
+		cc.bump(due)
+	}
+	generation, modified := cc.generation, cc.modified
+	lookUp := cc.stale && !cc.lookingUp && !now.Before(cc.retryAt)
+	if lookUp {
+		cc.lookingUp = true
+	}
+	cc.mu.Unlock()
+
+	if lookUp {
+		next, err := nextScheduledChange(cc.DB)
+		cc.mu.Lock()
+		cc.lookingUp = false
+		if err != nil {
+			// Keep the change already known and back off rather than query
+			// on every request while the database is struggling
+			cc.Logger.Printf("Error looking up scheduled catalog changes: %v", err)
+			cc.retryAt = now.Add(scheduleRetryDelay)
+		} else {
+			// The lookup is the newest schedule there is. If the catalog
+			// changed while it ran it may have missed that change, so the
+			// next request looks again
+			cc.nextChange = next
+			cc.stale = cc.generation != generation
+		}
+		cc.mu.Unlock()
+	}
+	return generation, modified
+}
+
+// nextScheduledChange returns when the catalog next changes by itself: a sale
+// starting or ending, or a scheduled product going live.
+func nextScheduledChange(db *sql.DB) (time.Time, error) {
+	var next sql.NullTime
+	err := db.QueryRow(`SELECT MIN(t) FROM (
+		SELECT MIN(starts_at) AS t FROM product_prices WHERE kind = 'sale' AND cancelled_at IS NULL AND starts_at > UTC_TIMESTAMP()
+		UNION ALL SELECT MIN(ends_at) FROM product_prices WHERE kind = 'sale' AND cancelled_at IS NULL AND ends_at > UTC_TIMESTAMP()
+		UNION ALL SELECT MIN(publish_at) FROM products WHERE status = 'scheduled' AND publish_at > UTC_TIMESTAMP()
+	) AS changes`).Scan(&next)
+	if err != nil || !next.Valid {
+		return time.Time{}, err
+	}
+	return next.Time, nil
+}
+
+// Conditional sets Cache-Control, ETag and Last-Modified on public catalog
+// responses and answers conditional GETs for an unchanged catalog with 304.
+// The ETag also covers Accept-Language, which picks the response's locale.
+func (cc *CatalogCache) Conditional() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead {
+			c.Next()
+			return
+		}
+		generation, modified := cc.current()
+		tag := "c" + strconv.FormatInt(generation, 36)
+		if lang := c.GetHeader("Accept-Language"); lang != "" {
+			h := fnv.New32a()
+			h.Write([]byte(lang))
+			tag += "-" + strconv.FormatUint(uint64(h.Sum32()), 36)
+		}
+		c.Set(catalogTagKey, tag)
+
+		header := c.Writer.Header()
+		header.Set("Cache-Control", cc.CacheControl)
+		header.Set("ETag", `"`+tag+`"`)
+		header.Set("Last-Modified", modified.Format(http.TimeFormat))
+		addVary(c, "Accept-Language")
+
+		if notModified(c, tag, modified) {
+			c.AbortWithStatus(http.StatusNotModified)
+			return
+		}
+		c.Writer = uncachedErrors{c.Writer}
+		c.Next()
+	}
+}
+
+// uncachedErrors keeps error responses out of caches: the validators
+// Conditional set belong to the catalog, not to a failed request.
+type uncachedErrors struct {
+	gin.ResponseWriter
+}
+
+func (w uncachedErrors) WriteHeader(code int) {
+	if code >= http.StatusBadRequest {
+		header := w.Header()
+		header.Del("ETag")
+		header.Del("Last-Modified")
+		header.Set("Cache-Control", "no-store")
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// notModified reports whether the client's copy is current. If-None-Match
+// takes precedence over If-Modified-Since, as RFC 9110 requires.
+func notModified(c *gin.Context, tag string, modified time.Time) bool {
+	if match := c.GetHeader("If-None-Match"); match != "" {
+		for _, candidate := range strings.Split(match, ",") {
+			candidate = strings.Trim(strings.TrimPrefix(strings.TrimSpace(candidate), "W/"), `"`)
+			// Record ETags carry the catalog validator after their version
+			if _, catalog, ok := strings.Cut(candidate, "+"); ok {
+				candidate = catalog
+			}
+			if candidate == "*" || candidate == tag {
+				return true
+			}
+		}
+		return false
+	}
+	if since, err := http.ParseTime(c.GetHeader("If-Modified-Since")); err == nil {
+		return !modified.Truncate(time.Second).After(since)
+	}
+	return false
+}
+
+// InvalidateOnWrite starts a new catalog generation after every successful
+// request that is not a GET or HEAD. Use it on routes that change what the
+// catalog shows.
+func (cc *CatalogCache) InvalidateOnWrite() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+		if c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead && c.Writer.Status() < 400 {
+			cc.Invalidate()
+		}
+	}
+}
+
+// addVary adds a field to the Vary header unless it is already listed.
+func addVary(c *gin.Context, field string) {
+	for _, v := range c.Writer.Header().Values("Vary") {
+		for _, f := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(f), field) {
+				return
+			}
+		}
+	}
+	c.Writer.Header().Add("Vary", field)
+}
@@ -0,0 +1,221 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+)
+
+const scheduleQuery = `SELECT MIN\(t\) FROM`
+
+// newTestCatalogCache returns a cache on a sqlmock connection whose log
+// ends up in the returned buffer.
+func newTestCatalogCache(t *testing.T) (*CatalogCache, sqlmock.Sqlmock, *bytes.Buffer) {
+	t.Helper()
+	conn, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	var logs bytes.Buffer
+	now := time.Now().UTC()
+	return &CatalogCache{
+		DB:           conn,
+		Logger:       log.New(&logs, "", 0),
+		CacheControl: defaultCatalogCacheControl,
+		generation:   1,
+		modified:     now,
+		stale:        true,
+		queries:      newQueryCache(10, time.Minute),
+	}, mock, &logs
+}
+
+func TestCatalogCacheScheduledChange(t *testing.T) {
+	cc, mock, _ := newTestCatalogCache(t)
+	due := time.Now().UTC().Add(-time.Second)
+	mock.ExpectQuery(scheduleQuery).WillReturnRows(sqlmock.NewRows([]string{"t"}).AddRow(due))
+	mock.ExpectQuery(scheduleQuery).WillReturnRows(sqlmock.NewRows([]string{"t"}).AddRow(nil))
+
+	first, _ := cc.current()
+	// The change has come due: one new generation, then a fresh lookup
+	second, modified := cc.current()
+	if second != first+1 {
+		t.Fatalf("generation after the scheduled change = %d, want %d", second, first+1)
+	}
+	if !modified.Equal(due) {
+		t.Errorf("modified = %v, want the scheduled time %v", modified, due)
+	}
+	for i := 0; i < 3; i++ {
+		if g, _ := cc.current(); g != second {
+			t.Fatalf("generation moved on to %d with nothing scheduled", g)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestCatalogCacheChangeFiresOnce checks that a scheduled change starts one
+// generation even when the lookup after it fails or races an Invalidate.
+func TestCatalogCacheChangeFiresOnce(t *testing.T) {
+	t.Run("lookup fails", func(t *testing.T) {
+		cc, mock, _ := newTestCatalogCache(t)
+		mock.ExpectQuery(scheduleQuery).WillReturnRows(sqlmock.NewRows([]string{"t"}).AddRow(time.Now().UTC().Add(-time.Second)))
+		mock.ExpectQuery(scheduleQuery).WillReturnError(errors.New("connection refused"))
+
+		first, _ := cc.current()
+		for i := 0; i < 3; i++ {
+			if g, _ := cc.current(); g != first+1 {
+				t.Fatalf("generation = %d during the backoff, want %d", g, first+1)
+			}
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("invalidated during the lookup", func(t *testing.T) {
+		cc, mock, _ := newTestCatalogCache(t)
+		mock.ExpectQuery(scheduleQuery).WillReturnRows(sqlmock.NewRows([]string{"t"}).AddRow(time.Now().UTC().Add(-time.Second)))
+		mock.ExpectQuery(scheduleQuery).WillDelayFor(50 * time.Millisecond).WillReturnRows(sqlmock.NewRows([]string{"t"}).AddRow(nil))
+		mock.ExpectQuery(scheduleQuery).WillReturnRows(sqlmock.NewRows([]string{"t"}).AddRow(nil))
+
+		first, _ := cc.current()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			time.Sleep(10 * time.Millisecond)
+			cc.Invalidate()
+		}()
+		cc.current()
+		<-done
+		for i := 0; i < 3; i++ {
+			if g, _ := cc.current(); g != first+2 {
+				t.Fatalf("generation = %d, want %d", g, first+2)
+			}
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestCatalogCacheKeepsQueriesUntilChange(t *testing.T) {
+	cc, mock, _ := newTestCatalogCache(t)
+	mock.ExpectQuery(scheduleQuery).WillReturnRows(sqlmock.NewRows([]string{"t"}).AddRow(time.Now().UTC().Add(time.Hour)))
+
+	loads := 0
+	load := func() (interface{}, error) {
+		loads++
+		return loads, nil
+	}
+	for i := 0; i < 3; i++ {
+		g, _ := cc.current()
+		if _, err := cc.queries.get("products", g, load); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if loads != 1 {
+		t.Errorf("loaded %d times before any change, want 1", loads)
+	}
+
+	cc.Invalidate()
+	mock.ExpectQuery(scheduleQuery).WillReturnRows(sqlmock.NewRows([]string{"t"}).AddRow(nil))
+	g, _ := cc.current()
+	if _, err := cc.queries.get("products", g, load); err != nil {
+		t.Fatal(err)
+	}
+	if loads != 2 {
+		t.Errorf("loaded %d times after Invalidate, want 2", loads)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCatalogCacheLookupErrorBacksOff(t *testing.T) {
+	cc, mock, logs := newTestCatalogCache(t)
+	mock.ExpectQuery(scheduleQuery).WillReturnError(errors.New("connection refused"))
+
+	first, _ := cc.current()
+	for i := 0; i < 3; i++ {
+		if g, _ := cc.current(); g != first {
+			t.Fatalf("generation moved on to %d after a failed lookup", g)
+		}
+	}
+	if n := strings.Count(logs.String(), "Error looking up"); n != 1 {
+		t.Errorf("looked up %d times during the backoff, want 1", n)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConditional(t *testing.T) {
+	cc, mock, _ := newTestCatalogCache(t)
+	mock.ExpectQuery(scheduleQuery).WillReturnRows(sqlmock.NewRows([]string{"t"}).AddRow(nil))
+
+	router := gin.New()
+	router.GET("/products", cc.Conditional(), func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"products": []string{}})
+	})
+	router.GET("/broken", cc.Conditional(), func(c *gin.Context) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+	})
+	serve := func(path string, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := serve("/products", nil)
+	etag, lastModified := w.Header().Get("ETag"), w.Header().Get("Last-Modified")
+	if w.Code != http.StatusOK || etag == "" || lastModified == "" {
+		t.Fatalf("first response: %d, ETag %q, Last-Modified %q", w.Code, etag, lastModified)
+	}
+	tag := strings.Trim(etag, `"`)
+
+	tests := []struct {
+		name   string
+		header map[string]string
+		want   int
+	}{
+		{"matching ETag", map[string]string{"If-None-Match": etag}, http.StatusNotModified},
+		{"weak ETag in a list", map[string]string{"If-None-Match": `"x", W/` + etag}, http.StatusNotModified},
+		{"record ETag", map[string]string{"If-None-Match": `"7+` + tag + `"`}, http.StatusNotModified},
+		{"star", map[string]string{"If-None-Match": "*"}, http.StatusNotModified},
+		{"other ETag", map[string]string{"If-None-Match": `"c0"`}, http.StatusOK},
+		{"ETag wins over date", map[string]string{"If-None-Match": `"c0"`, "If-Modified-Since": lastModified}, http.StatusOK},
+		{"not modified since", map[string]string{"If-Modified-Since": lastModified}, http.StatusNotModified},
+		{"modified since", map[string]string{"If-Modified-Since": time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)}, http.StatusOK},
+		{"other locale", map[string]string{"If-None-Match": etag, "Accept-Language": "zh-HK"}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		if w := serve("/products", tt.header); w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+
+	cc.Invalidate()
+	mock.ExpectQuery(scheduleQuery).WillReturnRows(sqlmock.NewRows([]string{"t"}).AddRow(nil))
+	if w := serve("/products", map[string]string{"If-None-Match": etag}); w.Code != http.StatusOK {
+		t.Errorf("after Invalidate: status %d, want 200", w.Code)
+	}
+
+	w = serve("/broken", nil)
+	if w.Header().Get("ETag") != "" || w.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("error response kept validators: ETag %q, Cache-Control %q", w.Header().Get("ETag"), w.Header().Get("Cache-Control"))
+	}
+}
@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// imagesDir is where uploaded product images are written; the frontend
+	// serves it as /images.
+	imagesDir = "/home/caijiayi/online-shopping-mall/public/images"
+
+	thumbnailSize = 300
+)
+
+// uploadError is an image upload failure together with the HTTP status and
+// message that should be reported to the client.
+type uploadError struct {
+	Status  int
+	Message string
+	Err     error
+}
+
+func (e *uploadError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %v", e.Message, e.Err)
+	}
+	return e.Message
+}
+
+// savedImage describes the files written for one uploaded image.
+type savedImage struct {
+	ImageURL     string
+	ThumbnailURL string
+}
+
+// saveUploadedImage validates an uploaded image, stores the original and
+// produces a thumbnail for it. Images already within the thumbnail size are
+// used as their own thumbnail.
+func saveUploadedImage(fileHeader *multipart.FileHeader, logger *log.Logger) (savedImage, error) {
+	file, err := fileHeader.Open()
+	if err != nil {
+		return savedImage{}, &uploadError{http.StatusBadRequest, "Unable to open file", err}
+	}
+	defer file.Close()
+
+	fileBytes, err := io.ReadAll(file)
+	if err != nil {
+		return savedImage{}, &uploadError{http.StatusInternalServerError, "Unable to read file", err}
+	}
+	return saveImageBytes(fileHeader.Filename, fileBytes, logger)
+}
+
+// saveImageBytes is saveUploadedImage for image data that is already in
+// memory. filename is only used for its extension and for logging.
+func saveImageBytes(filename string, fileBytes []byte, logger *log.Logger) (savedImage, error) {
+	// Verify file type before anything is written to disk
+	contentType := http.DetectContentType(fileBytes)
+	if !strings.Contains(contentType, "image/") {
+		return savedImage{}, &uploadError{Status: http.StatusBadRequest, Message: fmt.Sprintf("Invalid file type: %s. Only image files are allowed.", contentType)}
+	}
+
+	img, err := imaging.Decode(bytes.NewReader(fileBytes))
+	if err != nil {
+		return savedImage{}, &uploadError{http.StatusBadRequest, "The image file appears to be corrupted or in an unsupported format. Please try with a valid JPG, PNG or GIF image.", err}
+	}
+
+	if err := os.MkdirAll(imagesDir, 0755); err != nil {
+		return savedImage{}, &uploadError{http.StatusInternalServerError, "Failed to create images directory", err}
+	}
+
+	// Create unique filename
+	newFilename := fmt.Sprintf("%d%s", time.Now().UnixNano(), filepath.Ext(filename))
+	originalName := "original_" + newFilename
+	if err := os.WriteFile(filepath.Join(imagesDir, originalName), fileBytes, 0644); err != nil {
+		return savedImage{}, &uploadError{http.StatusInternalServerError, "Unable to save file", err}
+	}
+	saved := savedImage{ImageURL: "/images/" + originalName, ThumbnailURL: "/images/" + originalName}
+
+	bounds := img.Bounds()
+	if bounds.Dx() > thumbnailSize || bounds.Dy() > thumbnailSize {
+		thumbnailName := "thumbnail_" + newFilename
+		thumbnail := imaging.Resize(img, thumbnailSize, thumbnailSize, imaging.Lanczos)
+		if err := imaging.Save(thumbnail, filepath.Join(imagesDir, thumbnailName)); err != nil {
+			return savedImage{}, &uploadError{http.StatusInternalServerError, "Unable to save thumbnail", err}
+		}
+		saved.ThumbnailURL = "/images/" + thumbnailName
+	}
+
+	logger.Printf("Saved image %s (%dx%d) as %s", filename, bounds.Dx(), bounds.Dy(), saved.ImageURL)
+	return saved, nil
+}
+
+// respondUploadError reports a failed upload with the status carried by an
+// uploadError.
+func respondUploadError(c *gin.Context, logger *log.Logger, err error) {
+	logger.Printf("Error saving image: %v", err)
+	var upErr *uploadError
+	if errors.As(err, &upErr) {
+		c.JSON(upErr.Status, gin.H{"error": upErr.Message})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "Unable to save file"})
+}
+
+// removeImageFiles deletes the files behind image URLs produced by
+// saveUploadedImage. Missing files are ignored.
+func removeImageFiles(urls ...string) {
+	for _, url := range urls {
+		if !strings.HasPrefix(url, "/images/") {
+			continue
+		}
+		path := filepath.Join(imagesDir, filepath.Base(url))
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Error removing image %s: %v", path, err)
+		}
+	}
+}
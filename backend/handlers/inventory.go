@@ -0,0 +1,338 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"backend/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// reservationTTL is how long a pending order holds its stock before the
+// sweeper gives it back.
+const reservationTTL = 30 * time.Minute
+
+// InsufficientStockError is returned when a product cannot cover the
+// requested quantity.
+type InsufficientStockError struct {
+	ProductID int
+	VariantID *uint
+	Requested int
+}
+
+func (e *InsufficientStockError) Error() string {
+	return fmt.Sprintf("insufficient stock for product %d (requested %d)", e.ProductID, e.Requested)
+}
+
+// stockKey identifies the row that holds stock for a cart line: the variant
+// when one was chosen, otherwise the product itself.
+type stockKey struct {
+	ProductID int
+	VariantID uint
+}
+
+// stockUpdate returns the statement that adjusts the stock behind a key by
+// the sign given in op ("+" or "-").
+func stockUpdate(productID uint, variantID *uint, op string) (string, uint) {
+	if variantID != nil {
+		return "UPDATE product_variants SET stock = stock " + op + " ? WHERE id = ?", *variantID
+	}
+	return "UPDATE products SET stock = stock " + op + " ? WHERE id = ?", productID
+}
+
+// cartStock adds up how much of each stock row the cart items take, bundles
+// taking their components' stock.
+func cartStock(items []CartItem) map[stockKey]int {
+	quantities := make(map[stockKey]int)
+	for _, item := range items {
+		lines := []CartItem{item}
+		if len(item.Components) > 0 {
+			lines = item.Components
+		}
+		for _, line := range lines {
+			key := stockKey{ProductID: line.ID}
+			if line.VariantID != nil {
+				key.VariantID = *line.VariantID
+			}
+			quantities[key] += line.Quantity
+		}
+	}
+	return quantities
+}
+
+// sortedStockKeys returns the keys of quantities by product, then variant.
+func sortedStockKeys(quantities map[stockKey]int) []stockKey {
+	keys := make([]stockKey, 0, len(quantities))
+	for key := range quantities {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].ProductID != keys[j].ProductID {
+			return keys[i].ProductID < keys[j].ProductID
+		}
+		return keys[i].VariantID < keys[j].VariantID
+	})
+	return keys
+}
+
+// soldOut reports whether any of the stock rows behind keys has run out.
+// Taking stock only changes what the catalog shows when it sells something
+// out, so checkouts check this rather than invalidate the catalog every time.
+func soldOut(db *gorm.DB, keys []stockKey) (bool, error) {
+	var productIDs []int
+	var variantIDs []uint
+	for _, key := range keys {
+		if key.VariantID != 0 {
+			variantIDs = append(variantIDs, key.VariantID)
+		} else {
+			productIDs = append(productIDs, key.ProductID)
+		}
+	}
+	var out int64
+	if len(productIDs) > 0 {
+		if err := db.Table("products").Where("id IN ? AND stock <= 0", productIDs).Count(&out).Error; err != nil {
+			return false, err
+		}
+	}
+	if out == 0 && len(variantIDs) > 0 {
+		if err := db.Table("product_variants").Where("id IN ? AND stock <= 0", variantIDs).Count(&out).Error; err != nil {
+			return false, err
+		}
+	}
+	return out > 0, nil
+}
+
+// reserveStock takes stock for every cart item and records a reservation
+// against the order. It must run inside the transaction that creates the
+// order. The conditional UPDATE locks the stock row, so two checkouts racing
+// for the last unit cannot both succeed. Bundles take their components'
+// stock rather than their own.
+func reserveStock(tx *gorm.DB, orderID uint, items []CartItem) error {
+	quantities := cartStock(items)
+
+	// Lock rows in a fixed order so concurrent checkouts cannot deadlock.
+	keys := sortedStockKeys(quantities)
+
+	expiresAt := time.Now().Add(reservationTTL)
+	for _, key := range keys {
+		qty := quantities[key]
+		var variantID *uint
+		if key.VariantID != 0 {
+			id := key.VariantID
+			variantID = &id
+		}
+
+		query, id := stockUpdate(uint(key.ProductID), variantID, "-")
+		// Archived products are no longer for sale
+		if variantID != nil {
+			query += " AND product_id IN (SELECT id FROM products WHERE archived_at IS NULL)"
+		} else {
+			query += " AND archived_at IS NULL"
+		}
+		res := tx.Exec(query+" AND stock >= ?", qty, id, qty)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return &InsufficientStockError{ProductID: key.ProductID, VariantID: variantID, Requested: qty}
+		}
+
+		reservation := models.StockReservation{
+			OrderID:   orderID,
+			ProductID: uint(key.ProductID),
+			VariantID: variantID,
+			Quantity:  qty,
+			Status:    models.ReservationReserved,
+			ExpiresAt: expiresAt,
+		}
+		if err := tx.Create(&reservation).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseReservations returns the stock held by an order's open reservations.
+func releaseReservations(tx *gorm.DB, orderID uint) error {
+	var reservations []models.StockReservation
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("order_id = ? AND status = ?", orderID, models.ReservationReserved).
+		Find(&reservations).Error
+	if err != nil {
+		return err
+	}
+
+	for _, r := range reservations {
+		query, id := stockUpdate(r.ProductID, r.VariantID, "+")
+		if err := tx.Exec(query, r.Quantity, id).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&r).Update("status", models.ReservationReleased).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// commitReservations turns an order's reservations into a sale. If the
+// payment arrived after the sweeper released the stock, the units are taken
+// again; anything that can no longer be covered is logged for follow-up
+// rather than driving stock negative. It returns the stock rows it took
+// units from again.
+func commitReservations(tx *gorm.DB, orderID uint) ([]stockKey, error) {
+	var reservations []models.StockReservation
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("order_id = ? AND status <> ?", orderID, models.ReservationCommitted).
+		Find(&reservations).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var retaken []stockKey
+	for _, r := range reservations {
+		if r.Status == models.ReservationReleased {
+			query, id := stockUpdate(r.ProductID, r.VariantID, "-")
+			res := tx.Exec(query+" AND stock >= ?", r.Quantity, id, r.Quantity)
+			if res.Error != nil {
+				return nil, res.Error
+			}
+			if res.RowsAffected == 0 {
+				log.Printf("WARN: order %d was paid after its reservation expired; product %d is short by %d", orderID, r.ProductID, r.Quantity)
+			} else {
+				key := stockKey{ProductID: int(r.ProductID)}
+				if r.VariantID != nil {
+					key.VariantID = *r.VariantID
+				}
+				retaken = append(retaken, key)
+			}
+		}
+		if err := tx.Model(&r).Update("status", models.ReservationCommitted).Error; err != nil {
+			return nil, err
+		}
+	}
+	return retaken, nil
+}
+
+// releaseExpiredReservations releases reservations whose orders were never
+// paid and marks those orders as expired. It returns how many orders it
+// released.
+func releaseExpiredReservations(db *gorm.DB) (int, error) {
+	var orderIDs []uint
+	err := db.Model(&models.StockReservation{}).
+		Where("status = ? AND expires_at < ?", models.ReservationReserved, time.Now()).
+		Distinct().Pluck("order_id", &orderIDs).Error
+	if err != nil {
+		return 0, err
+	}
+
+	for i, orderID := range orderIDs {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := releaseReservations(tx, orderID); err != nil {
+				return err
+			}
+			return tx.Model(&models.Order{}).
+				Where("id = ? AND status = ?", orderID, "pending").
+				Update("status", "expired").Error
+		})
+		if err != nil {
+			return i, fmt.Errorf("release order %d: %w", orderID, err)
+		}
+		log.Printf("Released expired stock reservations for order %d", orderID)
+	}
+	return len(orderIDs), nil
+}
+
+// RunReservationSweeper periodically releases expired reservations until ctx
+// is cancelled. Released stock invalidates the catalog's HTTP validators.
+func RunReservationSweeper(ctx context.Context, db *gorm.DB, interval time.Duration, catalog *CatalogCache) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			released, err := releaseExpiredReservations(db)
+			if err != nil {
+				log.Printf("Error releasing expired reservations: %v", err)
+			}
+			if released > 0 {
+				catalog.Invalidate()
+			}
+		}
+	}
+}
+
+// UpdateStock sets a product's stock. The form takes either "stock" for an
+// absolute quantity or "delta" for a relative adjustment; deltas are safer
+// while checkouts are reserving units concurrently.
+func (h *ProductHandler) UpdateStock(c *gin.Context) {
+	productID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid product ID"})
+		return
+	}
+
+	var query string
+	var args []interface{}
+	delta := 0
+	if s, ok := c.GetPostForm("stock"); ok {
+		stock, err := strconv.Atoi(s)
+		if err != nil || stock < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid stock"})
+			return
+		}
+		query = `UPDATE products SET stock = ? WHERE id = ?`
+		args = []interface{}{stock, productID}
+	} else if s, ok := c.GetPostForm("delta"); ok {
+		delta, err = strconv.Atoi(s)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid delta"})
+			return
+		}
+		query = `UPDATE products SET stock = stock + ? WHERE id = ? AND stock + ? >= 0`
+		args = []interface{}{delta, productID, delta}
+	} else {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "stock or delta is required"})
+		return
+	}
+
+	result, err := h.DB.Exec(query, args...)
+	if err != nil {
+		h.Logger.Printf("Error updating stock: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	row := h.DB.QueryRow("SELECT "+productColumns+" FROM products WHERE id = ?", productID)
+	p, err := scanProduct(row)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if delta != 0 && rowsAffected == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Stock cannot go below zero", "stock": p.Stock})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"id": p.ID, "stock": p.Stock})
+}
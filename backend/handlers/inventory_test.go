@@ -0,0 +1,217 @@
+package handlers
+
+import (
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	"backend/models"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// newMockDB returns a gorm handle on a sqlmock connection. Statements are
+// expected in order.
+func newMockDB(t *testing.T) (*gorm.DB, sqlmock.Sqlmock) {
+	t.Helper()
+	conn, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	db, err := gorm.Open(mysql.New(mysql.Config{Conn: conn, SkipInitializeWithVersion: true}), &gorm.Config{
+		SkipDefaultTransaction: true,
+		Logger:                 logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, mock
+}
+
+var reservationColumns = []string{"id", "order_id", "product_id", "variant_id", "quantity", "status", "expires_at", "created_at", "updated_at"}
+
+func TestReserveStock(t *testing.T) {
+	db, mock := newMockDB(t)
+	variantID := uint(31)
+	items := []CartItem{
+		{ID: 9, Quantity: 1},
+		{ID: 7, Quantity: 2},
+		{ID: 9, Quantity: 2},
+		{ID: 8, VariantID: &variantID, Quantity: 1},
+	}
+
+	// Rows are taken in product order, with the lines for one product
+	// added together
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE products SET stock = stock - ? WHERE id = ? AND archived_at IS NULL AND stock >= ?")).
+		WithArgs(2, 7, 2).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO `stock_reservations`").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE product_variants SET stock = stock - ? WHERE id = ? AND product_id IN (SELECT id FROM products WHERE archived_at IS NULL) AND stock >= ?")).
+		WithArgs(1, 31, 1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO `stock_reservations`").WillReturnResult(sqlmock.NewResult(2, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE products SET stock = stock - ? WHERE id = ? AND archived_at IS NULL AND stock >= ?")).
+		WithArgs(3, 9, 3).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	err := reserveStock(db, 1, items)
+	var stockErr *InsufficientStockError
+	if !errors.As(err, &stockErr) {
+		t.Fatalf("reserveStock error = %v, want InsufficientStockError", err)
+	}
+	if stockErr.ProductID != 9 || stockErr.Requested != 3 {
+		t.Errorf("InsufficientStockError = %+v, want product 9 short of 3", stockErr)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestLateCommit walks an order through reserving stock, the sweeper
+// releasing it when the order goes unpaid, and the payment arriving after
+// all. The stock is taken again when there is enough of it; otherwise the
+// order is short, but stock never goes negative.
+func TestLateCommit(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		restocked int64 // rows the late stock update changes
+	}{
+		{name: "stock still there", restocked: 1},
+		{name: "stock sold meanwhile", restocked: 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := newMockDB(t)
+			const orderID = 5
+			expiresAt := time.Now().Add(-time.Minute)
+
+			// Checkout reserves two units of product 7
+			mock.ExpectExec(regexp.QuoteMeta("UPDATE products SET stock = stock - ? WHERE id = ? AND archived_at IS NULL AND stock >= ?")).
+				WithArgs(2, 7, 2).WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec("INSERT INTO `stock_reservations`").
+				WithArgs(orderID, 7, nil, 2, models.ReservationReserved, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			if err := reserveStock(db, orderID, []CartItem{{ID: 7, Quantity: 2}}); err != nil {
+				t.Fatalf("reserveStock: %v", err)
+			}
+
+			// The sweeper finds the reservation expired and gives the stock
+			// back
+			mock.ExpectQuery("SELECT DISTINCT `order_id` FROM `stock_reservations` WHERE status = \\? AND expires_at < \\?").
+				WithArgs(models.ReservationReserved, sqlmock.AnyArg()).
+				WillReturnRows(sqlmock.NewRows([]string{"order_id"}).AddRow(orderID))
+			mock.ExpectBegin()
+			mock.ExpectQuery("SELECT \\* FROM `stock_reservations` WHERE order_id = \\? AND status = \\? FOR UPDATE").
+				WithArgs(orderID, models.ReservationReserved).
+				WillReturnRows(sqlmock.NewRows(reservationColumns).
+					AddRow(1, orderID, 7, nil, 2, models.ReservationReserved, expiresAt, expiresAt, expiresAt))
+			mock.ExpectExec(regexp.QuoteMeta("UPDATE products SET stock = stock + ? WHERE id = ?")).
+				WithArgs(2, 7).WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec("UPDATE `stock_reservations` SET `status`=\\?").
+				WithArgs(models.ReservationReleased, sqlmock.AnyArg(), 1).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec("UPDATE `orders` SET `status`=\\?").
+				WithArgs("expired", sqlmock.AnyArg(), orderID, "pending").
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectCommit()
+			released, err := releaseExpiredReservations(db)
+			if err != nil {
+				t.Fatalf("releaseExpiredReservations: %v", err)
+			}
+			if released != 1 {
+				t.Errorf("released %d orders, want 1", released)
+			}
+
+			// The payment arrives: the released units are taken again, only
+			// if they are still in stock, and the reservation is committed
+			// either way
+			mock.ExpectQuery("SELECT \\* FROM `stock_reservations` WHERE order_id = \\? AND status <> \\? FOR UPDATE").
+				WithArgs(orderID, models.ReservationCommitted).
+				WillReturnRows(sqlmock.NewRows(reservationColumns).
+					AddRow(1, orderID, 7, nil, 2, models.ReservationReleased, expiresAt, expiresAt, expiresAt))
+			mock.ExpectExec(regexp.QuoteMeta("UPDATE products SET stock = stock - ? WHERE id = ? AND stock >= ?")).
+				WithArgs(2, 7, 2).WillReturnResult(sqlmock.NewResult(0, tt.restocked))
+			mock.ExpectExec("UPDATE `stock_reservations` SET `status`=\\?").
+				WithArgs(models.ReservationCommitted, sqlmock.AnyArg(), 1).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			retaken, err := commitReservations(db, orderID)
+			if err != nil {
+				t.Fatalf("commitReservations: %v", err)
+			}
+			if want := int(tt.restocked); len(retaken) != want {
+				t.Errorf("took stock again from %v, want %d rows", retaken, want)
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// TestCommitReservationsOnTime checks that a payment within the reservation
+// window commits it without touching stock again.
+func TestCommitReservationsOnTime(t *testing.T) {
+	db, mock := newMockDB(t)
+	expiresAt := time.Now().Add(reservationTTL)
+
+	mock.ExpectQuery("SELECT \\* FROM `stock_reservations` WHERE order_id = \\? AND status <> \\? FOR UPDATE").
+		WithArgs(3, models.ReservationCommitted).
+		WillReturnRows(sqlmock.NewRows(reservationColumns).
+			AddRow(4, 3, 7, 31, 1, models.ReservationReserved, expiresAt, expiresAt, expiresAt))
+	mock.ExpectExec("UPDATE `stock_reservations` SET `status`=\\?").
+		WithArgs(models.ReservationCommitted, sqlmock.AnyArg(), 4).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	retaken, err := commitReservations(db, 3)
+	if err != nil {
+		t.Fatalf("commitReservations: %v", err)
+	}
+	if len(retaken) != 0 {
+		t.Errorf("took stock again from %v on time", retaken)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSoldOut(t *testing.T) {
+	variantID := uint(31)
+	// The bundle's own stock is not taken, so only its components count
+	keys := sortedStockKeys(cartStock([]CartItem{
+		{ID: 4, Quantity: 1, Components: []CartItem{{ID: 7, Quantity: 2}, {ID: 8, VariantID: &variantID, Quantity: 1}}},
+		{ID: 9, Quantity: 1},
+	}))
+
+	for _, tt := range []struct {
+		name        string
+		products    int
+		variants    int
+		wantVariant bool // whether the variants are looked up
+		want        bool
+	}{
+		{name: "product sold out", products: 1, want: true},
+		{name: "variant sold out", variants: 1, wantVariant: true, want: true},
+		{name: "all in stock", wantVariant: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := newMockDB(t)
+			mock.ExpectQuery(regexp.QuoteMeta("SELECT count(*) FROM `products` WHERE id IN (?,?) AND stock <= 0")).
+				WithArgs(7, 9).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(tt.products))
+			if tt.wantVariant {
+				mock.ExpectQuery(regexp.QuoteMeta("SELECT count(*) FROM `product_variants` WHERE id IN (?) AND stock <= 0")).
+					WithArgs(31).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(tt.variants))
+			}
+			got, err := soldOut(db, keys)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("soldOut = %v, want %v", got, tt.want)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,236 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+
+	"backend/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+const defaultPurgeAfterDays = 90
+
+// PurgeReport lists the products removed by PurgeArchivedProducts and those
+// kept because orders still refer to them.
+type PurgeReport struct {
+	Purged  []int `json:"purged"`
+	Skipped []int `json:"skipped"`
+}
+
+// ListArchivedProducts pages through archived products. It accepts the same
+// query parameters as ListProducts.
+func (h *ProductHandler) ListArchivedProducts(c *gin.Context) {
+	q, err := parseProductQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	q.Filter.Archived = true
+	q.Filter.Statuses = []string{models.ProductDraft, models.ProductScheduled, models.ProductPublished}
+	if !h.resolveFilter(c, &q.Filter) {
+		return
+	}
+
+	page, err := queryProducts(h.DB, q)
+	if err != nil {
+		h.Logger.Printf("Error listing archived products: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	c.JSON(http.StatusOK, page)
+}
+
+// RestoreProduct puts an archived product back on sale.
+func (h *ProductHandler) RestoreProduct(c *gin.Context) {
+	productID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid product ID"})
+		return
+	}
+
+	result, err := h.DB.Exec("UPDATE products SET archived_at = NULL WHERE id = ? AND archived_at IS NOT NULL", productID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if rowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Archived product not found"})
+		return
+	}
+	h.syncSearch(productID)
+
+	row := h.DB.QueryRow("SELECT "+productColumns+" FROM products WHERE id = ?", productID)
+	product, err := scanProduct(row)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if product.Images, err = loadProductImages(h.DB, productID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	c.JSON(http.StatusOK, product)
+}
+
+// PurgeArchivedProducts permanently deletes products archived more than
+// older_than_days days ago (90 by default), along with their gallery,
+// options, variants and image files. Products that appear in any order are
+// kept so order history stays intact, as are components of a bundle, which
+// would otherwise silently drop out of it, and digital products until their
+// file is removed.
+func (h *ProductHandler) PurgeArchivedProducts(c *gin.Context) {
+	days := defaultPurgeAfterDays
+	if v := c.Query("older_than_days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "older_than_days must be a non-negative integer"})
+			return
+		}
+		days = n
+	}
+
+	rows, err := h.DB.Query(`SELECT p.id,
+			EXISTS(SELECT 1 FROM order_products op WHERE op.product_id = p.id)
+			OR EXISTS(SELECT 1 FROM verified_order_products vp WHERE vp.product_id = p.id)
+			OR EXISTS(SELECT 1 FROM bundle_components bc WHERE bc.product_id = p.id)
+			OR EXISTS(SELECT 1 FROM product_files pf WHERE pf.product_id = p.id)
+		FROM products p
+		WHERE p.archived_at IS NOT NULL AND p.archived_at < NOW() - INTERVAL ? DAY
+		ORDER BY p.id`, days)
+	if err != nil {
+		h.Logger.Printf("Error finding archived products: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	report := PurgeReport{Purged: []int{}, Skipped: []int{}}
+	var candidates []int
+	for rows.Next() {
+		var id int
+		var ordered bool
+		if err := rows.Scan(&id, &ordered); err != nil {
+			rows.Close()
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		if ordered {
+			report.Skipped = append(report.Skipped, id)
+		} else {
+			candidates = append(candidates, id)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	for _, id := range candidates {
+		urls, err := h.purgeProduct(id)
+		if err != nil {
+			h.Logger.Printf("Error purging product %d: %v", id, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error", "purged": report.Purged})
+			return
+		}
+		h.removeUnusedImageFiles(urls)
+		h.Search.Remove(id)
+		report.Purged = append(report.Purged, id)
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+// purgeProduct deletes an archived product and everything hanging off it in
+// one transaction, returning the image URLs it used.
+func (h *ProductHandler) purgeProduct(productID int) ([]string, error) {
+	tx, err := h.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	urls, err := collectImageURLs(tx, productID)
+	if err != nil {
+		return nil, err
+	}
+
+	statements := []string{
+		`DELETE FROM variant_option_values WHERE product_variant_id IN (SELECT id FROM product_variants WHERE product_id = ?)`,
+		`DELETE FROM product_variants WHERE product_id = ?`,
+		`DELETE FROM product_option_values WHERE option_id IN (SELECT id FROM product_options WHERE product_id = ?)`,
+		`DELETE FROM product_options WHERE product_id = ?`,
+		`DELETE FROM product_images WHERE product_id = ?`,
+		`DELETE FROM product_attribute_values WHERE product_id = ?`,
+		`DELETE FROM product_prices WHERE product_id = ?`,
+		`DELETE FROM slug_redirects WHERE kind = 'product' AND target_id = ?`,
+		`DELETE FROM product_translations WHERE product_id = ?`,
+		`DELETE FROM bundle_components WHERE bundle_id = ?`,
+		`DELETE FROM wishlist_items WHERE product_id = ?`,
+		`DELETE FROM products WHERE id = ? AND archived_at IS NOT NULL`,
+	}
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt, productID); err != nil {
+			return nil, err
+		}
+	}
+	return urls, tx.Commit()
+}
+
+// collectImageURLs returns every image URL a product refers to, from the
+// product row, its gallery and its variants.
+func collectImageURLs(tx sqlExecer, productID int) ([]string, error) {
+	rows, err := tx.Query(`SELECT image_url, thumbnail_url FROM products WHERE id = ?
+		UNION SELECT image_url, thumbnail_url FROM product_images WHERE product_id = ?
+		UNION SELECT image_url, thumbnail_url FROM product_variants WHERE product_id = ?`,
+		productID, productID, productID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var urls []string
+	for rows.Next() {
+		var imageURL, thumbnailURL sql.NullString
+		if err := rows.Scan(&imageURL, &thumbnailURL); err != nil {
+			return nil, err
+		}
+		for _, u := range []sql.NullString{imageURL, thumbnailURL} {
+			if u.Valid && u.String != "" {
+				urls = append(urls, u.String)
+			}
+		}
+	}
+	return urls, rows.Err()
+}
+
+// removeUnusedImageFiles deletes image files that no product, gallery image
+// or variant refers to any more. Imports can share files between products.
+func (h *ProductHandler) removeUnusedImageFiles(urls []string) {
+	seen := make(map[string]bool)
+	for _, url := range urls {
+		if seen[url] {
+			continue
+		}
+		seen[url] = true
+
+		var inUse bool
+		err := h.DB.QueryRow(`SELECT
+			EXISTS(SELECT 1 FROM products WHERE image_url = ? OR thumbnail_url = ?)
+			OR EXISTS(SELECT 1 FROM product_images WHERE image_url = ? OR thumbnail_url = ?)
+			OR EXISTS(SELECT 1 FROM product_variants WHERE image_url = ? OR thumbnail_url = ?)`,
+			url, url, url, url, url, url).Scan(&inUse)
+		if err != nil {
+			h.Logger.Printf("Error checking image %s: %v", url, err)
+			continue
+		}
+		if !inUse {
+			removeImageFiles(url)
+		}
+	}
+}
@@ -0,0 +1,335 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"backend/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+const maxAttributeFilters = 20
+
+var errInvalidAttributeFilter = errors.New("Invalid attribute filter")
+
+// AttributeFilter restricts a listing to products with matching values for
+// one attribute. Values holds enum options or "true"/"false"; number
+// attributes can also be bounded by Min and Max.
+type AttributeFilter struct {
+	AttributeID uint
+	Type        string // filled in by resolveAttributeFilters
+	Values      []string
+	Min         *float64
+	Max         *float64
+}
+
+// AttributeFacet counts the matching products per value of one attribute.
+type AttributeFacet struct {
+	AttributeID uint         `json:"attribute_id"`
+	Name        string       `json:"name"`
+	Type        string       `json:"type"`
+	Unit        string       `json:"unit,omitempty"`
+	Values      []FacetValue `json:"values"`
+}
+
+type FacetValue struct {
+	Value interface{} `json:"value"`
+	Count int         `json:"count"`
+}
+
+// parseAttributeFilters reads attr[<id>]=a,b, attr_min[<id>]=n and
+// attr_max[<id>]=n from the query string.
+func parseAttributeFilters(c *gin.Context) ([]AttributeFilter, error) {
+	byID := make(map[uint]*AttributeFilter)
+	get := func(key string) (*AttributeFilter, error) {
+		id, err := strconv.ParseUint(key, 10, 32)
+		if err != nil || id == 0 {
+			return nil, fmt.Errorf("%w: %s", errInvalidAttributeFilter, key)
+		}
+		f, ok := byID[uint(id)]
+		if !ok {
+			f = &AttributeFilter{AttributeID: uint(id)}
+			byID[uint(id)] = f
+		}
+		return f, nil
+	}
+
+	for key, value := range c.QueryMap("attr") {
+		f, err := get(key)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				f.Values = append(f.Values, v)
+			}
+		}
+	}
+	for _, bound := range []string{"attr_min", "attr_max"} {
+		for key, value := range c.QueryMap(bound) {
+			f, err := get(key)
+			if err != nil {
+				return nil, err
+			}
+			n, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid %s for attribute %s", bound, key)
+			}
+			if bound == "attr_min" {
+				f.Min = &n
+			} else {
+				f.Max = &n
+			}
+		}
+	}
+
+	if len(byID) > maxAttributeFilters {
+		return nil, fmt.Errorf("At most %d attribute filters are allowed", maxAttributeFilters)
+	}
+	filters := make([]AttributeFilter, 0, len(byID))
+	for _, f := range byID {
+		if len(f.Values) > 0 || f.Min != nil || f.Max != nil {
+			filters = append(filters, *f)
+		}
+	}
+	sort.Slice(filters, func(i, j int) bool { return filters[i].AttributeID < filters[j].AttributeID })
+	return filters, nil
+}
+
+// resolveAttributeFilters looks up the type of every filtered attribute and
+// checks that the filter values suit it.
+func resolveAttributeFilters(db sqlExecer, filters []AttributeFilter) error {
+	for i := range filters {
+		f := &filters[i]
+		err := db.QueryRow("SELECT type FROM attributes WHERE id = ?", f.AttributeID).Scan(&f.Type)
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("%w: unknown attribute %d", errInvalidAttributeFilter, f.AttributeID)
+		}
+		if err != nil {
+			return err
+		}
+
+		if f.Type != models.AttributeNumber && (f.Min != nil || f.Max != nil) {
+			return fmt.Errorf("%w: attribute %d is not a number", errInvalidAttributeFilter, f.AttributeID)
+		}
+		for _, v := range f.Values {
+			var err error
+			switch f.Type {
+			case models.AttributeNumber:
+				_, err = strconv.ParseFloat(v, 64)
+			case models.AttributeBoolean:
+				_, err = strconv.ParseBool(v)
+			}
+			if err != nil {
+				return fmt.Errorf("%w: %q is not a valid %s value for attribute %d", errInvalidAttributeFilter, v, f.Type, f.AttributeID)
+			}
+		}
+	}
+	return nil
+}
+
+// condition returns an SQL condition on the products table for the filter.
+func (f AttributeFilter) condition() (string, []interface{}) {
+	query := "EXISTS (SELECT 1 FROM product_attribute_values fv"
+	if f.Type == models.AttributeEnum {
+		query += " JOIN attribute_options fo ON fo.id = fv.option_id"
+	}
+	query += " WHERE fv.product_id = products.id AND fv.attribute_id = ?"
+	args := []interface{}{f.AttributeID}
+
+	if len(f.Values) > 0 {
+		column := "fo.value"
+		switch f.Type {
+		case models.AttributeNumber:
+			column = "fv.number_value"
+		case models.AttributeBoolean:
+			column = "fv.bool_value"
+		}
+		query += " AND " + column + " IN (" + strings.TrimSuffix(strings.Repeat("?,", len(f.Values)), ",") + ")"
+		for _, v := range f.Values {
+			switch f.Type {
+			case models.AttributeNumber:
+				n, _ := strconv.ParseFloat(v, 64)
+				args = append(args, n)
+			case models.AttributeBoolean:
+				b, _ := strconv.ParseBool(v)
+				args = append(args, b)
+			default:
+				args = append(args, v)
+			}
+		}
+	}
+	if f.Min != nil {
+		query += " AND fv.number_value >= ?"
+		args = append(args, *f.Min)
+	}
+	if f.Max != nil {
+		query += " AND fv.number_value <= ?"
+		args = append(args, *f.Max)
+	}
+	return query + ")", args
+}
+
+// attributeFacets counts the products matching filter per attribute value.
+// The counts for a filtered attribute ignore that attribute's own filter, so
+// the storefront can still offer its other values.
+func attributeFacets(db sqlExecer, filter ProductFilter) ([]AttributeFacet, error) {
+	type facetKey struct {
+		attributeID uint
+		value       interface{}
+	}
+	type facetRow struct {
+		key      facetKey
+		position int
+		count    int
+	}
+	var counted []facetRow
+
+	collect := func(skipAttribute uint) error {
+		where, args := filter.whereExcept(skipAttribute)
+		query := `SELECT v.attribute_id, o.value, COALESCE(o.position, 0), v.number_value, v.bool_value, COUNT(*)
+			FROM product_attribute_values v LEFT JOIN attribute_options o ON o.id = v.option_id
+			WHERE v.product_id IN (SELECT id FROM products` + where + `)`
+		if skipAttribute != 0 {
+			query += " AND v.attribute_id = ?"
+			args = append(args, skipAttribute)
+		} else {
+			for _, f := range filter.Attributes {
+				query += " AND v.attribute_id <> ?"
+				args = append(args, f.AttributeID)
+			}
+		}
+		query += " GROUP BY v.attribute_id, o.id, o.value, o.position, v.number_value, v.bool_value"
+
+		rows, err := db.Query(query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var row facetRow
+			var option sql.NullString
+			var number sql.NullFloat64
+			var boolean sql.NullBool
+			if err := rows.Scan(&row.key.attributeID, &option, &row.position, &number, &boolean, &row.count); err != nil {
+				return err
+			}
+			switch {
+			case option.Valid:
+				row.key.value = option.String
+			case number.Valid:
+				row.key.value = number.Float64
+			case boolean.Valid:
+				row.key.value = boolean.Bool
+			default:
+				continue
+			}
+			counted = append(counted, row)
+		}
+		return rows.Err()
+	}
+
+	if err := collect(0); err != nil {
+		return nil, err
+	}
+	for _, f := range filter.Attributes {
+		if err := collect(f.AttributeID); err != nil {
+			return nil, err
+		}
+	}
+	if len(counted) == 0 {
+		return []AttributeFacet{}, nil
+	}
+
+	// Order values the way admins listed them, numbers ascending and false
+	// before true.
+	sort.SliceStable(counted, func(i, j int) bool {
+		a, b := counted[i], counted[j]
+		if a.key.attributeID != b.key.attributeID {
+			return a.key.attributeID < b.key.attributeID
+		}
+		if a.position != b.position {
+			return a.position < b.position
+		}
+		switch av := a.key.value.(type) {
+		case float64:
+			bv, _ := b.key.value.(float64)
+			return av < bv
+		case bool:
+			return !av && b.key.value == true
+		}
+		return false
+	})
+
+	ids := make([]interface{}, 0)
+	facets := make(map[uint]*AttributeFacet)
+	for _, row := range counted {
+		facet, ok := facets[row.key.attributeID]
+		if !ok {
+			facet = &AttributeFacet{AttributeID: row.key.attributeID, Values: []FacetValue{}}
+			facets[row.key.attributeID] = facet
+			ids = append(ids, row.key.attributeID)
+		}
+		facet.Values = append(facet.Values, FacetValue{Value: row.key.value, Count: row.count})
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+	rows, err := db.Query("SELECT id, name, type, COALESCE(unit, '') FROM attributes WHERE id IN ("+placeholders+") ORDER BY position, id", ids...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := []AttributeFacet{}
+	for rows.Next() {
+		var id uint
+		var name, typ, unit string
+		if err := rows.Scan(&id, &name, &typ, &unit); err != nil {
+			return nil, err
+		}
+		facet := facets[id]
+		facet.Name, facet.Type, facet.Unit = name, typ, unit
+		result = append(result, *facet)
+	}
+	return result, rows.Err()
+}
+
+// loadProductAttributes returns the attribute values set on a product.
+func loadProductAttributes(db sqlExecer, productID int) ([]models.ProductAttribute, error) {
+	rows, err := db.Query(`SELECT a.id, a.name, a.type, COALESCE(a.unit, ''), o.value, v.number_value, v.bool_value
+		FROM product_attribute_values v
+		JOIN attributes a ON a.id = v.attribute_id
+		LEFT JOIN attribute_options o ON o.id = v.option_id
+		WHERE v.product_id = ? ORDER BY a.position, a.id`, productID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attributes := []models.ProductAttribute{}
+	for rows.Next() {
+		var attr models.ProductAttribute
+		var option sql.NullString
+		var number sql.NullFloat64
+		var boolean sql.NullBool
+		if err := rows.Scan(&attr.AttributeID, &attr.Name, &attr.Type, &attr.Unit, &option, &number, &boolean); err != nil {
+			return nil, err
+		}
+		switch {
+		case option.Valid:
+			attr.Value = option.String
+		case number.Valid:
+			attr.Value = number.Float64
+		case boolean.Valid:
+			attr.Value = boolean.Bool
+		default:
+			continue
+		}
+		attributes = append(attributes, attr)
+	}
+	return attributes, rows.Err()
+}
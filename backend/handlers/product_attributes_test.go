@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func floatPtr(f float64) *float64 {
+	return &f
+}
+
+func TestParseAttributeFilters(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    []AttributeFilter
+		wantErr string
+	}{
+		{query: "", want: []AttributeFilter{}},
+		{
+			query: "attr[3]=red,%20blue%20,&attr[1]=true",
+			want: []AttributeFilter{
+				{AttributeID: 1, Values: []string{"true"}},
+				{AttributeID: 3, Values: []string{"red", "blue"}},
+			},
+		},
+		{
+			query: "attr_min[5]=1.5&attr_max[5]=10",
+			want:  []AttributeFilter{{AttributeID: 5, Min: floatPtr(1.5), Max: floatPtr(10)}},
+		},
+		{query: "attr[2]=,%20", want: []AttributeFilter{}},
+		{query: "attr[x]=red", wantErr: "Invalid attribute filter: x"},
+		{query: "attr[0]=red", wantErr: "Invalid attribute filter: 0"},
+		{query: "attr_min[4]=lots", wantErr: "Invalid attr_min for attribute 4"},
+		{query: "sort=newest&category_id=2", want: []AttributeFilter{}},
+	}
+	for _, tt := range tests {
+		got, err := parseAttributeFilters(testContext(tt.query))
+		if tt.wantErr != "" {
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("parseAttributeFilters(%q) error = %v, want %q", tt.query, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseAttributeFilters(%q): %v", tt.query, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseAttributeFilters(%q) = %+v, want %+v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestParseAttributeFiltersLimit(t *testing.T) {
+	params := url.Values{}
+	for id := 1; id <= maxAttributeFilters+1; id++ {
+		params.Set(fmt.Sprintf("attr[%d]", id), "x")
+	}
+	_, err := parseAttributeFilters(testContext(params.Encode()))
+	if err == nil || !strings.HasPrefix(err.Error(), "At most") {
+		t.Errorf("error = %v, want the filter limit", err)
+	}
+	if errors.Is(err, errInvalidAttributeFilter) {
+		t.Errorf("limit error should not be an invalid filter error")
+	}
+}
@@ -0,0 +1,467 @@
+package handlers
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"backend/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Shopping channels cap these fields; longer values get the item rejected.
+const (
+	feedTitleMax       = 150
+	feedDescriptionMax = 5000
+	feedExtraImagesMax = 10
+)
+
+var facebookFeedColumns = []string{"id", "title", "description", "availability", "condition", "price", "sale_price",
+	"link", "image_link", "additional_image_link", "brand", "product_type", "inventory", "item_group_id"}
+
+// ProductFeed serves the published catalog as a Google Merchant RSS feed and
+// a Facebook catalog CSV. The feeds are rebuilt when the catalog changes,
+// reusing the entries of products that have not changed since the last
+// build, so only changed products are reloaded from the database.
+type ProductFeed struct {
+	DB      *sql.DB
+	Logger  *log.Logger
+	Catalog *CatalogCache
+	// StoreURL is the storefront's origin, which product links and image
+	// paths are resolved against. The feeds are unavailable without it.
+	StoreURL string
+	// StoreName titles the feed and is the brand of every item.
+	StoreName string
+
+	mu         sync.Mutex
+	built      bool
+	generation int64
+	items      map[int]*feedItem
+	google     []byte
+	facebook   []byte
+}
+
+// feedItem is one product's entries in both feeds, rendered when the product
+// last changed. A product sold in variants has an entry per variant.
+type feedItem struct {
+	stamp    string
+	google   []byte
+	facebook [][]string
+}
+
+// feedVariantOptionsExpr names a variant v by its option values, as in
+// "Red / L".
+const feedVariantOptionsExpr = `(SELECT GROUP_CONCAT(ov.value ORDER BY o.position, o.id SEPARATOR ' / ')
+	FROM variant_option_values vov
+	JOIN product_option_values ov ON ov.id = vov.product_option_value_id
+	JOIN product_options o ON o.id = ov.option_id
+	WHERE vov.product_variant_id = v.id)`
+
+// feedVariant is a variant as the feeds list it.
+type feedVariant struct {
+	SKU      string
+	Price    *float64 // nil when it sells at the product's price
+	ImageURL string
+	Stock    int
+	Options  string // its option values, as in "Red / L"
+}
+
+// googleItem is an RSS item with the Google Merchant (g:) fields.
+type googleItem struct {
+	XMLName          xml.Name `xml:"item"`
+	ID               string   `xml:"g:id"`
+	Title            string   `xml:"g:title"`
+	Description      string   `xml:"g:description"`
+	Link             string   `xml:"g:link"`
+	ImageLink        string   `xml:"g:image_link"`
+	AdditionalImages []string `xml:"g:additional_image_link"`
+	Availability     string   `xml:"g:availability"`
+	Price            string   `xml:"g:price"`
+	SalePrice        string   `xml:"g:sale_price,omitempty"`
+	Condition        string   `xml:"g:condition"`
+	Brand            string   `xml:"g:brand,omitempty"`
+	ProductType      string   `xml:"g:product_type,omitempty"`
+	IdentifierExists string   `xml:"g:identifier_exists"`
+	ItemGroupID      string   `xml:"g:item_group_id,omitempty"`
+}
+
+// storeURLFromEnv reads the storefront's public origin from STORE_URL,
+// without a trailing slash. It is nil when STORE_URL is not set.
+func storeURLFromEnv() (*url.URL, error) {
+	s := os.Getenv("STORE_URL")
+	if s == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(strings.TrimSuffix(s, "/"))
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid STORE_URL: %q", s)
+	}
+	return u, nil
+}
+
+// NewProductFeedFromEnv creates a ProductFeed for the storefront at
+// STORE_URL, named STORE_NAME (default: the STORE_URL host).
+func NewProductFeedFromEnv(db *sql.DB, logger *log.Logger, catalog *CatalogCache) (*ProductFeed, error) {
+	feed := &ProductFeed{DB: db, Logger: logger, Catalog: catalog, StoreName: os.Getenv("STORE_NAME")}
+	u, err := storeURLFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if u != nil {
+		feed.StoreURL = u.String()
+		if feed.StoreName == "" {
+			feed.StoreName = u.Host
+		}
+	}
+	return feed, nil
+}
+
+// GoogleFeed serves the Google Merchant Center feed.
+func (f *ProductFeed) GoogleFeed(c *gin.Context) {
+	f.serve(c, func() []byte { return f.google }, "application/rss+xml; charset=utf-8")
+}
+
+// FacebookFeed serves the Facebook catalog CSV feed.
+func (f *ProductFeed) FacebookFeed(c *gin.Context) {
+	f.serve(c, func() []byte { return f.facebook }, "text/csv; charset=utf-8")
+}
+
+func (f *ProductFeed) serve(c *gin.Context, body func() []byte, contentType string) {
+	if f.StoreURL == "" {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Product feeds need STORE_URL to be set"})
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.refresh(); err != nil {
+		f.Logger.Printf("Error building product feeds: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	c.Data(http.StatusOK, contentType, body())
+}
+
+// refresh rebuilds the feeds if the catalog has changed since they were last
+// built. The caller holds f.mu.
+func (f *ProductFeed) refresh() error {
+	var generation int64
+	if f.Catalog != nil {
+		generation, _ = f.Catalog.current()
+		if f.built && generation == f.generation {
+			return nil
+		}
+	}
+
+	tree, err := loadCategoryTree(f.DB)
+	if err != nil {
+		return err
+	}
+
+	// A product's stamp covers everything its entry shows, so only products
+	// whose stamp changed need loading and rendering again
+	rows, err := f.DB.Query(`SELECT id, catid, CONCAT_WS('|', version, ` + productStockExpr + `,
+		(SELECT pp.price ` + activeSale + `), (SELECT pp.ends_at ` + activeSale + `),
+		(SELECT GROUP_CONCAT(pi.image_url ORDER BY pi.position, pi.id) FROM product_images pi WHERE pi.product_id = products.id),
+		(SELECT GROUP_CONCAT(CONCAT_WS(':', v.id, v.sku, COALESCE(v.price, ''), v.stock, v.image_url, ` + feedVariantOptionsExpr + `)
+			ORDER BY v.id) FROM product_variants v WHERE v.product_id = products.id))
+		FROM products WHERE archived_at IS NULL AND ` + publishedCond)
+	if err != nil {
+		return err
+	}
+	items := make(map[int]*feedItem)
+	stamps := make(map[int]string)
+	var changed []int
+	for rows.Next() {
+		var id, categoryID int
+		var stamp string
+		if err := rows.Scan(&id, &categoryID, &stamp); err != nil {
+			rows.Close()
+			return err
+		}
+		stamp += "|" + categoryPath(tree, categoryID)
+		if item, ok := f.items[id]; ok && item.stamp == stamp {
+			items[id] = item
+			continue
+		}
+		stamps[id] = stamp
+		changed = append(changed, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	products, images, variants, err := loadFeedProducts(f.DB, changed)
+	if err != nil {
+		return err
+	}
+	for _, p := range products {
+		item, err := f.render(p, images[p.ID], variants[p.ID], categoryPath(tree, p.CategoryID))
+		if err != nil {
+			return err
+		}
+		item.stamp = stamps[p.ID]
+		items[p.ID] = item
+	}
+
+	f.items = items
+	f.google, f.facebook, err = f.assemble()
+	if err != nil {
+		return err
+	}
+	f.generation = generation
+	f.built = true
+	return nil
+}
+
+// loadFeedProducts loads products, the image URLs of their galleries and
+// their variants.
+func loadFeedProducts(db *sql.DB, ids []int) ([]models.Product, map[int][]string, map[int][]feedVariant, error) {
+	var products []models.Product
+	images := make(map[int][]string)
+	variants := make(map[int][]feedVariant)
+	const batch = 500
+	for start := 0; start < len(ids); start += batch {
+		chunk := ids[start:min(start+batch, len(ids))]
+		placeholders := strings.TrimSuffix(strings.Repeat("?,", len(chunk)), ",")
+		args := make([]interface{}, len(chunk))
+		for i, id := range chunk {
+			args[i] = id
+		}
+
+		rows, err := db.Query("SELECT "+productColumns+" FROM products WHERE id IN ("+placeholders+")", args...)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		for rows.Next() {
+			p, err := scanProduct(rows)
+			if err != nil {
+				rows.Close()
+				return nil, nil, nil, err
+			}
+			products = append(products, p)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, nil, nil, err
+		}
+
+		rows, err = db.Query("SELECT product_id, image_url FROM product_images WHERE product_id IN ("+placeholders+") ORDER BY product_id, position, id", args...)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		for rows.Next() {
+			var id int
+			var imageURL string
+			if err := rows.Scan(&id, &imageURL); err != nil {
+				rows.Close()
+				return nil, nil, nil, err
+			}
+			images[id] = append(images[id], imageURL)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, nil, nil, err
+		}
+
+		rows, err = db.Query("SELECT v.product_id, v.sku, v.price, v.image_url, v.stock, COALESCE("+feedVariantOptionsExpr+", '') FROM product_variants v WHERE v.product_id IN ("+placeholders+") ORDER BY v.product_id, v.id", args...)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		for rows.Next() {
+			var id int
+			var v feedVariant
+			if err := rows.Scan(&id, &v.SKU, &v.Price, &v.ImageURL, &v.Stock, &v.Options); err != nil {
+				rows.Close()
+				return nil, nil, nil, err
+			}
+			variants[id] = append(variants[id], v)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	return products, images, variants, nil
+}
+
+// categoryPath names a category with its ancestors, as in "Home > Kitchen".
+func categoryPath(tree *categoryTree, id int) string {
+	var names []string
+	for _, crumb := range tree.breadcrumbs(id) {
+		names = append(names, crumb.Name)
+	}
+	return strings.Join(names, " > ")
+}
+
+// render builds a product's entries for both feeds: one for the product, or
+// one per variant grouped under it for a product sold in variants. Variants
+// with a price of their own sell at it, sale or not, as at checkout.
+// Products without an image are left out, as both channels reject them.
+func (f *ProductFeed) render(p models.Product, gallery []string, variants []feedVariant, productType string) (*feedItem, error) {
+	item := &feedItem{}
+	if p.ImageURL == "" {
+		return item, nil
+	}
+
+	ref := p.Slug
+	if ref == "" {
+		ref = strconv.Itoa(p.ID)
+	}
+	description := p.Description
+	if strings.TrimSpace(description) == "" {
+		description = p.Name
+	}
+	var extraImages []string
+	for _, img := range gallery {
+		if img != p.ImageURL && len(extraImages) < feedExtraImagesMax {
+			extraImages = append(extraImages, f.absoluteURL(img))
+		}
+	}
+
+	product := googleItem{
+		ID:               p.SKU,
+		Title:            truncateRunes(p.Name, feedTitleMax),
+		Description:      truncateRunes(description, feedDescriptionMax),
+		Link:             f.StoreURL + "/products/" + url.PathEscape(ref),
+		ImageLink:        f.absoluteURL(p.ImageURL),
+		AdditionalImages: extraImages,
+		Price:            feedPrice(p.Price),
+		Condition:        "new",
+		Brand:            f.StoreName,
+		ProductType:      productType,
+		IdentifierExists: "no",
+	}
+	if p.WasPrice != nil {
+		product.SalePrice = feedPrice(p.CurrentPrice)
+	}
+
+	if len(variants) == 0 {
+		return item, item.add(product, p.Stock)
+	}
+	for _, v := range variants {
+		g := product
+		g.ID = v.SKU
+		g.ItemGroupID = p.SKU
+		if v.Options != "" {
+			g.Title = truncateRunes(p.Name+" - "+v.Options, feedTitleMax)
+		}
+		if v.ImageURL != "" {
+			g.ImageLink = f.absoluteURL(v.ImageURL)
+		}
+		if v.Price != nil {
+			g.Price = feedPrice(*v.Price)
+			g.SalePrice = ""
+		}
+		if err := item.add(g, v.Stock); err != nil {
+			return nil, err
+		}
+	}
+	return item, nil
+}
+
+// add appends an entry with the given stock to both feeds.
+func (item *feedItem) add(g googleItem, stock int) error {
+	g.Availability = "out_of_stock"
+	if stock > 0 {
+		g.Availability = "in_stock"
+	}
+	data, err := xml.MarshalIndent(g, "    ", "  ")
+	if err != nil {
+		return err
+	}
+	if item.google != nil {
+		item.google = append(item.google, '\n')
+	}
+	item.google = append(item.google, data...)
+	item.facebook = append(item.facebook, []string{
+		g.ID,
+		g.Title,
+		g.Description,
+		strings.ReplaceAll(g.Availability, "_", " "),
+		g.Condition,
+		g.Price,
+		g.SalePrice,
+		g.Link,
+		g.ImageLink,
+		strings.Join(g.AdditionalImages, ","),
+		g.Brand,
+		g.ProductType,
+		strconv.Itoa(max(stock, 0)),
+		g.ItemGroupID,
+	})
+	return nil
+}
+
+// assemble joins the rendered entries into the two feeds, in product order.
+func (f *ProductFeed) assemble() ([]byte, []byte, error) {
+	ids := make([]int, 0, len(f.items))
+	for id, item := range f.items {
+		if item.google != nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+
+	var google bytes.Buffer
+	google.WriteString(xml.Header)
+	google.WriteString(`<rss version="2.0" xmlns:g="http://base.google.com/ns/1.0">` + "\n  <channel>\n    <title>")
+	xml.EscapeText(&google, []byte(f.StoreName))
+	google.WriteString("</title>\n    <link>")
+	xml.EscapeText(&google, []byte(f.StoreURL))
+	google.WriteString("</link>\n    <description>")
+	xml.EscapeText(&google, []byte("Products from "+f.StoreName))
+	google.WriteString("</description>\n")
+	for _, id := range ids {
+		google.Write(f.items[id].google)
+		google.WriteString("\n")
+	}
+	google.WriteString("  </channel>\n</rss>\n")
+
+	var facebook bytes.Buffer
+	writer := csv.NewWriter(&facebook)
+	writer.Write(facebookFeedColumns)
+	for _, id := range ids {
+		for _, row := range f.items[id].facebook {
+			writer.Write(row)
+		}
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return nil, nil, err
+	}
+	return google.Bytes(), facebook.Bytes(), nil
+}
+
+// absoluteURL resolves an image path such as /images/a.jpg against the
+// storefront. URLs that are already absolute are kept.
+func (f *ProductFeed) absoluteURL(ref string) string {
+	if u, err := url.Parse(ref); err == nil && u.IsAbs() {
+		return ref
+	}
+	return f.StoreURL + "/" + strings.TrimPrefix(ref, "/")
+}
+
+func feedPrice(price float64) string {
+	return strconv.FormatFloat(price, 'f', 2, 64) + " " + storeCurrency
+}
+
+func truncateRunes(s string, max int) string {
+	if utf8.RuneCountInString(s) <= max {
+		return s
+	}
+	return string([]rune(s)[:max])
+}
@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"strings"
+	"testing"
+
+	"backend/models"
+)
+
+func TestFeedRenderVariants(t *testing.T) {
+	f := &ProductFeed{StoreURL: "https://shop.example", StoreName: "Shop"}
+	sale := 80.0
+	p := models.Product{ID: 3, SKU: "TEE", Name: "Tee", Slug: "tee", ImageURL: "/images/tee.jpg", Price: 100, Stock: 5}
+	applySalePrice(&p, &sale, nil)
+	own := 120.0
+	variants := []feedVariant{
+		{SKU: "TEE-S", Stock: 2, Options: "Red / S"},
+		{SKU: "TEE-XL", Price: &own, Stock: 0, ImageURL: "/images/tee-xl.jpg", Options: "Red / XL"},
+	}
+
+	item, err := f.render(p, nil, variants, "Clothing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"TEE-S", "Tee - Red / S", "in stock", "100.00 HKD", "80.00 HKD", "https://shop.example/images/tee.jpg", "2", "TEE"},
+		{"TEE-XL", "Tee - Red / XL", "out of stock", "120.00 HKD", "", "https://shop.example/images/tee-xl.jpg", "0", "TEE"},
+	}
+	if len(item.facebook) != len(want) {
+		t.Fatalf("got %d Facebook rows, want %d", len(item.facebook), len(want))
+	}
+	for i, row := range item.facebook {
+		got := []string{row[0], row[1], row[3], row[5], row[6], row[8], row[12], row[13]}
+		for j := range got {
+			if got[j] != want[i][j] {
+				t.Errorf("row %d column %d = %q, want %q", i, j, got[j], want[i][j])
+			}
+		}
+	}
+	google := string(item.google)
+	if strings.Count(google, "<item>") != 2 || strings.Count(google, "<g:item_group_id>TEE</g:item_group_id>") != 2 {
+		t.Errorf("Google entries are not one per variant in the TEE group:\n%s", google)
+	}
+	if !strings.Contains(google, "<g:price>120.00 HKD</g:price>") {
+		t.Errorf("variant price missing from the Google feed:\n%s", google)
+	}
+
+	item, err = f.render(p, nil, nil, "Clothing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(item.facebook) != 1 || item.facebook[0][0] != "TEE" || item.facebook[0][13] != "" {
+		t.Errorf("product without variants rendered as %v", item.facebook)
+	}
+}
@@ -1,28 +1,64 @@
 package handlers
 
 import (
-	"bytes"
 	"database/sql"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
-	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
-	"time"
 
-	"github.com/disintegration/imaging"
 	"github.com/gin-gonic/gin"
 	"backend/models"
 )
 
 type ProductHandler struct {
-	DB     *sql.DB
-	Logger *log.Logger
+	DB      *sql.DB
+	Logger  *log.Logger
+	Search  *SearchIndex
+	Catalog *CatalogCache
 }
 
+// syncSearch refreshes the search index entry of a product from the database,
+// dropping it if the product no longer exists, is archived or is not
+// published.
+func (h *ProductHandler) syncSearch(productID int) {
+	row := h.DB.QueryRow("SELECT "+productColumns+" FROM products WHERE id = ?", productID)
+	p, err := scanProduct(row)
+	if err == sql.ErrNoRows || (err == nil && (p.ArchivedAt != nil || !isPublished(p))) {
+		h.Search.Remove(productID)
+		return
+	}
+	if err == nil {
+		products := []models.Product{p}
+		err = loadProductTranslations(h.DB, products, "")
+		p = products[0]
+	}
+	if err != nil {
+		h.Logger.Printf("Error refreshing search index for product %d: %v", productID, err)
+		return
+	}
+	h.Search.Upsert(p)
+}
+
+// currentProduct loads a product as admins edit it: whatever its status, with
+// every translation.
+func (h *ProductHandler) currentProduct(productID int) (models.Product, error) {
+	row := h.DB.QueryRow("SELECT "+productColumns+" FROM products WHERE id = ?", productID)
+	p, err := scanProduct(row)
+	if err != nil {
+		return p, err
+	}
+	products := []models.Product{p}
+	err = loadProductTranslations(h.DB, products, "")
+	return products[0], err
+}
+
+// CreateProduct adds a product from a multipart form. Name and description
+// are in models.DefaultLocale; translations go in name[<locale>] and
+// description[<locale>] fields. The product goes live at once unless status
+// is draft, or scheduled with a publish_at time.
 func (h *ProductHandler) CreateProduct(c *gin.Context) {
 	// Log request details
 	h.Logger.Printf("CreateProduct request received")
@@ -50,274 +86,206 @@ func (h *ProductHandler) CreateProduct(c *gin.Context) {
 	}
 
 	description := c.PostForm("description")
-
-	// Handle file upload
-	h.Logger.Printf("Attempting to get uploaded file from form-data")
-	fileHeader, err := c.FormFile("image")
+	translations, err := parseProductTranslations(c)
 	if err != nil {
-		h.Logger.Printf("Error getting uploaded file: %v", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Unable to get file: %v", err)})
-		return
-	}
-	file, err := fileHeader.Open()
-	defer file.Close()
-	h.Logger.Printf("Successfully received file: %s (%d bytes)", fileHeader.Filename, fileHeader.Size)
-
-	// Create unique filename
-	ext := filepath.Ext(fileHeader.Filename)
-	newFilename := fmt.Sprintf("%d%s", time.Now().UnixNano(), ext)
-
-	// Ensure images directory exists
-	if err := os.MkdirAll("/home/caijiayi/online-shopping-mall/public/images", 0755); err != nil {
-		h.Logger.Printf("Error creating images directory: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create images directory"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	// Save original file
-	filePath := filepath.Join("/home/caijiayi/online-shopping-mall/public/images", "original_"+newFilename)
-	dst, err := os.Create(filePath)
+	status := c.DefaultPostForm("status", models.ProductPublished)
+	publishAt, err := parsePublishing(status, c.PostForm("publish_at"))
 	if err != nil {
-		h.Logger.Printf("Error creating file %s: %v", filePath, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unable to save file"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	defer dst.Close()
 
-	// Create a TeeReader to read the file once and write to both destination and memory
-	fileBytes, err := io.ReadAll(file)
-	if err != nil {
-		h.Logger.Printf("Error reading file: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unable to read file"})
-		return
+	stock := 0
+	if s := c.PostForm("stock"); s != "" {
+		stock, err = strconv.Atoi(s)
+		if err != nil || stock < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid stock"})
+			return
+		}
 	}
 
-	if _, err := dst.Write(fileBytes); err != nil {
-		h.Logger.Printf("Error writing file: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unable to save file"})
+	sku := strings.TrimSpace(c.PostForm("sku"))
+	if len(sku) > 64 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "SKU must be at most 64 characters"})
 		return
 	}
+	if sku != "" {
+		var taken bool
+		if err := h.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM products WHERE sku = ?)", sku).Scan(&taken); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		if taken {
+			c.JSON(http.StatusConflict, gin.H{"error": "SKU already exists"})
+			return
+		}
+	}
 
-	// Verify file type
-	contentType := http.DetectContentType(fileBytes)
-	h.Logger.Printf("Detected file content type: %s", contentType)
-	if !strings.Contains(contentType, "image/") {
-		h.Logger.Printf("Invalid file type: %s", contentType)
-		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid file type: %s. Only image files are allowed.", contentType)})
+	// Handle file uploads; the first image becomes the primary one
+	files := uploadedImages(c)
+	if len(files) == 0 {
+		h.Logger.Printf("No image uploaded")
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unable to get file: at least one image is required"})
 		return
 	}
-
-	// Decode image from memory
-	h.Logger.Printf("Attempting to decode image, size: %d bytes", len(fileBytes))
-	img, err := imaging.Decode(bytes.NewReader(fileBytes))
-	if err != nil {
-		h.Logger.Printf("Failed to decode image: %v", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "The image file appears to be corrupted or in an unsupported format. Please try with a valid JPG, PNG or GIF image."})
-		return
-	}
-	h.Logger.Printf("Successfully decoded image, dimensions: %dx%d", img.Bounds().Dx(), img.Bounds().Dy())
-
-	bounds := img.Bounds()
-	width := bounds.Dx()
-	height := bounds.Dy()
-
-	var thumbnailPath string
-	if width <= 300 && height <= 300 {
-		// Use original image as thumbnail if it's small enough
-		thumbnailPath = filePath
-	} else {
-		// Create thumbnail for larger images
-	thumbnail := imaging.Resize(img, 300, 300, imaging.Lanczos)
-	thumbnailFilename := "thumbnail_" + newFilename
-	thumbnailPath = filepath.Join("/home/caijiayi/online-shopping-mall/public/images", thumbnailFilename)
-	err = imaging.Save(thumbnail, thumbnailPath)
+	saved, err := h.saveUploadedImages(files)
 	if err != nil {
-		h.Logger.Printf("Error saving thumbnail: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unable to save thumbnail"})
+		respondUploadError(c, h.Logger, err)
 		return
 	}
-	h.Logger.Printf("Successfully created thumbnail: %s", thumbnailFilename)
+	removeSaved := func() {
+		for _, img := range saved {
+			removeImageFiles(img.ImageURL, img.ThumbnailURL)
+		}
 	}
 
-	// Log file save success
-	h.Logger.Printf("Successfully saved image to: %s", filePath)
-	h.Logger.Printf("Successfully saved thumbnail to: %s", thumbnailPath)
-
 	// Insert product into database
-	imageURL := "/images/" + "original_" + newFilename
-	thumbnailURL := "/images/" + "thumbnail_" + newFilename
+	imageURL := saved[0].ImageURL
+	thumbnailURL := saved[0].ThumbnailURL
 	h.Logger.Printf("Inserting product with image_url: %s, thumbnail_url: %s", imageURL, thumbnailURL)
-	query := `INSERT INTO products (catid, name, price, description, image_url, thumbnail_url) VALUES (?, ?, ?, ?, ?, ?)`
-	result, err := h.DB.Exec(query, categoryID, name, price, description, imageURL, thumbnailURL)
+	tx, err := h.DB.Begin()
+	if err != nil {
+		removeSaved()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+	query := `INSERT INTO products (catid, name, price, description, image_url, thumbnail_url, stock, status, publish_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	result, err := tx.Exec(query, categoryID, name, price, description, imageURL, thumbnailURL, stock, status, publishAt)
 	if err != nil {
+		removeSaved()
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 		h.Logger.Print(err)
 		return
 	}
-	h.Logger.Print(result)
 
 	// Get inserted product ID
 	productID, err := result.LastInsertId()
 	if err != nil {
+		removeSaved()
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 		return
 	}
 
-
-	// Return created product with full image URLs
-	product := models.Product{
-		ID:          int(productID),
-		CategoryID:  categoryID,
-		Name:        name,
-		Price:       price,
-		Description: description,
-		ImageURL:    "/images/original_" + newFilename,
-		ThumbnailURL: "/images/thumbnail_" + newFilename,
+	// Products created without a SKU get one derived from their ID
+	if sku == "" {
+		sku = fmt.Sprintf("P%d", productID)
 	}
-
-	// Log successful response
-	h.Logger.Printf("Successfully created product: %+v", product)
-	c.JSON(http.StatusOK, product)
-}
-
-func (h *ProductHandler) UpdateProduct(c *gin.Context) {
-	productID, err := strconv.Atoi(c.Param("id"))
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid product ID"})
+	if _, err := tx.Exec("UPDATE products SET sku = ? WHERE id = ?", sku, productID); err != nil {
+		removeSaved()
+		h.Logger.Printf("Error setting product SKU: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 		return
 	}
 
-	// Parse multipart form
-	form, err := c.MultipartForm()
+	slug, err := assignSlug(tx, models.SlugProduct, int(productID), name)
 	if err != nil {
-		h.Logger.Printf("Error parsing form: %v", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Unable to parse form"})
+		removeSaved()
+		h.Logger.Printf("Error setting product slug: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 		return
 	}
 
-	// Get form values
-	categoryID, err := strconv.Atoi(form.Value["category_id"][0])
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid category ID"})
+	if err := saveProductTranslations(tx, int(productID), translations); err != nil {
+		removeSaved()
+		h.Logger.Printf("Error saving product translations: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 		return
 	}
 
-	name := form.Value["name"][0]
-	price, err := strconv.ParseFloat(form.Value["price"][0], 64)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid price"})
+	if err := appendProductImages(tx, int(productID), saved, true); err != nil {
+		removeSaved()
+		h.Logger.Printf("Error saving product images: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if err := recordBasePrice(tx, int(productID), price); err != nil {
+		removeSaved()
+		h.Logger.Printf("Error recording product price: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		removeSaved()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 		return
 	}
 
-	description := form.Value["description"][0]
-
-	// Handle file upload if exists
-	var newFilename string
-	fileHeader, err := c.FormFile("image")
-	if err == nil {
-		file, err := fileHeader.Open()
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Unable to open file: %v", err)})
-			return
-		}
-		defer file.Close()
-
-		// Create unique filename
-		ext := filepath.Ext(fileHeader.Filename)
-		newFilename = fmt.Sprintf("%d%s", time.Now().UnixNano(), ext)
-
-		// Save original file
-		filePath := filepath.Join("/home/caijiayi/online-shopping-mall/public/images", "original_"+newFilename)
-		dst, err := os.Create(filePath)
-		if err != nil {
-			h.Logger.Printf("Error creating file: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Unable to save file"})
-			return
-		}
-		defer dst.Close()
-
-		// Read file into memory
-		fileBytes, err := io.ReadAll(file)
-		if err != nil {
-			h.Logger.Printf("Error reading file: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Unable to read file"})
-			return
-		}
-
-		if _, err := dst.Write(fileBytes); err != nil {
-			h.Logger.Printf("Error writing file: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Unable to save file"})
-			return
-		}
-
-		// Decode image from memory
-		img, err := imaging.Decode(bytes.NewReader(fileBytes))
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Unable to process image"})
-			return
-		}
+	images, err := loadProductImages(h.DB, int(productID))
+	if err != nil {
+		h.Logger.Printf("Error loading product images: %v", err)
+	}
 
-		bounds := img.Bounds()
-		width := bounds.Dx()
-		height := bounds.Dy()
-
-		var thumbnailPath string
-		if width <= 300 && height <= 300 {
-			// Use original image as thumbnail if it's small enough
-			thumbnailPath = filePath
-		} else {
-			// Create thumbnail for larger images
-			thumbnail := imaging.Resize(img, 300, 300, imaging.Lanczos)
-			thumbnailFilename := "thumbnail_" + newFilename
-			thumbnailPath = filepath.Join("/home/caijiayi/online-shopping-mall/public/images", thumbnailFilename)
-			err = imaging.Save(thumbnail, thumbnailPath)
-			if err != nil {
-				h.Logger.Printf("Error saving thumbnail: %v", err)
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Unable to save thumbnail"})
-				return
+	// Return created product with full image URLs
+	product := models.Product{
+		ID:           int(productID),
+		SKU:          sku,
+		Slug:         slug,
+		CategoryID:   categoryID,
+		Name:         name,
+		Price:        price,
+		CurrentPrice: price,
+		Description:  description,
+		ImageURL:     imageURL,
+		ThumbnailURL: thumbnailURL,
+		Stock:        stock,
+		Status:       status,
+		PublishAt:    publishAt,
+		Version:      1,
+		Images:       images,
+	}
+	for locale, t := range translations {
+		if t != (models.ProductText{}) {
+			if product.Translations == nil {
+				product.Translations = make(map[string]models.ProductText)
 			}
+			product.Translations[locale] = t
 		}
 	}
 
-	// Update product in database
-	var query string
-	var result sql.Result
-	if newFilename != "" {
-		query = `UPDATE products SET catid = ?, name = ?, price = ?, description = ?, image_url = ?, thumbnail_url = ? WHERE id = ?`
-		result, err = h.DB.Exec(query, categoryID, name, price, description, "/images/" + newFilename, "/images/thumbnail_" + newFilename, productID)
-	} else {
-		query = `UPDATE products SET catid = ?, name = ?, price = ?, description = ? WHERE id = ?`
-		result, err = h.DB.Exec(query, categoryID, name, price, description, productID)
-	}
-
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
-		return
+	// Log successful response
+	h.Logger.Printf("Successfully created product: %+v", product)
+	setETag(c, product.Version)
+	if isPublished(product) {
+		h.Search.Upsert(product)
 	}
+	c.JSON(http.StatusOK, product)
+}
 
-	rowsAffected, err := result.RowsAffected()
+// UpdateProduct replaces a product's details from a multipart form. Locales
+// sent as name[<locale>] and description[<locale>] fields replace that
+// translation; others are left as they are. The status is only changed if
+// the form has a status field. Invalid fields are reported as in
+// PatchProduct. The request must carry the version it was
+// based on, as If-Match or a version field; if the product has changed since,
+// nothing is saved and the current product is returned with 412 or 409.
+func (h *ProductHandler) UpdateProduct(c *gin.Context) {
+	productID, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid product ID"})
 		return
 	}
 
-	if rowsAffected == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+	// Parse multipart form
+	if _, err := c.MultipartForm(); err != nil {
+		h.Logger.Printf("Error parsing form: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unable to parse form"})
 		return
 	}
 
-	// Return updated product with full image URLs
-	product := models.Product{
-		ID:          productID,
-		CategoryID:  categoryID,
-		Name:        name,
-		Price:       price,
-		Description: description,
-		ImageURL:    "/images/" + newFilename,
-		ThumbnailURL: "/images/thumbnail_" + newFilename,
+	// Unlike PatchProduct, the main details must all be sent
+	errs := FieldErrors{}
+	patch := parseProductPatchForm(c, errs)
+	for _, field := range []string{"name", "price", "category_id"} {
+		if _, ok := c.GetPostForm(field); !ok {
+			errs.add(field, "is required")
+		}
 	}
-
-	c.JSON(http.StatusOK, product)
+	h.applyProductPatch(c, productID, patch, errs)
 }
 
 func (h *ProductHandler) DeleteProduct(c *gin.Context) {
@@ -328,8 +296,9 @@ func (h *ProductHandler) DeleteProduct(c *gin.Context) {
 		return
 	}
 
-	// Delete product from database
-	query := `DELETE FROM products WHERE id = ?`
+	// Archive rather than delete so order history can still resolve the
+	// product; PurgeArchivedProducts removes it for good later
+	query := `UPDATE products SET archived_at = NOW() WHERE id = ? AND archived_at IS NULL`
 	result, err := h.DB.Exec(query, productID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
@@ -346,22 +315,39 @@ func (h *ProductHandler) DeleteProduct(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
 		return
 	}
+	h.Search.Remove(productID)
 
 	c.Status(http.StatusNoContent)
 }
 
+// GetProduct returns a published product by ID or slug in the requested
+// locale, along with all of its translations. A slug the product had before
+// a rename still finds it, with a canonical Link to its current one.
 func (h *ProductHandler) GetProduct(c *gin.Context) {
-	// Get product ID from URL
-	productID, err := strconv.Atoi(c.Param("id"))
+	h.getProduct(c, false)
+}
+
+// getProduct serves GetProduct and, with preview set, PreviewProduct.
+func (h *ProductHandler) getProduct(c *gin.Context, preview bool) {
+	productID, redirectTo, err := resolveSlug(h.DB, models.SlugProduct, c.Param("id"))
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid product ID"})
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 		return
 	}
+	if redirectTo != "" {
+		setCanonicalLink(c, models.SlugProduct, redirectTo)
+	}
 
 	// Query product from database
-	row := h.DB.QueryRow("SELECT * FROM products WHERE id = ?", productID)
-	var p models.Product
-	err = row.Scan(&p.ID, &p.CategoryID, &p.Name, &p.Price, &p.Description, &p.ImageURL, &p.ThumbnailURL)
+	row := h.DB.QueryRow("SELECT "+productColumns+" FROM products WHERE id = ?", productID)
+	p, err := scanProduct(row)
+	if err == nil && !preview && !isPublished(p) {
+		err = sql.ErrNoRows
+	}
 	if err != nil {
 		if err == sql.ErrNoRows {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
@@ -371,71 +357,178 @@ func (h *ProductHandler) GetProduct(c *gin.Context) {
 		return
 	}
 
+	p.Images, err = loadProductImages(h.DB, productID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	p.Attributes, err = loadProductAttributes(h.DB, productID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if err := h.withBundle(&p); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	products := []models.Product{p}
+	if err := loadProductTranslations(h.DB, products, ""); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	p = products[0]
+	localizeProduct(&p, requestLocale(c))
+
+	setETag(c, p.Version)
 	c.JSON(http.StatusOK, p)
 }
 
+// GetProductsByCategoryID is ListProducts with a mandatory category filter.
+// With include_descendants=true products of every subcategory are included.
 func (h *ProductHandler) GetProductsByCategoryID(c *gin.Context) {
-	categoryID, err := strconv.Atoi(c.Query("category_id"))
-	if err != nil {
+	if _, err := strconv.Atoi(c.Query("category_id")); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid category ID"})
 		return
 	}
 
-	rows, err := h.DB.Query("SELECT * FROM products WHERE catid = ?", categoryID)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
-		return
-	}
-	defer rows.Close()
+	h.ListProducts(c)
+}
 
-	var products []models.Product
-	for rows.Next() {
-		var p models.Product
-		err := rows.Scan(&p.ID, &p.CategoryID, &p.Name, &p.Price, &p.Description, &p.ImageURL, &p.ThumbnailURL)
+// completeFilter fills in what only the database knows about a parsed
+// filter: the subcategories of the requested category and the attribute
+// types. Filters naming attributes that do not exist fail with
+// errInvalidAttributeFilter.
+func completeFilter(db *sql.DB, f *ProductFilter) error {
+	if f.Descendants && f.CategoryID != nil {
+		tree, err := loadCategoryTree(db)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
-			return
+			return err
 		}
-		products = append(products, p)
+		f.CategoryIDs = tree.descendants(*f.CategoryID)
 	}
+	return resolveAttributeFilters(db, f.Attributes)
+}
 
-	if err = rows.Err(); err != nil {
+// resolveFilter completes a parsed filter with completeFilter. It writes the
+// error response itself and reports whether to carry on.
+func (h *ProductHandler) resolveFilter(c *gin.Context, f *ProductFilter) bool {
+	if err := completeFilter(h.DB, f); err != nil {
+		if errors.Is(err, errInvalidAttributeFilter) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return false
+		}
+		h.Logger.Printf("Database error: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
-		return
+		return false
 	}
-
-	c.JSON(http.StatusOK, products)
+	return true
 }
 
+// ListProducts returns one page of products. It accepts the query parameters
+// sort, limit, cursor, category_id, include_descendants, min_price, max_price
+// and ids, plus attribute filters attr[<id>]=a,b, attr_min[<id>] and
+// attr_max[<id>]. With facets=true the page also carries per-value counts for
+// every attribute of the matching products. Names and descriptions are in
+// the locale chosen by lang or Accept-Language.
 func (h *ProductHandler) ListProducts(c *gin.Context) {
 	h.Logger.Printf("Handling ListProducts request")
-	
-	// Query products from database
-	rows, err := h.DB.Query("SELECT id, catid, name, price, description, image_url, thumbnail_url FROM products")
+
+	q, err := parseProductQuery(c)
 	if err != nil {
-		h.Logger.Printf("Database error: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	defer rows.Close()
 
-	var products []models.Product
-	for rows.Next() {
-		var p models.Product
-		err := rows.Scan(&p.ID, &p.CategoryID, &p.Name, &p.Price, &p.Description, &p.ImageURL, &p.ThumbnailURL)
+	// Pages are cached per query string and locale until the catalog
+	// changes. The filter is completed on a miss only, since subcategories
+	// and attributes belong to the catalog too
+	locale := requestLocale(c)
+	page, err := h.Catalog.Fetch("products?"+c.Request.URL.Query().Encode()+"#"+locale, func() (interface{}, error) {
+		if err := completeFilter(h.DB, &q.Filter); err != nil {
+			if !errors.Is(err, errInvalidAttributeFilter) {
+				h.Logger.Printf("Database error: %v", err)
+			}
+			return nil, err
+		}
+		page, err := queryProducts(h.DB, q)
 		if err != nil {
-			h.Logger.Printf("Database scan error: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			h.Logger.Printf("Database error: %v", err)
+			return nil, err
+		}
+		if err := localizeProducts(h.DB, page.Products, locale); err != nil {
+			h.Logger.Printf("Error loading translations: %v", err)
+			return nil, err
+		}
+		if q.Facets {
+			if page.Facets, err = attributeFacets(h.DB, q.Filter); err != nil {
+				h.Logger.Printf("Error counting facets: %v", err)
+				return nil, err
+			}
+		}
+		return page, nil
+	})
+	if err != nil {
+		if errors.Is(err, errInvalidAttributeFilter) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
-		products = append(products, p)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
 	}
 
-	if err = rows.Err(); err != nil {
-		h.Logger.Printf("Database rows error: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+	c.JSON(http.StatusOK, page)
+}
+
+// SearchProducts ranks products against the q parameter using the in-memory
+// search index. Results carry highlighted name and description snippets.
+func (h *ProductHandler) SearchProducts(c *gin.Context) {
+	query := strings.TrimSpace(c.Query("q"))
+	if query == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "q is required"})
 		return
 	}
 
-	c.JSON(http.StatusOK, products)
+	limit := defaultPageSize
+	if s := c.Query("limit"); s != "" {
+		l, err := strconv.Atoi(s)
+		if err != nil || l < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+			return
+		}
+		limit = min(l, maxPageSize)
+	}
+
+	offset := 0
+	if s := c.Query("offset"); s != "" {
+		o, err := strconv.Atoi(s)
+		if err != nil || o < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid offset"})
+			return
+		}
+		offset = o
+	}
+
+	results, total := h.Search.Search(query, requestLocale(c), offset, limit)
+
+	// Index entries keep the price from when they were indexed; sales may
+	// have started or ended since.
+	products := make([]models.Product, len(results))
+	for i := range results {
+		products[i] = results[i].Product
+	}
+	if err := refreshPrices(h.DB, products); err != nil {
+		h.Logger.Printf("Error refreshing search result prices: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	for i := range results {
+		results[i].Product = products[i]
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"query":   query,
+		"results": results,
+		"total":   total,
+		"limit":   limit,
+		"offset":  offset,
+	})
 }
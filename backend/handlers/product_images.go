@@ -0,0 +1,353 @@
+package handlers
+
+import (
+	"database/sql"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+
+	"backend/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// sqlExecer is satisfied by both *sql.DB and *sql.Tx.
+type sqlExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+type ReorderImagesRequest struct {
+	ImageIDs []uint `json:"image_ids" binding:"required,min=1"`
+}
+
+func loadProductImages(db sqlExecer, productID int) ([]models.ProductImage, error) {
+	rows, err := db.Query(`SELECT id, product_id, image_url, thumbnail_url, position, is_primary, created_at
+		FROM product_images WHERE product_id = ? ORDER BY position, id`, productID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	images := []models.ProductImage{}
+	for rows.Next() {
+		var img models.ProductImage
+		if err := rows.Scan(&img.ID, &img.ProductID, &img.ImageURL, &img.ThumbnailURL, &img.Position, &img.IsPrimary, &img.CreatedAt); err != nil {
+			return nil, err
+		}
+		images = append(images, img)
+	}
+	return images, rows.Err()
+}
+
+// uploadedImages collects the files sent as "images" (any number) and the
+// single "image" field older clients use.
+func uploadedImages(c *gin.Context) []*multipart.FileHeader {
+	form, err := c.MultipartForm()
+	if err != nil {
+		return nil
+	}
+	var files []*multipart.FileHeader
+	files = append(files, form.File["images"]...)
+	files = append(files, form.File["image"]...)
+	return files
+}
+
+// saveUploadedImages runs every file through saveUploadedImage. On failure
+// the files already written are removed again.
+func (h *ProductHandler) saveUploadedImages(files []*multipart.FileHeader) ([]savedImage, error) {
+	var saved []savedImage
+	for _, fileHeader := range files {
+		img, err := saveUploadedImage(fileHeader, h.Logger)
+		if err != nil {
+			for _, s := range saved {
+				removeImageFiles(s.ImageURL, s.ThumbnailURL)
+			}
+			return nil, err
+		}
+		saved = append(saved, img)
+	}
+	return saved, nil
+}
+
+// appendProductImages adds images to the end of a product's gallery. With
+// makePrimary the first of them becomes the primary image.
+func appendProductImages(tx sqlExecer, productID int, images []savedImage, makePrimary bool) error {
+	var position int
+	err := tx.QueryRow("SELECT COALESCE(MAX(position) + 1, 0) FROM product_images WHERE product_id = ?", productID).Scan(&position)
+	if err != nil {
+		return err
+	}
+
+	if makePrimary && len(images) > 0 {
+		if _, err := tx.Exec("UPDATE product_images SET is_primary = FALSE WHERE product_id = ?", productID); err != nil {
+			return err
+		}
+	}
+
+	for i, img := range images {
+		_, err := tx.Exec(`INSERT INTO product_images (product_id, image_url, thumbnail_url, position, is_primary, created_at)
+			VALUES (?, ?, ?, ?, ?, NOW())`, productID, img.ImageURL, img.ThumbnailURL, position+i, makePrimary && i == 0)
+		if err != nil {
+			return err
+		}
+	}
+	return syncPrimaryImage(tx, productID)
+}
+
+// syncPrimaryImage makes sure a gallery has exactly one primary image,
+// falling back to the first by position, and mirrors it onto the product.
+func syncPrimaryImage(tx sqlExecer, productID int) error {
+	var id uint
+	var imageURL, thumbnailURL string
+	err := tx.QueryRow(`SELECT id, image_url, thumbnail_url FROM product_images
+		WHERE product_id = ? ORDER BY is_primary DESC, position, id LIMIT 1`, productID).Scan(&id, &imageURL, &thumbnailURL)
+	if err == sql.ErrNoRows {
+		_, err = tx.Exec("UPDATE products SET image_url = '', thumbnail_url = '' WHERE id = ?", productID)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("UPDATE product_images SET is_primary = (id = ?) WHERE product_id = ?", id, productID); err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE products SET image_url = ?, thumbnail_url = ? WHERE id = ?", imageURL, thumbnailURL, productID)
+	return err
+}
+
+// bumpProductVersion moves a product on to a new version after a change to
+// its gallery, so that clients holding its ETag see the images changed.
+func bumpProductVersion(tx sqlExecer, productID int) error {
+	_, err := tx.Exec("UPDATE products SET version = version + 1 WHERE id = ?", productID)
+	return err
+}
+
+// respondGallery writes the current gallery of a product, with the ETag of
+// the product version it belongs to.
+func (h *ProductHandler) respondGallery(c *gin.Context, productID int) {
+	images, err := loadProductImages(h.DB, productID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	var version int
+	if err := h.DB.QueryRow("SELECT version FROM products WHERE id = ?", productID).Scan(&version); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	setETag(c, version)
+	c.JSON(http.StatusOK, gin.H{"product_id": productID, "version": version, "images": images})
+}
+
+// AddProductImages appends the uploaded "images" files to a product's
+// gallery. Passing primary=true makes the first upload the primary image.
+func (h *ProductHandler) AddProductImages(c *gin.Context) {
+	productID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid product ID"})
+		return
+	}
+
+	var exists bool
+	if err := h.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM products WHERE id = ?)", productID).Scan(&exists); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+		return
+	}
+
+	files := uploadedImages(c)
+	if len(files) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "At least one image is required"})
+		return
+	}
+	saved, err := h.saveUploadedImages(files)
+	if err != nil {
+		respondUploadError(c, h.Logger, err)
+		return
+	}
+
+	tx, err := h.DB.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+	err = appendProductImages(tx, productID, saved, c.PostForm("primary") == "true")
+	if err == nil {
+		err = bumpProductVersion(tx, productID)
+	}
+	if err != nil {
+		h.Logger.Printf("Error adding product images: %v", err)
+		for _, s := range saved {
+			removeImageFiles(s.ImageURL, s.ThumbnailURL)
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	h.respondGallery(c, productID)
+}
+
+// DeleteProductImage removes one gallery image and its files. If it was the
+// primary image the next one in order takes over.
+func (h *ProductHandler) DeleteProductImage(c *gin.Context) {
+	imageID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid image ID"})
+		return
+	}
+
+	var img models.ProductImage
+	err = h.DB.QueryRow("SELECT id, product_id, image_url, thumbnail_url FROM product_images WHERE id = ?", imageID).
+		Scan(&img.ID, &img.ProductID, &img.ImageURL, &img.ThumbnailURL)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	tx, err := h.DB.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM product_images WHERE id = ?", imageID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if err := syncPrimaryImage(tx, int(img.ProductID)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if err := bumpProductVersion(tx, int(img.ProductID)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	removeImageFiles(img.ImageURL, img.ThumbnailURL)
+
+	h.respondGallery(c, int(img.ProductID))
+}
+
+// ReorderProductImages sets the gallery order. The request must list every
+// image of the product exactly once.
+func (h *ProductHandler) ReorderProductImages(c *gin.Context) {
+	productID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid product ID"})
+		return
+	}
+
+	var req ReorderImagesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+
+	images, err := loadProductImages(h.DB, productID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	current := make(map[uint]bool)
+	for _, img := range images {
+		current[img.ID] = true
+	}
+	seen := make(map[uint]bool)
+	for _, id := range req.ImageIDs {
+		if !current[id] || seen[id] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "image_ids must list every image of the product exactly once"})
+			return
+		}
+		seen[id] = true
+	}
+	if len(seen) != len(current) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "image_ids must list every image of the product exactly once"})
+		return
+	}
+
+	tx, err := h.DB.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+	for position, id := range req.ImageIDs {
+		if _, err := tx.Exec("UPDATE product_images SET position = ? WHERE id = ?", position, id); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+	}
+	if err := bumpProductVersion(tx, productID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	h.respondGallery(c, productID)
+}
+
+// SetPrimaryProductImage marks a gallery image as the product's primary
+// image.
+func (h *ProductHandler) SetPrimaryProductImage(c *gin.Context) {
+	imageID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid image ID"})
+		return
+	}
+
+	var productID int
+	if err := h.DB.QueryRow("SELECT product_id FROM product_images WHERE id = ?", imageID).Scan(&productID); err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	tx, err := h.DB.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("UPDATE product_images SET is_primary = (id = ?) WHERE product_id = ?", imageID, productID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if err := syncPrimaryImage(tx, productID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if err := bumpProductVersion(tx, productID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	h.respondGallery(c, productID)
+}
@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+)
+
+var galleryColumns = []string{"id", "product_id", "image_url", "thumbnail_url", "position", "is_primary", "created_at"}
+
+// TestGalleryChangesBumpVersion checks that gallery changes move the product
+// to a new version in their own transaction and hand out its ETag.
+func TestGalleryChangesBumpVersion(t *testing.T) {
+	bump := regexp.QuoteMeta("UPDATE products SET version = version + 1 WHERE id = ?")
+	created := time.Date(2026, 1, 5, 9, 0, 0, 0, time.UTC)
+	expectGallery := func(mock sqlmock.Sqlmock) {
+		mock.ExpectQuery("FROM product_images WHERE product_id = \\?").WithArgs(3).
+			WillReturnRows(sqlmock.NewRows(galleryColumns).
+				AddRow(5, 3, "/images/a.jpg", "/images/a_thumb.jpg", 0, true, created).
+				AddRow(6, 3, "/images/b.jpg", "/images/b_thumb.jpg", 1, false, created))
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		expect func(mock sqlmock.Sqlmock)
+	}{
+		{
+			name:   "set primary",
+			method: "PUT",
+			path:   "/products/images/6/primary",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT product_id FROM product_images WHERE id = \\?").WithArgs(6).
+					WillReturnRows(sqlmock.NewRows([]string{"product_id"}).AddRow(3))
+				mock.ExpectBegin()
+				mock.ExpectExec(regexp.QuoteMeta("UPDATE product_images SET is_primary = (id = ?) WHERE product_id = ?")).
+					WithArgs(6, 3).WillReturnResult(sqlmock.NewResult(0, 2))
+				mock.ExpectQuery("SELECT id, image_url, thumbnail_url FROM product_images").WithArgs(3).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "image_url", "thumbnail_url"}).AddRow(6, "/images/b.jpg", "/images/b_thumb.jpg"))
+				mock.ExpectExec(regexp.QuoteMeta("UPDATE product_images SET is_primary = (id = ?) WHERE product_id = ?")).
+					WithArgs(6, 3).WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec(regexp.QuoteMeta("UPDATE products SET image_url = ?, thumbnail_url = ? WHERE id = ?")).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(bump).WithArgs(3).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+		},
+		{
+			name:   "reorder",
+			method: "PUT",
+			path:   "/products/3/images/order",
+			body:   `{"image_ids": [6, 5]}`,
+			expect: func(mock sqlmock.Sqlmock) {
+				expectGallery(mock)
+				mock.ExpectBegin()
+				mock.ExpectExec(regexp.QuoteMeta("UPDATE product_images SET position = ? WHERE id = ?")).
+					WithArgs(0, 6).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(regexp.QuoteMeta("UPDATE product_images SET position = ? WHERE id = ?")).
+					WithArgs(1, 5).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(bump).WithArgs(3).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			tt.expect(mock)
+			expectGallery(mock)
+			mock.ExpectQuery("SELECT version FROM products WHERE id = \\?").WithArgs(3).
+				WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(8))
+
+			h := &ProductHandler{DB: conn, Logger: log.New(io.Discard, "", 0)}
+			router := gin.New()
+			router.PUT("/products/images/:id/primary", h.SetPrimaryProductImage)
+			router.PUT("/products/:id/images/order", h.ReorderProductImages)
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+			if etag := w.Header().Get("ETag"); etag != `"8"` {
+				t.Errorf("ETag %q, want the new version", etag)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,662 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"backend/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// catalogColumns is the header of the CSV import/export format. Images are
+// separated by "|" within their cell.
+var catalogColumns = []string{"sku", "name", "category", "price", "description", "stock", "images"}
+
+const imageRefSeparator = "|"
+
+// catalogRow is one product of an import or export file.
+type catalogRow struct {
+	SKU         string   `json:"sku"`
+	Name        string   `json:"name"`
+	Category    string   `json:"category"`
+	Price       float64  `json:"price"`
+	Description string   `json:"description"`
+	Stock       *int     `json:"stock,omitempty"`
+	Images      []string `json:"images"`
+}
+
+// rawCatalogRow is a row as read from the file, before validation. Line is
+// the CSV line or the 1-based JSON array index.
+type rawCatalogRow struct {
+	Line   int
+	Fields map[string]string
+	Images []string
+}
+
+// ImportRowResult reports what an import did, or would do, with one row.
+type ImportRowResult struct {
+	Line   int      `json:"line"`
+	SKU    string   `json:"sku"`
+	Action string   `json:"action,omitempty"`
+	Errors []string `json:"errors,omitempty"`
+}
+
+// ImportReport is the response body of ImportProducts.
+type ImportReport struct {
+	DryRun  bool              `json:"dry_run"`
+	Valid   bool              `json:"valid"`
+	Created int               `json:"created"`
+	Updated int               `json:"updated"`
+	Rows    []ImportRowResult `json:"rows"`
+}
+
+// plannedRow is a validated row together with what will happen to it.
+type plannedRow struct {
+	catalogRow
+	ProductID  int // zero for new products
+	CategoryID int // zero when the category is created by the import
+}
+
+func splitImageRefs(s string) []string {
+	var refs []string
+	for _, ref := range strings.Split(s, imageRefSeparator) {
+		if ref = strings.TrimSpace(ref); ref != "" {
+			refs = append(refs, ref)
+		}
+	}
+	return refs
+}
+
+func readCSVCatalog(r io.Reader) ([]rawCatalogRow, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read CSV header: %v", err)
+	}
+	for i := range header {
+		header[i] = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(header[i], "\ufeff")))
+	}
+
+	var rows []rawCatalogRow
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read CSV: %v", err)
+		}
+		row := rawCatalogRow{Line: line, Fields: make(map[string]string)}
+		for i, value := range record {
+			if i < len(header) {
+				row.Fields[header[i]] = strings.TrimSpace(value)
+			}
+		}
+		row.Images = splitImageRefs(row.Fields["images"])
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+func readJSONCatalog(r io.Reader) ([]rawCatalogRow, error) {
+	var items []map[string]interface{}
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+	if err := decoder.Decode(&items); err != nil {
+		return nil, fmt.Errorf("Unable to parse JSON: %v", err)
+	}
+
+	rows := make([]rawCatalogRow, 0, len(items))
+	for i, item := range items {
+		row := rawCatalogRow{Line: i + 1, Fields: make(map[string]string)}
+		for key, value := range item {
+			key = strings.ToLower(key)
+			switch v := value.(type) {
+			case nil:
+			case string:
+				row.Fields[key] = strings.TrimSpace(v)
+			case []interface{}:
+				if key == "images" {
+					for _, ref := range v {
+						if s, ok := ref.(string); ok && strings.TrimSpace(s) != "" {
+							row.Images = append(row.Images, strings.TrimSpace(s))
+						}
+					}
+				}
+			default:
+				row.Fields[key] = fmt.Sprint(v)
+			}
+		}
+		if len(row.Images) == 0 {
+			row.Images = splitImageRefs(row.Fields["images"])
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// importImageSource resolves image references from an import file. A
+// reference is either an existing /images/ URL, the name of a file uploaded
+// with the import, or a path inside IMPORT_DIR on the server.
+type importImageSource struct {
+	uploads   map[string]*multipart.FileHeader
+	importDir string
+}
+
+func (src importImageSource) check(ref string) error {
+	if strings.HasPrefix(ref, "/images/") {
+		if _, err := os.Stat(filepath.Join(imagesDir, filepath.Base(ref))); err != nil {
+			return fmt.Errorf("image %s does not exist", ref)
+		}
+		return nil
+	}
+	if _, ok := src.uploads[filepath.Base(ref)]; ok {
+		return nil
+	}
+	path, err := src.localPath(ref)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("image %s was not uploaded and is not in the import directory", ref)
+	}
+	return nil
+}
+
+func (src importImageSource) localPath(ref string) (string, error) {
+	if src.importDir == "" {
+		return "", fmt.Errorf("image %s was not uploaded with the import", ref)
+	}
+	path := filepath.Join(src.importDir, filepath.Clean("/"+ref))
+	if !strings.HasPrefix(path, filepath.Clean(src.importDir)+string(filepath.Separator)) {
+		return "", fmt.Errorf("image path %s is outside the import directory", ref)
+	}
+	return path, nil
+}
+
+// resolveImportImage returns the stored image for a reference, running new files
+// through the thumbnail pipeline. created reports whether files were written.
+func (h *ProductHandler) resolveImportImage(src importImageSource, ref string) (img savedImage, created bool, err error) {
+	if strings.HasPrefix(ref, "/images/") {
+		var thumbnailURL string
+		err := h.DB.QueryRow("SELECT thumbnail_url FROM product_images WHERE image_url = ? LIMIT 1", ref).Scan(&thumbnailURL)
+		if err == sql.ErrNoRows {
+			thumbnailURL = ref
+		} else if err != nil {
+			return savedImage{}, false, err
+		}
+		return savedImage{ImageURL: ref, ThumbnailURL: thumbnailURL}, false, nil
+	}
+	if fileHeader, ok := src.uploads[filepath.Base(ref)]; ok {
+		img, err := saveUploadedImage(fileHeader, h.Logger)
+		return img, err == nil, err
+	}
+	path, err := src.localPath(ref)
+	if err != nil {
+		return savedImage{}, false, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return savedImage{}, false, err
+	}
+	img, err = saveImageBytes(path, data, h.Logger)
+	return img, err == nil, err
+}
+
+// validateCatalogRows checks every row and works out whether it creates or
+// updates a product.
+func (h *ProductHandler) validateCatalogRows(rows []rawCatalogRow, src importImageSource, createCategories bool) ([]plannedRow, []ImportRowResult, bool, error) {
+	categories := make(map[string]int)
+	catRows, err := h.DB.Query("SELECT catid, name FROM categories")
+	if err != nil {
+		return nil, nil, false, err
+	}
+	for catRows.Next() {
+		var id int
+		var name string
+		if err := catRows.Scan(&id, &name); err != nil {
+			catRows.Close()
+			return nil, nil, false, err
+		}
+		categories[strings.ToLower(name)] = id
+	}
+	catRows.Close()
+
+	var plans []plannedRow
+	var results []ImportRowResult
+	valid := true
+	seenSKUs := make(map[string]int)
+	for _, raw := range rows {
+		f := raw.Fields
+		row := catalogRow{
+			SKU:         f["sku"],
+			Name:        f["name"],
+			Category:    f["category"],
+			Description: f["description"],
+			Images:      raw.Images,
+		}
+		result := ImportRowResult{Line: raw.Line, SKU: row.SKU}
+
+		switch {
+		case row.SKU == "":
+			result.Errors = append(result.Errors, "sku is required")
+		case len(row.SKU) > 64:
+			result.Errors = append(result.Errors, "sku must be at most 64 characters")
+		case seenSKUs[row.SKU] != 0:
+			result.Errors = append(result.Errors, fmt.Sprintf("sku is repeated from line %d", seenSKUs[row.SKU]))
+		default:
+			seenSKUs[row.SKU] = raw.Line
+		}
+
+		if row.Name == "" {
+			result.Errors = append(result.Errors, "name is required")
+		} else if len(row.Name) > 255 {
+			result.Errors = append(result.Errors, "name must be at most 255 characters")
+		}
+
+		categoryID := 0
+		if row.Category == "" {
+			result.Errors = append(result.Errors, "category is required")
+		} else if id, ok := categories[strings.ToLower(row.Category)]; ok {
+			categoryID = id
+		} else if !createCategories {
+			result.Errors = append(result.Errors, fmt.Sprintf("category %q does not exist", row.Category))
+		}
+
+		if price, err := strconv.ParseFloat(f["price"], 64); err != nil || price <= 0 {
+			result.Errors = append(result.Errors, "price must be a positive number")
+		} else {
+			row.Price = price
+		}
+
+		if s := f["stock"]; s != "" {
+			if stock, err := strconv.Atoi(s); err != nil || stock < 0 {
+				result.Errors = append(result.Errors, "stock must be a non-negative integer")
+			} else {
+				row.Stock = &stock
+			}
+		}
+
+		for _, ref := range row.Images {
+			if err := src.check(ref); err != nil {
+				result.Errors = append(result.Errors, err.Error())
+			}
+		}
+
+		plan := plannedRow{catalogRow: row, CategoryID: categoryID}
+		if row.SKU != "" {
+			err := h.DB.QueryRow("SELECT id FROM products WHERE sku = ?", row.SKU).Scan(&plan.ProductID)
+			if err != nil && err != sql.ErrNoRows {
+				return nil, nil, false, err
+			}
+		}
+		if plan.ProductID == 0 {
+			result.Action = "create"
+		} else {
+			result.Action = "update"
+			if row.Price > 0 {
+				sale, ok, err := maxSalePrice(h.DB, plan.ProductID)
+				if err != nil {
+					return nil, nil, false, err
+				}
+				if ok && row.Price <= sale {
+					result.Errors = append(result.Errors, fmt.Sprintf("price must be above the sale price of %.2f", sale))
+				}
+			}
+		}
+
+		if len(result.Errors) > 0 {
+			valid = false
+			result.Action = ""
+		}
+		results = append(results, result)
+		plans = append(plans, plan)
+	}
+	return plans, results, valid, nil
+}
+
+// applyCatalogRows writes validated rows in a single transaction and returns
+// the IDs of the products it touched.
+func (h *ProductHandler) applyCatalogRows(plans []plannedRow, src importImageSource) ([]int, error) {
+	// Process image files before the transaction so a bad file doesn't
+	// leave a half-imported catalog behind.
+	var created []savedImage
+	cleanup := func() {
+		for _, img := range created {
+			removeImageFiles(img.ImageURL, img.ThumbnailURL)
+		}
+	}
+	images := make([][]savedImage, len(plans))
+	for i, plan := range plans {
+		for _, ref := range plan.Images {
+			img, isNew, err := h.resolveImportImage(src, ref)
+			if err != nil {
+				cleanup()
+				return nil, fmt.Errorf("image %s: %w", ref, err)
+			}
+			if isNew {
+				created = append(created, img)
+			}
+			images[i] = append(images[i], img)
+		}
+	}
+
+	tx, err := h.DB.Begin()
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	tree, err := loadCategoryTree(tx)
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+	newCategories := make(map[string]int)
+	var ids []int
+	var dropped []string
+	for i, plan := range plans {
+		categoryID := plan.CategoryID
+		if categoryID == 0 {
+			key := strings.ToLower(plan.Category)
+			if id, ok := newCategories[key]; ok {
+				categoryID = id
+			} else {
+				result, err := tx.Exec("INSERT INTO categories (name) VALUES (?)", plan.Category)
+				if err != nil {
+					cleanup()
+					return nil, err
+				}
+				id, _ := result.LastInsertId()
+				categoryID = int(id)
+				newCategories[key] = categoryID
+				if _, err := assignSlug(tx, models.SlugCategory, categoryID, plan.Category); err != nil {
+					cleanup()
+					return nil, err
+				}
+			}
+		}
+
+		productID := plan.ProductID
+		if productID == 0 {
+			stock := 0
+			if plan.Stock != nil {
+				stock = *plan.Stock
+			}
+			result, err := tx.Exec(`INSERT INTO products (sku, catid, name, price, description, image_url, thumbnail_url, stock) VALUES (?, ?, ?, ?, ?, '', '', ?)`,
+				plan.SKU, categoryID, plan.Name, plan.Price, plan.Description, stock)
+			if err != nil {
+				cleanup()
+				return nil, err
+			}
+			id, _ := result.LastInsertId()
+			productID = int(id)
+		} else {
+			_, err := tx.Exec(`UPDATE products SET catid = ?, name = ?, price = ?, description = ?, version = version + 1 WHERE id = ?`,
+				categoryID, plan.Name, plan.Price, plan.Description, productID)
+			if err == nil && plan.Stock != nil {
+				_, err = tx.Exec(`UPDATE products SET stock = ? WHERE id = ?`, *plan.Stock, productID)
+			}
+			if err == nil {
+				err = pruneAttributeValues(tx, tree, categoryID, productID)
+			}
+			if err != nil {
+				cleanup()
+				return nil, err
+			}
+		}
+		if _, err := assignSlug(tx, models.SlugProduct, productID, plan.Name); err != nil {
+			cleanup()
+			return nil, err
+		}
+		if err := recordBasePrice(tx, productID, plan.Price); err != nil {
+			cleanup()
+			return nil, err
+		}
+
+		// A row that lists images replaces the whole gallery
+		if len(images[i]) > 0 {
+			current, err := loadProductImages(tx, productID)
+			if err != nil {
+				cleanup()
+				return nil, err
+			}
+			keep := make(map[string]bool)
+			for _, img := range images[i] {
+				keep[img.ImageURL] = true
+			}
+			for _, img := range current {
+				if !keep[img.ImageURL] {
+					dropped = append(dropped, img.ImageURL, img.ThumbnailURL)
+				}
+			}
+			if _, err := tx.Exec("DELETE FROM product_images WHERE product_id = ?", productID); err != nil {
+				cleanup()
+				return nil, err
+			}
+			if err := appendProductImages(tx, productID, images[i], true); err != nil {
+				cleanup()
+				return nil, err
+			}
+		}
+		ids = append(ids, productID)
+	}
+
+	if err := tx.Commit(); err != nil {
+		cleanup()
+		return nil, err
+	}
+
+	// Only delete files no gallery refers to any more
+	for _, url := range dropped {
+		var inUse bool
+		if err := h.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM product_images WHERE image_url = ? OR thumbnail_url = ?)", url, url).Scan(&inUse); err == nil && !inUse {
+			removeImageFiles(url)
+		}
+	}
+	return ids, nil
+}
+
+// ImportProducts upserts products from a CSV or JSON file sent as "file",
+// matching existing products by SKU. Image files referenced by name can be
+// uploaded alongside as "images". With dry_run=true the file is only
+// validated; create_categories=true creates unknown categories.
+func (h *ProductHandler) ImportProducts(c *gin.Context) {
+	form, err := c.MultipartForm()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unable to parse form"})
+		return
+	}
+	files := form.File["file"]
+	if len(files) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "file is required"})
+		return
+	}
+	fileHeader := files[0]
+
+	format := strings.ToLower(c.DefaultQuery("format", c.PostForm("format")))
+	if format == "" {
+		format = strings.TrimPrefix(strings.ToLower(filepath.Ext(fileHeader.Filename)), ".")
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unable to open file"})
+		return
+	}
+	defer file.Close()
+
+	var rows []rawCatalogRow
+	switch format {
+	case "csv":
+		rows, err = readCSVCatalog(file)
+	case "json":
+		rows, err = readJSONCatalog(file)
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be csv or json"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(rows) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The file contains no products"})
+		return
+	}
+
+	src := importImageSource{uploads: make(map[string]*multipart.FileHeader), importDir: os.Getenv("IMPORT_DIR")}
+	for _, fh := range form.File["images"] {
+		src.uploads[filepath.Base(fh.Filename)] = fh
+	}
+
+	isTrue := func(key string) bool {
+		v := c.DefaultQuery(key, c.PostForm(key))
+		return v == "true" || v == "1"
+	}
+	report := ImportReport{DryRun: isTrue("dry_run")}
+
+	plans, results, valid, err := h.validateCatalogRows(rows, src, isTrue("create_categories"))
+	if err != nil {
+		h.Logger.Printf("Error validating import: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	report.Rows = results
+	report.Valid = valid
+	for _, r := range results {
+		switch r.Action {
+		case "create":
+			report.Created++
+		case "update":
+			report.Updated++
+		}
+	}
+
+	if report.DryRun {
+		c.JSON(http.StatusOK, report)
+		return
+	}
+	if !valid {
+		report.Created, report.Updated = 0, 0
+		c.JSON(http.StatusUnprocessableEntity, report)
+		return
+	}
+
+	ids, err := h.applyCatalogRows(plans, src)
+	if err != nil {
+		h.Logger.Printf("Error importing products: %v", err)
+		var upErr *uploadError
+		if errors.As(err, &upErr) {
+			c.JSON(upErr.Status, gin.H{"error": upErr.Message})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Import failed"})
+		return
+	}
+	for _, id := range ids {
+		h.syncSearch(id)
+	}
+	h.Logger.Printf("Imported %d products (%d created, %d updated)", len(ids), report.Created, report.Updated)
+
+	c.JSON(http.StatusOK, report)
+}
+
+// exportCatalogRows loads every product in the import format.
+func (h *ProductHandler) exportCatalogRows() ([]catalogRow, error) {
+	gallery := make(map[int][]string)
+	imgRows, err := h.DB.Query("SELECT product_id, image_url FROM product_images ORDER BY product_id, position, id")
+	if err != nil {
+		return nil, err
+	}
+	for imgRows.Next() {
+		var productID int
+		var url string
+		if err := imgRows.Scan(&productID, &url); err != nil {
+			imgRows.Close()
+			return nil, err
+		}
+		gallery[productID] = append(gallery[productID], url)
+	}
+	imgRows.Close()
+
+	rows, err := h.DB.Query(`SELECT p.id, COALESCE(p.sku, ''), p.name, COALESCE(c.name, ''), p.price, COALESCE(p.description, ''), p.stock
+		FROM products p LEFT JOIN categories c ON c.catid = p.catid
+		WHERE p.archived_at IS NULL ORDER BY p.id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	catalog := []catalogRow{}
+	for rows.Next() {
+		var id, stock int
+		var row catalogRow
+		if err := rows.Scan(&id, &row.SKU, &row.Name, &row.Category, &row.Price, &row.Description, &stock); err != nil {
+			return nil, err
+		}
+		row.Stock = &stock
+		row.Images = gallery[id]
+		if row.Images == nil {
+			row.Images = []string{}
+		}
+		catalog = append(catalog, row)
+	}
+	return catalog, rows.Err()
+}
+
+// ExportProducts writes the catalog as CSV or JSON (format=csv|json) in the
+// same shape ImportProducts accepts.
+func (h *ProductHandler) ExportProducts(c *gin.Context) {
+	format := strings.ToLower(c.DefaultQuery("format", "csv"))
+	if format != "csv" && format != "json" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be csv or json"})
+		return
+	}
+
+	catalog, err := h.exportCatalogRows()
+	if err != nil {
+		h.Logger.Printf("Error exporting products: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.Header("Content-Disposition", "attachment; filename=products."+format)
+	if format == "json" {
+		c.JSON(http.StatusOK, catalog)
+		return
+	}
+
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Status(http.StatusOK)
+	writer := csv.NewWriter(c.Writer)
+	writer.Write(catalogColumns)
+	for _, row := range catalog {
+		writer.Write([]string{
+			row.SKU,
+			row.Name,
+			row.Category,
+			strconv.FormatFloat(row.Price, 'f', 2, 64),
+			row.Description,
+			strconv.Itoa(*row.Stock),
+			strings.Join(row.Images, imageRefSeparator),
+		})
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		h.Logger.Printf("Error writing CSV export: %v", err)
+	}
+}
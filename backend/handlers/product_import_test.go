@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+)
+
+func TestReadCatalogFiles(t *testing.T) {
+	csvRows, err := readCSVCatalog(strings.NewReader("\ufeffSKU, Name ,category,price,images\nMUG-1, Mug ,Kitchen,12.50,a.jpg | b.jpg\n"))
+	if err != nil {
+		t.Fatalf("readCSVCatalog: %v", err)
+	}
+	jsonRows, err := readJSONCatalog(strings.NewReader(`[{"SKU": "MUG-1", "name": " Mug ", "category": "Kitchen", "price": 12.50, "images": ["a.jpg", " b.jpg", ""]}]`))
+	if err != nil {
+		t.Fatalf("readJSONCatalog: %v", err)
+	}
+
+	want := map[string]string{"sku": "MUG-1", "name": "Mug", "category": "Kitchen", "price": "12.50"}
+	for _, rows := range [][]rawCatalogRow{csvRows, jsonRows} {
+		if len(rows) != 1 {
+			t.Fatalf("read %d rows, want 1", len(rows))
+		}
+		fields := rows[0].Fields
+		delete(fields, "images")
+		// JSON numbers keep the digits they were written with
+		if !reflect.DeepEqual(fields, want) {
+			t.Errorf("fields = %v, want %v", fields, want)
+		}
+		if !reflect.DeepEqual(rows[0].Images, []string{"a.jpg", "b.jpg"}) {
+			t.Errorf("images = %q", rows[0].Images)
+		}
+	}
+	if csvRows[0].Line != 2 || jsonRows[0].Line != 1 {
+		t.Errorf("lines %d and %d, want the CSV line and the JSON index", csvRows[0].Line, jsonRows[0].Line)
+	}
+
+	if _, err := readJSONCatalog(strings.NewReader(`{"sku": "MUG-1"}`)); err == nil {
+		t.Error("readJSONCatalog accepted an object instead of an array")
+	}
+}
+
+// TestImportRowErrors imports a file with a valid row and several invalid
+// ones. Nothing is written and every problem is reported on its line.
+func TestImportRowErrors(t *testing.T) {
+	t.Setenv("IMPORT_DIR", "")
+	conn, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	skuQuery := `SELECT id FROM products WHERE sku = \?`
+	saleQuery := `SELECT MAX\(price\) FROM product_prices`
+
+	mock.ExpectQuery(`SELECT catid, name FROM categories`).
+		WillReturnRows(sqlmock.NewRows([]string{"catid", "name"}).AddRow(2, "Kitchen"))
+	// Line 2 updates MUG-1, priced below its running sale
+	mock.ExpectQuery(skuQuery).WithArgs("MUG-1").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
+	mock.ExpectQuery(saleQuery).WithArgs(3).WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(15.0))
+	// Line 4 repeats MUG-1
+	mock.ExpectQuery(skuQuery).WithArgs("MUG-1").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
+	mock.ExpectQuery(saleQuery).WithArgs(3).WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(nil))
+	// Lines 5 and 6 are new
+	mock.ExpectQuery(skuQuery).WithArgs("TEA-1").WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectQuery(skuQuery).WithArgs("CUP-1").WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+	file := strings.Join([]string{
+		"sku,name,category,price,stock,images",
+		"MUG-1,Mug,Kitchen,12,5,",
+		",,Garden,free,-1,",
+		"MUG-1,Big mug,kitchen,20,,",
+		"TEA-1,Tea,Kitchen,4,,missing.jpg",
+		"CUP-1,Cup,Kitchen,3,2,",
+	}, "\n")
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", "catalog.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write([]byte(file))
+	form.Close()
+
+	h := &ProductHandler{DB: conn, Logger: log.New(io.Discard, "", 0)}
+	router := gin.New()
+	router.POST("/products/import", h.ImportProducts)
+	req := httptest.NewRequest("POST", "/products/import", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("status %d, want 422: %s", w.Code, w.Body)
+	}
+	var report ImportReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	want := []ImportRowResult{
+		{Line: 2, SKU: "MUG-1", Errors: []string{"price must be above the sale price of 15.00"}},
+		{Line: 3, Errors: []string{
+			"sku is required",
+			"name is required",
+			`category "Garden" does not exist`,
+			"price must be a positive number",
+			"stock must be a non-negative integer",
+		}},
+		{Line: 4, SKU: "MUG-1", Errors: []string{"sku is repeated from line 2"}},
+		{Line: 5, SKU: "TEA-1", Errors: []string{"image missing.jpg was not uploaded with the import"}},
+		{Line: 6, SKU: "CUP-1", Action: "create"},
+	}
+	if report.Valid || report.Created != 0 || report.Updated != 0 {
+		t.Errorf("report valid=%v created=%d updated=%d, want an invalid import that changed nothing", report.Valid, report.Created, report.Updated)
+	}
+	if !reflect.DeepEqual(report.Rows, want) {
+		t.Errorf("rows:\n got %+v\nwant %+v", report.Rows, want)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
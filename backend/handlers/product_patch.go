@@ -0,0 +1,380 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"backend/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// FieldErrors maps request fields to what is wrong with them. Handlers that
+// validate several fields report them all at once with respondFieldErrors.
+type FieldErrors map[string]string
+
+// add records the first problem found with a field.
+func (e FieldErrors) add(field, message string) {
+	if _, ok := e[field]; !ok {
+		e[field] = message
+	}
+}
+
+func respondFieldErrors(c *gin.Context, errs FieldErrors) {
+	c.JSON(http.StatusBadRequest, gin.H{"error": "Validation failed", "fields": errs})
+}
+
+// ProductPatch is a partial product update. Nil fields are left unchanged.
+// Translations replace the given locales as a whole; an empty one removes
+// the translation.
+type ProductPatch struct {
+	Name         *string                       `json:"name"`
+	Description  *string                       `json:"description"`
+	Price        *float64                      `json:"price"`
+	CategoryID   *int                          `json:"category_id"`
+	SKU          *string                       `json:"sku"`
+	Status       *string                       `json:"status"`
+	PublishAt    *string                       `json:"publish_at"`
+	Translations map[string]models.ProductText `json:"translations"`
+	Version      *int                          `json:"version"`
+
+	publishAt *time.Time
+}
+
+func (p ProductPatch) empty() bool {
+	return p.Name == nil && p.Description == nil && p.Price == nil && p.CategoryID == nil &&
+		p.SKU == nil && p.Status == nil && len(p.Translations) == 0
+}
+
+// parseProductPatchForm reads a patch from form fields of the same names,
+// with translations as name[<locale>] and description[<locale>]. Fields that
+// cannot be parsed are reported in errs.
+func parseProductPatchForm(c *gin.Context, errs FieldErrors) ProductPatch {
+	var p ProductPatch
+	if s, ok := c.GetPostForm("name"); ok {
+		p.Name = &s
+	}
+	if s, ok := c.GetPostForm("description"); ok {
+		p.Description = &s
+	}
+	if s, ok := c.GetPostForm("price"); ok {
+		if price, err := strconv.ParseFloat(s, 64); err == nil {
+			p.Price = &price
+		} else {
+			errs.add("price", "must be a number")
+		}
+	}
+	if s, ok := c.GetPostForm("category_id"); ok {
+		if id, err := strconv.Atoi(s); err == nil {
+			p.CategoryID = &id
+		} else {
+			errs.add("category_id", "must be an integer")
+		}
+	}
+	if s, ok := c.GetPostForm("sku"); ok {
+		p.SKU = &s
+	}
+	if s, ok := c.GetPostForm("status"); ok {
+		p.Status = &s
+	}
+	if s, ok := c.GetPostForm("publish_at"); ok {
+		p.PublishAt = &s
+	}
+	if translations, err := parseProductTranslations(c); err == nil {
+		p.Translations = translations
+	} else {
+		errs.add("translations", err.Error())
+	}
+	return p
+}
+
+// validate checks the supplied fields, normalizing them as it goes, and
+// looks up what only the database knows: that the category exists and the
+// SKU is free.
+func (p *ProductPatch) validate(db sqlExecer, productID int, errs FieldErrors) error {
+	if p.Name != nil {
+		name := strings.TrimSpace(*p.Name)
+		p.Name = &name
+		if name == "" {
+			errs.add("name", "must not be empty")
+		} else if utf8.RuneCountInString(name) > 255 {
+			errs.add("name", "must be at most 255 characters")
+		}
+	}
+	if p.Price != nil && (*p.Price <= 0 || math.IsInf(*p.Price, 0) || math.IsNaN(*p.Price)) {
+		errs.add("price", "must be greater than 0")
+	}
+	if p.Status != nil {
+		publishAt := ""
+		if p.PublishAt != nil {
+			publishAt = *p.PublishAt
+		}
+		var err error
+		if p.publishAt, err = parsePublishing(*p.Status, publishAt); err != nil {
+			errs.add("status", err.Error())
+		}
+	} else if p.PublishAt != nil {
+		errs.add("publish_at", "can only be set together with status")
+	}
+	for locale := range p.Translations {
+		if _, err := translationLocale(locale); err != nil {
+			errs.add("translations", err.Error())
+		}
+	}
+
+	if p.Price != nil && errs["price"] == "" {
+		sale, ok, err := maxSalePrice(db, productID)
+		if err != nil {
+			return err
+		}
+		if ok && *p.Price <= sale {
+			errs.add("price", fmt.Sprintf("must be above the sale price of %.2f; cancel the sale first", sale))
+		}
+	}
+	if p.CategoryID != nil {
+		var exists bool
+		if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM categories WHERE catid = ?)", *p.CategoryID).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			errs.add("category_id", "category does not exist")
+		}
+	}
+	if p.SKU != nil {
+		sku := strings.TrimSpace(*p.SKU)
+		p.SKU = &sku
+		switch {
+		case sku == "":
+			errs.add("sku", "must not be empty")
+		case len(sku) > 64:
+			errs.add("sku", "must be at most 64 characters")
+		default:
+			var taken bool
+			if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM products WHERE sku = ? AND id <> ?)", sku, productID).Scan(&taken); err != nil {
+				return err
+			}
+			if taken {
+				errs.add("sku", "is already used by another product")
+			}
+		}
+	}
+	return nil
+}
+
+// PatchProduct updates only the product fields supplied, as JSON or as a
+// form. A form may also upload images, which are added to the gallery with
+// the first becoming primary. Like UpdateProduct it needs If-Match or a
+// version. Invalid fields are all reported together.
+func (h *ProductHandler) PatchProduct(c *gin.Context) {
+	productID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid product ID"})
+		return
+	}
+
+	errs := FieldErrors{}
+	var patch ProductPatch
+	if c.ContentType() == "application/json" {
+		if err := c.ShouldBindJSON(&patch); err != nil {
+			var typeErr *json.UnmarshalTypeError
+			if errors.As(err, &typeErr) && typeErr.Field != "" {
+				errs.add(typeErr.Field, "must be "+jsonTypeName(typeErr.Type))
+				respondFieldErrors(c, errs)
+				return
+			}
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+			return
+		}
+	} else {
+		patch = parseProductPatchForm(c, errs)
+	}
+	h.applyProductPatch(c, productID, patch, errs)
+}
+
+// jsonTypeName describes the JSON value a field of type t takes.
+func jsonTypeName(t reflect.Type) string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Map, reflect.Struct:
+		return "an object"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	}
+	return "of type " + t.String()
+}
+
+// applyProductPatch validates a patch and saves it in one transaction,
+// provided the product is still at the version the client read.
+func (h *ProductHandler) applyProductPatch(c *gin.Context, productID int, patch ProductPatch, errs FieldErrors) {
+	if err := patch.validate(h.DB, productID, errs); err != nil {
+		h.Logger.Printf("Error validating product update: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	files := uploadedImages(c)
+	if len(errs) == 0 && patch.empty() && len(files) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No fields to update"})
+		return
+	}
+	if len(errs) > 0 {
+		respondFieldErrors(c, errs)
+		return
+	}
+
+	pre, err := parsePrecondition(c)
+	if err != nil && errors.Is(err, errMissingPrecondition) && patch.Version != nil {
+		pre, err = precondition{version: *patch.Version}, nil
+	}
+	if err != nil {
+		respondPrecondition(c, err)
+		return
+	}
+
+	tx, err := h.DB.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	var version int
+	if err := tx.QueryRow("SELECT version FROM products WHERE id = ? FOR UPDATE", productID).Scan(&version); err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if !pre.matches(version) {
+		tx.Rollback()
+		current, err := h.currentProduct(productID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		pre.respondStale(c, current.Version, current)
+		return
+	}
+
+	if err := savePatch(tx, productID, patch); err != nil {
+		h.Logger.Printf("Error updating product %d: %v", productID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	// New images, if any, are added to the gallery as the primary image
+	if len(files) > 0 {
+		saved, err := h.saveUploadedImages(files)
+		if err != nil {
+			respondUploadError(c, h.Logger, err)
+			return
+		}
+		if err := appendProductImages(h.DB, productID, saved, true); err != nil {
+			h.Logger.Printf("Error saving product images: %v", err)
+			for _, img := range saved {
+				removeImageFiles(img.ImageURL, img.ThumbnailURL)
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+	}
+	h.syncSearch(productID)
+
+	// Return updated product with its gallery
+	product, err := h.currentProduct(productID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	product.Images, err = loadProductImages(h.DB, productID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	setETag(c, product.Version)
+	c.JSON(http.StatusOK, product)
+}
+
+// savePatch writes a validated patch and everything that follows from it:
+// the slug on a rename, the price history on a price change and dropping
+// attribute values the new category does not have on a move.
+func savePatch(tx sqlExecer, productID int, patch ProductPatch) error {
+	sets := []string{"version = version + 1"}
+	var args []interface{}
+	if patch.Name != nil {
+		sets = append(sets, "name = ?")
+		args = append(args, *patch.Name)
+	}
+	if patch.Description != nil {
+		sets = append(sets, "description = ?")
+		args = append(args, *patch.Description)
+	}
+	if patch.Price != nil {
+		sets = append(sets, "price = ?")
+		args = append(args, *patch.Price)
+	}
+	if patch.CategoryID != nil {
+		sets = append(sets, "catid = ?")
+		args = append(args, *patch.CategoryID)
+	}
+	if patch.SKU != nil {
+		sets = append(sets, "sku = ?")
+		args = append(args, *patch.SKU)
+	}
+	args = append(args, productID)
+	if _, err := tx.Exec("UPDATE products SET "+strings.Join(sets, ", ")+" WHERE id = ?", args...); err != nil {
+		return err
+	}
+
+	if patch.Name != nil {
+		if _, err := assignSlug(tx, models.SlugProduct, productID, *patch.Name); err != nil {
+			return err
+		}
+	}
+	if patch.Price != nil {
+		if err := recordBasePrice(tx, productID, *patch.Price); err != nil {
+			return err
+		}
+	}
+	if patch.CategoryID != nil {
+		tree, err := loadCategoryTree(tx)
+		if err != nil {
+			return err
+		}
+		if err := pruneAttributeValues(tx, tree, *patch.CategoryID, productID); err != nil {
+			return err
+		}
+	}
+	if patch.Status != nil {
+		if err := setProductStatus(tx, productID, *patch.Status, patch.publishAt); err != nil {
+			return err
+		}
+	}
+	return saveProductTranslations(tx, productID, patch.Translations)
+}
@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	categoryExistsQuery = `SELECT EXISTS\(SELECT 1 FROM categories WHERE catid = \?\)`
+	skuTakenQuery       = `SELECT EXISTS\(SELECT 1 FROM products WHERE sku = \? AND id <> \?\)`
+)
+
+// servePatch sends a PATCH for product 3 to a handler on a sqlmock
+// connection whose expectations expect sets up.
+func servePatch(t *testing.T, contentType, body string, expect func(mock sqlmock.Sqlmock)) *httptest.ResponseRecorder {
+	t.Helper()
+	conn, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if expect != nil {
+		expect(mock)
+	}
+
+	h := &ProductHandler{DB: conn, Logger: log.New(io.Discard, "", 0)}
+	router := gin.New()
+	router.PATCH("/products/update/:id", h.PatchProduct)
+	req := httptest.NewRequest("PATCH", "/products/update/3", strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+	return w
+}
+
+func TestPatchProductFieldErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		expect      func(mock sqlmock.Sqlmock)
+		want        map[string]string
+	}{
+		{
+			name:        "JSON type error",
+			contentType: "application/json",
+			body:        `{"price": "cheap"}`,
+			want:        map[string]string{"price": "must be a number"},
+		},
+		{
+			name:        "every invalid field at once",
+			contentType: "application/json",
+			body:        `{"name": "  ", "price": -1, "category_id": 99, "sku": "MUG-1", "status": "live"}`,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(categoryExistsQuery).WithArgs(99).
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+				mock.ExpectQuery(skuTakenQuery).WithArgs("MUG-1", 3).
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+			},
+			want: map[string]string{
+				"name":        "must not be empty",
+				"price":       "must be greater than 0",
+				"category_id": "category does not exist",
+				"sku":         "is already used by another product",
+				"status":      errInvalidPublishing.Error(),
+			},
+		},
+		{
+			name:        "publish_at without status",
+			contentType: "application/json",
+			body:        `{"publish_at": "2030-01-01T00:00:00Z", "sku": " "}`,
+			want: map[string]string{
+				"publish_at": "can only be set together with status",
+				"sku":        "must not be empty",
+			},
+		},
+		{
+			name:        "unknown translation locale",
+			contentType: "application/json",
+			body:        `{"translations": {"fr": {"name": "Tasse"}}}`,
+			want:        map[string]string{"translations": `unsupported translation locale "fr"`},
+		},
+		{
+			name:        "form fields",
+			contentType: "application/x-www-form-urlencoded",
+			body:        url.Values{"price": {"cheap"}, "category_id": {"two"}, "name": {strings.Repeat("x", 256)}}.Encode(),
+			want: map[string]string{
+				"price":       "must be a number",
+				"category_id": "must be an integer",
+				"name":        "must be at most 255 characters",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := servePatch(t, tt.contentType, tt.body, tt.expect)
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("status %d, want 400: %s", w.Code, w.Body)
+			}
+			var resp struct {
+				Error  string            `json:"error"`
+				Fields map[string]string `json:"fields"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Error != "Validation failed" || !reflect.DeepEqual(resp.Fields, tt.want) {
+				t.Errorf("response %+v, want the field errors %v", resp, tt.want)
+			}
+		})
+	}
+}
+
+func TestPatchProductRequests(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    int
+		wantErr string
+	}{
+		{name: "nothing to update", body: `{}`, want: http.StatusBadRequest, wantErr: "No fields to update"},
+		{name: "version alone", body: `{"version": 2}`, want: http.StatusBadRequest, wantErr: "No fields to update"},
+		{name: "malformed JSON", body: `{"name": `, want: http.StatusBadRequest, wantErr: "Invalid request format"},
+		{name: "no precondition", body: `{"name": "Mug"}`, want: http.StatusPreconditionRequired, wantErr: errMissingPrecondition.Error()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := servePatch(t, "application/json", tt.body, nil)
+			if w.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if want := `{"error":"` + tt.wantErr + `"}`; w.Body.String() != want {
+				t.Errorf("body %s, want %s", w.Body, want)
+			}
+		})
+	}
+}
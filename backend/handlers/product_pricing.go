@@ -0,0 +1,314 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"backend/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// activeSale selects the sale running on a product right now, for use in
+// subqueries on the products table. CreateSale keeps sales from overlapping;
+// should two match anyway, the one started last wins, as in priceCart, so
+// listings and checkout agree on the price. Times are stored in UTC.
+const activeSale = `FROM product_prices pp WHERE pp.product_id = products.id AND pp.kind = 'sale'
+	AND pp.cancelled_at IS NULL AND pp.starts_at <= UTC_TIMESTAMP() AND pp.ends_at > UTC_TIMESTAMP()
+	ORDER BY pp.starts_at DESC, pp.id DESC LIMIT 1`
+
+// currentPriceExpr is the price a product sells for right now. Listing
+// filters and sorts use it so sale items show up where customers expect.
+const currentPriceExpr = "COALESCE((SELECT pp.price " + activeSale + "), products.price)"
+
+type SaleRequest struct {
+	Price    float64   `json:"price" form:"price" binding:"required,gt=0"`
+	StartsAt time.Time `json:"starts_at" form:"starts_at" time_format:"2006-01-02T15:04:05Z07:00"` // defaults to now
+	EndsAt   time.Time `json:"ends_at" form:"ends_at" time_format:"2006-01-02T15:04:05Z07:00" binding:"required"`
+}
+
+// recordBasePrice adds a base entry to a product's price history when its
+// regular price differs from the last one recorded.
+func recordBasePrice(tx sqlExecer, productID int, price float64) error {
+	var last float64
+	err := tx.QueryRow(`SELECT price FROM product_prices WHERE product_id = ? AND kind = 'base'
+		ORDER BY starts_at DESC, id DESC LIMIT 1`, productID).Scan(&last)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if err == nil && fmt.Sprintf("%.2f", last) == fmt.Sprintf("%.2f", price) {
+		return nil
+	}
+	now := time.Now().UTC()
+	_, err = tx.Exec(`INSERT INTO product_prices (product_id, kind, price, starts_at, created_at)
+		VALUES (?, 'base', ?, ?, ?)`, productID, price, now, now)
+	return err
+}
+
+// maxSalePrice returns the highest price among a product's running and
+// upcoming sales, and false when it has none. CreateSale only accepts sale
+// prices below the regular price; a new regular price must stay above this
+// one so that no sale turns into a markup.
+func maxSalePrice(db sqlExecer, productID int) (float64, bool, error) {
+	var price sql.NullFloat64
+	err := db.QueryRow(`SELECT MAX(price) FROM product_prices WHERE product_id = ? AND kind = 'sale'
+		AND cancelled_at IS NULL AND ends_at > UTC_TIMESTAMP()`, productID).Scan(&price)
+	return price.Float64, price.Valid, err
+}
+
+// applySalePrice fills in the was/now prices of a scanned product.
+func applySalePrice(p *models.Product, salePrice *float64, saleEndsAt *time.Time) {
+	p.CurrentPrice = p.Price
+	p.WasPrice = nil
+	p.SaleEndsAt = nil
+	if salePrice != nil {
+		was := p.Price
+		p.CurrentPrice = *salePrice
+		p.WasPrice = &was
+		p.SaleEndsAt = saleEndsAt
+	}
+}
+
+// refreshPrices updates the was/now prices of products held in memory, such
+// as search index entries, which go stale as sales start and end.
+func refreshPrices(db sqlExecer, products []models.Product) error {
+	if len(products) == 0 {
+		return nil
+	}
+	byID := make(map[int]*models.Product, len(products))
+	args := make([]interface{}, 0, len(products))
+	for i := range products {
+		byID[products[i].ID] = &products[i]
+		args = append(args, products[i].ID)
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(args)), ",")
+	rows, err := db.Query(`SELECT id, price, (SELECT pp.price `+activeSale+`), (SELECT pp.ends_at `+activeSale+`)
+		FROM products WHERE id IN (`+placeholders+`)`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var price float64
+		var salePrice *float64
+		var saleEndsAt *time.Time
+		if err := rows.Scan(&id, &price, &salePrice, &saleEndsAt); err != nil {
+			return err
+		}
+		p := byID[id]
+		p.Price = price
+		applySalePrice(p, salePrice, saleEndsAt)
+	}
+	return rows.Err()
+}
+
+// priceCart replaces the prices sent by the client with the prices in effect
+// at the given time: the variant price where a variant sets one, otherwise
+// the product's sale or regular price.
+func priceCart(db *gorm.DB, items []CartItem, at time.Time) error {
+	at = at.UTC()
+	for i := range items {
+		if items[i].VariantID != nil {
+			var variant models.ProductVariant
+			if err := db.Select("price").First(&variant, *items[i].VariantID).Error; err != nil {
+				return err
+			}
+			if variant.Price != nil {
+				items[i].Price = *variant.Price
+				continue
+			}
+		}
+
+		var price sql.NullFloat64
+		err := db.Raw(`SELECT COALESCE(
+				(SELECT price FROM product_prices WHERE product_id = ? AND kind = 'sale' AND cancelled_at IS NULL
+					AND starts_at <= ? AND ends_at > ? ORDER BY starts_at DESC, id DESC LIMIT 1),
+				(SELECT price FROM products WHERE id = ?))`,
+			items[i].ID, at, at, items[i].ID).Row().Scan(&price)
+		if err != nil {
+			return err
+		}
+		if !price.Valid {
+			return fmt.Errorf("%w: product %d", errUnavailableProduct, items[i].ID)
+		}
+		items[i].Price = price.Float64
+	}
+	return nil
+}
+
+// CreateSale schedules a sale price for a product between starts_at
+// (default now) and ends_at, both RFC 3339. Sales on the same product may
+// not overlap.
+func (h *ProductHandler) CreateSale(c *gin.Context) {
+	productID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid product ID"})
+		return
+	}
+
+	var req SaleRequest
+	if err := c.ShouldBind(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "price and ends_at are required; times use RFC 3339"})
+		return
+	}
+	now := time.Now().UTC()
+	if req.StartsAt.IsZero() {
+		req.StartsAt = now
+	}
+	req.StartsAt, req.EndsAt = req.StartsAt.UTC(), req.EndsAt.UTC()
+	if !req.EndsAt.After(req.StartsAt) || !req.EndsAt.After(now) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ends_at must be after starts_at and in the future"})
+		return
+	}
+
+	tx, err := h.DB.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	// Lock the product so two overlapping sales cannot be added at once
+	var price float64
+	if err := tx.QueryRow("SELECT price FROM products WHERE id = ? FOR UPDATE", productID).Scan(&price); err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if req.Price >= price {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Sale price must be lower than the regular price"})
+		return
+	}
+
+	var overlapping int
+	err = tx.QueryRow(`SELECT COUNT(*) FROM product_prices WHERE product_id = ? AND kind = 'sale'
+		AND cancelled_at IS NULL AND starts_at < ? AND ends_at > ?`, productID, req.EndsAt, req.StartsAt).Scan(&overlapping)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if overlapping > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "The product already has a sale in that period"})
+		return
+	}
+
+	sale := models.ProductPrice{
+		ProductID: uint(productID),
+		Kind:      models.PriceSale,
+		Price:     req.Price,
+		StartsAt:  req.StartsAt,
+		EndsAt:    &req.EndsAt,
+		CreatedAt: now,
+	}
+	result, err := tx.Exec(`INSERT INTO product_prices (product_id, kind, price, starts_at, ends_at, created_at)
+		VALUES (?, 'sale', ?, ?, ?, ?)`, productID, sale.Price, sale.StartsAt, sale.EndsAt, sale.CreatedAt)
+	if err != nil {
+		h.Logger.Printf("Error creating sale: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	sale.ID = uint(id)
+
+	c.JSON(http.StatusOK, sale)
+}
+
+// CancelSale stops a scheduled or running sale. The entry stays in the
+// price history with its cancellation time.
+func (h *ProductHandler) CancelSale(c *gin.Context) {
+	saleID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid sale ID"})
+		return
+	}
+
+	now := time.Now().UTC()
+	result, err := h.DB.Exec(`UPDATE product_prices SET cancelled_at = ?
+		WHERE id = ? AND kind = 'sale' AND cancelled_at IS NULL AND ends_at > ?`, now, saleID, now)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if rowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No active or upcoming sale with that ID"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// PriceHistory returns every base price change and sale of a product,
+// oldest first, along with the price in effect now.
+func (h *ProductHandler) PriceHistory(c *gin.Context) {
+	productID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid product ID"})
+		return
+	}
+
+	row := h.DB.QueryRow("SELECT "+productColumns+" FROM products WHERE id = ?", productID)
+	product, err := scanProduct(row)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	rows, err := h.DB.Query(`SELECT id, product_id, kind, price, starts_at, ends_at, cancelled_at, created_at
+		FROM product_prices WHERE product_id = ? ORDER BY starts_at, id`, productID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	history := []models.ProductPrice{}
+	for rows.Next() {
+		var entry models.ProductPrice
+		err := rows.Scan(&entry.ID, &entry.ProductID, &entry.Kind, &entry.Price, &entry.StartsAt, &entry.EndsAt, &entry.CancelledAt, &entry.CreatedAt)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		history = append(history, entry)
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"product_id":    productID,
+		"price":         product.Price,
+		"current_price": product.CurrentPrice,
+		"was_price":     product.WasPrice,
+		"sale_ends_at":  product.SaleEndsAt,
+		"history":       history,
+	})
+}
@@ -0,0 +1,196 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"backend/models"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+)
+
+const cartPriceQuery = `SELECT COALESCE\(\s+\(SELECT price FROM product_prices WHERE product_id = \? AND kind = 'sale' AND cancelled_at IS NULL\s+AND starts_at <= \? AND ends_at > \? ORDER BY starts_at DESC, id DESC LIMIT 1\)`
+
+func TestPriceCart(t *testing.T) {
+	db, mock := newMockDB(t)
+	priced, unpriced := uint(31), uint(32)
+	items := []CartItem{
+		{ID: 5, VariantID: &priced, Price: 0.01, Quantity: 1},
+		{ID: 6, VariantID: &unpriced, Price: 0.01, Quantity: 1},
+		{ID: 7, Price: 0.01, Quantity: 2},
+	}
+	at := time.Date(2026, 3, 1, 12, 0, 0, 0, time.FixedZone("HKT", 8*3600))
+
+	// A variant's own price wins over any sale on the product
+	mock.ExpectQuery("SELECT `price` FROM `product_variants`").WithArgs(31, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"price"}).AddRow(12.5))
+	// Without one, the variant sells at the product's current price
+	mock.ExpectQuery("SELECT `price` FROM `product_variants`").WithArgs(32, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"price"}).AddRow(nil))
+	mock.ExpectQuery(cartPriceQuery).WithArgs(6, at.UTC(), at.UTC(), 6).
+		WillReturnRows(sqlmock.NewRows([]string{"price"}).AddRow(8.0))
+	mock.ExpectQuery(cartPriceQuery).WithArgs(7, at.UTC(), at.UTC(), 7).
+		WillReturnRows(sqlmock.NewRows([]string{"price"}).AddRow(20.0))
+
+	if err := priceCart(db, items, at); err != nil {
+		t.Fatalf("priceCart: %v", err)
+	}
+	for i, want := range []float64{12.5, 8, 20} {
+		if items[i].Price != want {
+			t.Errorf("item %d priced at %v, want %v", i, items[i].Price, want)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPriceCartMissingProduct(t *testing.T) {
+	db, mock := newMockDB(t)
+	mock.ExpectQuery(cartPriceQuery).
+		WillReturnRows(sqlmock.NewRows([]string{"price"}).AddRow(nil))
+
+	err := priceCart(db, []CartItem{{ID: 9, Quantity: 1}}, time.Now())
+	if !errors.Is(err, errUnavailableProduct) {
+		t.Errorf("priceCart error = %v, want errUnavailableProduct", err)
+	}
+}
+
+// TestSaleOrdering checks that listings pick the same sale as checkout,
+// whose ordering cartPriceQuery pins down, should two ever overlap.
+func TestSaleOrdering(t *testing.T) {
+	const order = "ORDER BY pp.starts_at DESC, pp.id DESC LIMIT 1"
+	if !strings.HasSuffix(activeSale, order) {
+		t.Errorf("activeSale does not end in %q", order)
+	}
+}
+
+func TestApplySalePrice(t *testing.T) {
+	ends := time.Now().Add(time.Hour)
+	p := models.Product{Price: 50}
+	applySalePrice(&p, floatPtr(40), &ends)
+	if p.CurrentPrice != 40 || p.WasPrice == nil || *p.WasPrice != 50 || p.SaleEndsAt != &ends {
+		t.Errorf("on sale: current %v, was %v, ends %v", p.CurrentPrice, p.WasPrice, p.SaleEndsAt)
+	}
+	applySalePrice(&p, nil, nil)
+	if p.CurrentPrice != 50 || p.WasPrice != nil || p.SaleEndsAt != nil {
+		t.Errorf("after the sale: current %v, was %v, ends %v", p.CurrentPrice, p.WasPrice, p.SaleEndsAt)
+	}
+}
+
+func TestCreateSale(t *testing.T) {
+	ends := time.Now().Add(24 * time.Hour).UTC().Format(time.RFC3339)
+	tests := []struct {
+		name    string
+		price   string
+		expect  func(mock sqlmock.Sqlmock)
+		want    int
+		wantErr string
+	}{
+		{
+			name:  "created",
+			price: "40",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT COUNT\(\*\) FROM product_prices`).WithArgs(3, sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+				mock.ExpectExec(`INSERT INTO product_prices`).WithArgs(3, 40.0, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(11, 1))
+				mock.ExpectCommit()
+			},
+			want: http.StatusOK,
+		},
+		{
+			name:    "not a reduction",
+			price:   "50",
+			expect:  func(mock sqlmock.Sqlmock) { mock.ExpectRollback() },
+			want:    http.StatusBadRequest,
+			wantErr: "Sale price must be lower than the regular price",
+		},
+		{
+			name:  "overlapping",
+			price: "40",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT COUNT\(\*\) FROM product_prices`).
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+				mock.ExpectRollback()
+			},
+			want:    http.StatusConflict,
+			wantErr: "The product already has a sale in that period",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			mock.ExpectBegin()
+			mock.ExpectQuery(`SELECT price FROM products WHERE id = \? FOR UPDATE`).WithArgs(3).
+				WillReturnRows(sqlmock.NewRows([]string{"price"}).AddRow(50.0))
+			tt.expect(mock)
+
+			h := &ProductHandler{DB: conn, Logger: log.New(io.Discard, "", 0)}
+			router := gin.New()
+			router.POST("/products/:id/sales", h.CreateSale)
+			form := url.Values{"price": {tt.price}, "ends_at": {ends}}
+			req := httptest.NewRequest("POST", "/products/3/sales", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if tt.wantErr != "" && !strings.Contains(w.Body.String(), tt.wantErr) {
+				t.Errorf("body %s, want %q", w.Body, tt.wantErr)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestPatchPriceAboveSale(t *testing.T) {
+	const saleQuery = `SELECT MAX\(price\) FROM product_prices WHERE product_id = \? AND kind = 'sale'`
+	tests := []struct {
+		price   float64
+		sale    interface{}
+		wantErr string
+	}{
+		{price: 45, sale: 40.0},
+		{price: 40, sale: 40.0, wantErr: "must be above the sale price of 40.00; cancel the sale first"},
+		{price: 30, sale: 40.0, wantErr: "must be above the sale price of 40.00; cancel the sale first"},
+		{price: 30, sale: nil},
+	}
+	for _, tt := range tests {
+		conn, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+		mock.ExpectQuery(saleQuery).WithArgs(3).
+			WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(tt.sale))
+
+		errs := FieldErrors{}
+		patch := ProductPatch{Price: floatPtr(tt.price)}
+		if err := patch.validate(conn, 3, errs); err != nil {
+			t.Fatalf("validate: %v", err)
+		}
+		if errs["price"] != tt.wantErr {
+			t.Errorf("price %v with a sale at %v: error %q, want %q", tt.price, tt.sale, errs["price"], tt.wantErr)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+		conn.Close()
+	}
+}
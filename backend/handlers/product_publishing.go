@@ -0,0 +1,235 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"backend/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// publishedCond matches products customers may see. Scheduled products count
+// from their publish time on, even before the scheduler has flipped them.
+const publishedCond = "(status = 'published' OR (status = 'scheduled' AND publish_at <= UTC_TIMESTAMP()))"
+
+var errInvalidPublishing = errors.New("status must be draft, scheduled or published; scheduled products need a future publish_at in RFC 3339")
+
+// isPublished is publishedCond for a product already loaded.
+func isPublished(p models.Product) bool {
+	switch p.Status {
+	case models.ProductPublished:
+		return true
+	case models.ProductScheduled:
+		return p.PublishAt != nil && !p.PublishAt.After(time.Now())
+	}
+	return false
+}
+
+// parsePublishing validates the status and publish_at form fields. Only
+// scheduled products take a publish time; publishing now records the current
+// time and drafts have none.
+func parsePublishing(status, publishAt string) (*time.Time, error) {
+	now := time.Now().UTC()
+	switch status {
+	case models.ProductDraft:
+		return nil, nil
+	case models.ProductPublished:
+		return &now, nil
+	case models.ProductScheduled:
+		t, err := time.Parse(time.RFC3339, publishAt)
+		if err != nil || !t.After(now) {
+			return nil, errInvalidPublishing
+		}
+		t = t.UTC()
+		return &t, nil
+	}
+	return nil, errInvalidPublishing
+}
+
+// setProductStatus changes a product's status. Republishing a product that
+// is already live keeps its original publish time.
+func setProductStatus(db sqlExecer, productID int, status string, publishAt *time.Time) error {
+	_, err := db.Exec(`UPDATE products SET
+		publish_at = IF(? = 'published' AND status = 'published' AND publish_at IS NOT NULL, publish_at, ?),
+		status = ? WHERE id = ?`, status, publishAt, status, productID)
+	return err
+}
+
+// UpdateProductStatus moves a product between draft, scheduled and
+// published. The form takes status and, for scheduled, publish_at. Like
+// UpdateProduct it needs If-Match or a version field.
+func (h *ProductHandler) UpdateProductStatus(c *gin.Context) {
+	productID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid product ID"})
+		return
+	}
+	status := c.PostForm("status")
+	publishAt, err := parsePublishing(status, c.PostForm("publish_at"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	pre, err := parsePrecondition(c)
+	if err != nil {
+		respondPrecondition(c, err)
+		return
+	}
+
+	tx, err := h.DB.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	var version int
+	if err := tx.QueryRow("SELECT version FROM products WHERE id = ? FOR UPDATE", productID).Scan(&version); err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if !pre.matches(version) {
+		tx.Rollback()
+		current, err := h.currentProduct(productID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		pre.respondStale(c, current.Version, current)
+		return
+	}
+	err = setProductStatus(tx, productID, status, publishAt)
+	if err == nil {
+		_, err = tx.Exec("UPDATE products SET version = version + 1 WHERE id = ?", productID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		h.Logger.Printf("Error updating product status: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	h.syncSearch(productID)
+
+	product, err := h.currentProduct(productID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	setETag(c, product.Version)
+	c.JSON(http.StatusOK, product)
+}
+
+// PreviewProduct is GetProduct for admins: it also returns drafts and
+// products scheduled for later.
+func (h *ProductHandler) PreviewProduct(c *gin.Context) {
+	h.getProduct(c, true)
+}
+
+// ListUnpublishedProducts pages through drafts and scheduled products. It
+// accepts the same parameters as ListProducts, plus status=draft|scheduled
+// to narrow the list.
+func (h *ProductHandler) ListUnpublishedProducts(c *gin.Context) {
+	h.listByStatus(c, models.ProductDraft, models.ProductScheduled)
+}
+
+// ListAllProducts pages through every product that is not archived, whatever
+// its status, for the admin product list. It accepts the same parameters as
+// ListProducts, plus status=published|draft|scheduled to narrow the list.
+// Scheduled products whose time has come are listed as published by the
+// public routes but keep their stored status here until publishDue runs.
+func (h *ProductHandler) ListAllProducts(c *gin.Context) {
+	h.listByStatus(c, models.ProductPublished, models.ProductDraft, models.ProductScheduled)
+}
+
+// listByStatus pages through products in the given statuses, or in the one
+// the status parameter picks among them.
+func (h *ProductHandler) listByStatus(c *gin.Context, statuses ...string) {
+	q, err := parseProductQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	q.Filter.Statuses = statuses
+	if status := c.Query("status"); status != "" {
+		if !slices.Contains(statuses, status) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid status"})
+			return
+		}
+		q.Filter.Statuses = []string{status}
+	}
+	if !h.resolveFilter(c, &q.Filter) {
+		return
+	}
+
+	page, err := queryProducts(h.DB, q)
+	if err != nil {
+		h.Logger.Printf("Error listing products by status: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	c.JSON(http.StatusOK, page)
+}
+
+// publishDue marks scheduled products whose publish time has passed as
+// published and adds them to the search index.
+func (h *ProductHandler) publishDue() error {
+	rows, err := h.DB.Query("SELECT id FROM products WHERE status = 'scheduled' AND publish_at <= UTC_TIMESTAMP()")
+	if err != nil {
+		return err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		result, err := h.DB.Exec("UPDATE products SET status = 'published', version = version + 1 WHERE id = ? AND status = 'scheduled' AND publish_at <= UTC_TIMESTAMP()", id)
+		if err != nil {
+			return err
+		}
+		if n, err := result.RowsAffected(); err == nil && n > 0 {
+			h.syncSearch(id)
+			h.Logger.Printf("Published scheduled product %d", id)
+		}
+	}
+	return nil
+}
+
+// RunPublishScheduler periodically publishes scheduled products that are due
+// until ctx is cancelled.
+func (h *ProductHandler) RunPublishScheduler(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := h.publishDue(); err != nil {
+				h.Logger.Printf("Error publishing scheduled products: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"database/sql/driver"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+)
+
+func TestListAllProducts(t *testing.T) {
+	tests := []struct {
+		query    string
+		want     int
+		statuses []driver.Value // expected in the count query
+	}{
+		{query: "", want: http.StatusOK, statuses: []driver.Value{"published", "draft", "scheduled"}},
+		{query: "status=draft", want: http.StatusOK, statuses: []driver.Value{"draft"}},
+		{query: "status=archived", want: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		conn, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.statuses != nil {
+			mock.ExpectQuery(`SELECT COUNT\(\*\) FROM products WHERE archived_at IS NULL AND status IN \(\?`).
+				WithArgs(tt.statuses...).
+				WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+			mock.ExpectQuery(`SELECT .* FROM products WHERE`).
+				WillReturnRows(sqlmock.NewRows([]string{"id"}))
+		}
+
+		h := &ProductHandler{DB: conn, Logger: log.New(io.Discard, "", 0)}
+		router := gin.New()
+		router.GET("/admin/products/all", h.ListAllProducts)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/admin/products/all?"+tt.query, nil))
+
+		if w.Code != tt.want {
+			t.Errorf("%q: status %d, want %d: %s", tt.query, w.Code, tt.want, w.Body)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("%q: %v", tt.query, err)
+		}
+		conn.Close()
+	}
+}
@@ -0,0 +1,375 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"backend/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+	maxFilterIDs    = 100
+
+	// productColumns is the column list every product query selects, in the
+	// order scanProduct expects them.
+	productColumns = "id, catid, name, price, description, image_url, thumbnail_url, " + productStockExpr + ", COALESCE(sku, ''), COALESCE(slug, ''), status, publish_at, version, archived_at, rating_average, review_count, UNIX_TIMESTAMP(updated_at), " +
+		"(SELECT pp.price " + activeSale + "), (SELECT pp.ends_at " + activeSale + ")"
+)
+
+// productSort maps a public sort name onto the column used for keyset
+// pagination. The product id is always the tie-breaker.
+type productSort struct {
+	column string
+	desc   bool
+}
+
+var productSorts = map[string]productSort{
+	"newest":     {column: "id", desc: true},
+	"price_asc":  {column: currentPriceExpr},
+	"price_desc": {column: currentPriceExpr, desc: true},
+	"name_asc":   {column: "name"},
+	"name_desc":  {column: "name", desc: true},
+}
+
+// ProductFilter holds the optional constraints accepted by the product
+// listing endpoints.
+type ProductFilter struct {
+	CategoryID *int
+	// Descendants widens CategoryID to its whole subtree; ListProducts
+	// resolves the subtree into CategoryIDs.
+	Descendants bool
+	CategoryIDs []int
+	MinPrice    *float64
+	MaxPrice    *float64
+	IDs         []int
+	Archived    bool // List archived products instead of live ones
+	// Statuses lists the product statuses to include. When empty only
+	// products visible to customers are.
+	Statuses   []string
+	Attributes []AttributeFilter
+}
+
+// productQuery is a fully parsed listing request.
+type productQuery struct {
+	Filter ProductFilter
+	Sort   string
+	Limit  int
+	Cursor *productCursor
+	Facets bool // Also count products per attribute value
+}
+
+// productCursor marks the last row of a page. It is handed to clients as an
+// opaque base64 string and is only valid for the sort it was issued for.
+type productCursor struct {
+	Sort  string      `json:"s"`
+	Value interface{} `json:"v,omitempty"`
+	ID    int         `json:"id"`
+}
+
+// ProductPage is the response body of the product listing endpoints.
+type ProductPage struct {
+	Products   []models.Product `json:"products"`
+	NextCursor string           `json:"next_cursor,omitempty"`
+	Total      int              `json:"total"`
+	Limit      int              `json:"limit"`
+	Facets     []AttributeFacet `json:"facets,omitempty"`
+}
+
+func encodeCursor(cur productCursor) string {
+	data, _ := json.Marshal(cur)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string) (*productCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.New("Invalid cursor")
+	}
+	var cur productCursor
+	if err := json.Unmarshal(data, &cur); err != nil {
+		return nil, errors.New("Invalid cursor")
+	}
+	return &cur, nil
+}
+
+// parseProductQuery reads pagination, sort and filter parameters from the
+// query string.
+func parseProductQuery(c *gin.Context) (productQuery, error) {
+	q := productQuery{Sort: "newest", Limit: defaultPageSize}
+
+	if s := c.Query("sort"); s != "" {
+		if _, ok := productSorts[s]; !ok {
+			return q, fmt.Errorf("Invalid sort: %s", s)
+		}
+		q.Sort = s
+	}
+
+	if s := c.Query("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit < 1 {
+			return q, errors.New("Invalid limit")
+		}
+		if limit > maxPageSize {
+			limit = maxPageSize
+		}
+		q.Limit = limit
+	}
+
+	if s := c.Query("category_id"); s != "" {
+		categoryID, err := strconv.Atoi(s)
+		if err != nil {
+			return q, errors.New("Invalid category ID")
+		}
+		q.Filter.CategoryID = &categoryID
+	}
+
+	if s := c.Query("include_descendants"); s != "" {
+		descendants, err := strconv.ParseBool(s)
+		if err != nil {
+			return q, errors.New("Invalid include_descendants")
+		}
+		q.Filter.Descendants = descendants
+	}
+
+	if s := c.Query("min_price"); s != "" {
+		minPrice, err := strconv.ParseFloat(s, 64)
+		if err != nil || minPrice < 0 {
+			return q, errors.New("Invalid min_price")
+		}
+		q.Filter.MinPrice = &minPrice
+	}
+
+	if s := c.Query("max_price"); s != "" {
+		maxPrice, err := strconv.ParseFloat(s, 64)
+		if err != nil || maxPrice < 0 {
+			return q, errors.New("Invalid max_price")
+		}
+		q.Filter.MaxPrice = &maxPrice
+	}
+
+	if q.Filter.MinPrice != nil && q.Filter.MaxPrice != nil && *q.Filter.MinPrice > *q.Filter.MaxPrice {
+		return q, errors.New("min_price cannot be greater than max_price")
+	}
+
+	if s := c.Query("ids"); s != "" {
+		for _, part := range strings.Split(s, ",") {
+			id, err := strconv.Atoi(strings.TrimSpace(part))
+			if err != nil {
+				return q, errors.New("Invalid ids")
+			}
+			q.Filter.IDs = append(q.Filter.IDs, id)
+		}
+		if len(q.Filter.IDs) > maxFilterIDs {
+			return q, fmt.Errorf("At most %d ids are allowed", maxFilterIDs)
+		}
+	}
+
+	attributes, err := parseAttributeFilters(c)
+	if err != nil {
+		return q, err
+	}
+	q.Filter.Attributes = attributes
+
+	if s := c.Query("facets"); s != "" {
+		facets, err := strconv.ParseBool(s)
+		if err != nil {
+			return q, errors.New("Invalid facets")
+		}
+		q.Facets = facets
+	}
+
+	if s := c.Query("cursor"); s != "" {
+		cur, err := decodeCursor(s)
+		if err != nil {
+			return q, err
+		}
+		if cur.Sort != q.Sort {
+			return q, errors.New("Cursor does not match sort order")
+		}
+		if _, _, err := cur.keyset(productSorts[q.Sort]); err != nil {
+			return q, err
+		}
+		q.Cursor = cur
+	}
+
+	return q, nil
+}
+
+// where builds the WHERE clause shared by the page and count queries. The
+// cursor condition is left out so the count covers every matching row.
+// Archived products are excluded unless Archived is set, and unpublished ones
+// unless Statuses asks for them.
+func (f ProductFilter) where() (string, []interface{}) {
+	return f.whereExcept(0)
+}
+
+// whereExcept is where without the filter on one attribute, which facet
+// counts for that attribute need.
+func (f ProductFilter) whereExcept(skipAttribute uint) (string, []interface{}) {
+	conds := []string{"archived_at IS NULL"}
+	var args []interface{}
+	if f.Archived {
+		conds[0] = "archived_at IS NOT NULL"
+	}
+	if len(f.Statuses) == 0 {
+		conds = append(conds, publishedCond)
+	} else {
+		placeholders := strings.TrimSuffix(strings.Repeat("?,", len(f.Statuses)), ",")
+		conds = append(conds, "status IN ("+placeholders+")")
+		for _, s := range f.Statuses {
+			args = append(args, s)
+		}
+	}
+
+	if len(f.CategoryIDs) > 0 {
+		placeholders := strings.TrimSuffix(strings.Repeat("?,", len(f.CategoryIDs)), ",")
+		conds = append(conds, "catid IN ("+placeholders+")")
+		for _, id := range f.CategoryIDs {
+			args = append(args, id)
+		}
+	} else if f.CategoryID != nil {
+		conds = append(conds, "catid = ?")
+		args = append(args, *f.CategoryID)
+	}
+	if f.MinPrice != nil {
+		conds = append(conds, currentPriceExpr+" >= ?")
+		args = append(args, *f.MinPrice)
+	}
+	if f.MaxPrice != nil {
+		conds = append(conds, currentPriceExpr+" <= ?")
+		args = append(args, *f.MaxPrice)
+	}
+	if len(f.IDs) > 0 {
+		placeholders := strings.TrimSuffix(strings.Repeat("?,", len(f.IDs)), ",")
+		conds = append(conds, "id IN ("+placeholders+")")
+		for _, id := range f.IDs {
+			args = append(args, id)
+		}
+	}
+	for _, af := range f.Attributes {
+		if af.AttributeID == skipAttribute {
+			continue
+		}
+		cond, condArgs := af.condition()
+		conds = append(conds, cond)
+		args = append(args, condArgs...)
+	}
+
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+// keyset returns the condition that selects rows after the cursor.
+func (cur *productCursor) keyset(sort productSort) (string, []interface{}, error) {
+	op := ">"
+	if sort.desc {
+		op = "<"
+	}
+	if sort.column == "id" {
+		return "id " + op + " ?", []interface{}{cur.ID}, nil
+	}
+
+	var value interface{}
+	switch v := cur.Value.(type) {
+	case float64:
+		if sort.column != currentPriceExpr {
+			return "", nil, errors.New("Invalid cursor")
+		}
+		value = v
+	case string:
+		if sort.column != "name" {
+			return "", nil, errors.New("Invalid cursor")
+		}
+		value = v
+	default:
+		return "", nil, errors.New("Invalid cursor")
+	}
+
+	cond := fmt.Sprintf("(%[1]s %[2]s ? OR (%[1]s = ? AND id %[2]s ?))", sort.column, op)
+	return cond, []interface{}{value, value, cur.ID}, nil
+}
+
+func scanProduct(rows interface{ Scan(...interface{}) error }) (models.Product, error) {
+	var p models.Product
+	var salePrice *float64
+	var saleEndsAt *time.Time
+	var updated int64
+	err := rows.Scan(&p.ID, &p.CategoryID, &p.Name, &p.Price, &p.Description, &p.ImageURL, &p.ThumbnailURL, &p.Stock, &p.SKU, &p.Slug, &p.Status, &p.PublishAt, &p.Version, &p.ArchivedAt, &p.RatingAverage, &p.ReviewCount,
+		&updated, &salePrice, &saleEndsAt)
+	p.UpdatedAt = time.Unix(updated, 0).UTC()
+	applySalePrice(&p, salePrice, saleEndsAt)
+	return p, err
+}
+
+// queryProducts runs a listing query and returns one page of results along
+// with the total number of matching products.
+func queryProducts(db *sql.DB, q productQuery) (ProductPage, error) {
+	page := ProductPage{Products: []models.Product{}, Limit: q.Limit}
+	sort := productSorts[q.Sort]
+
+	where, args := q.Filter.where()
+	if err := db.QueryRow("SELECT COUNT(*) FROM products"+where, args...).Scan(&page.Total); err != nil {
+		return page, err
+	}
+
+	if q.Cursor != nil {
+		cond, cursorArgs, err := q.Cursor.keyset(sort)
+		if err != nil {
+			return page, err
+		}
+		where += " AND " + cond
+		args = append(args, cursorArgs...)
+	}
+
+	dir := "ASC"
+	if sort.desc {
+		dir = "DESC"
+	}
+	order := fmt.Sprintf(" ORDER BY %s %s", sort.column, dir)
+	if sort.column != "id" {
+		order += ", id " + dir
+	}
+
+	// Fetch one extra row to find out whether another page exists.
+	query := "SELECT " + productColumns + " FROM products" + where + order + " LIMIT ?"
+	rows, err := db.Query(query, append(args, q.Limit+1)...)
+	if err != nil {
+		return page, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		p, err := scanProduct(rows)
+		if err != nil {
+			return page, err
+		}
+		page.Products = append(page.Products, p)
+	}
+	if err := rows.Err(); err != nil {
+		return page, err
+	}
+
+	if len(page.Products) > q.Limit {
+		page.Products = page.Products[:q.Limit]
+		last := page.Products[len(page.Products)-1]
+		cur := productCursor{Sort: q.Sort, ID: last.ID}
+		switch sort.column {
+		case currentPriceExpr:
+			cur.Value = last.CurrentPrice
+		case "name":
+			cur.Value = last.Name
+		}
+		page.NextCursor = encodeCursor(cur)
+	}
+
+	return page, nil
+}
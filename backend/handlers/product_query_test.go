@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// testContext returns a context for a GET request with the given query.
+func testContext(query string) *gin.Context {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/products?"+query, nil)
+	return c
+}
+
+func TestCursorRoundTrip(t *testing.T) {
+	cursors := []productCursor{
+		{Sort: "newest", ID: 42},
+		{Sort: "price_asc", Value: 19.99, ID: 7},
+		{Sort: "name_desc", Value: "Blue widget", ID: 3},
+	}
+	for _, cur := range cursors {
+		got, err := decodeCursor(encodeCursor(cur))
+		if err != nil {
+			t.Fatalf("decodeCursor(encodeCursor(%+v)): %v", cur, err)
+		}
+		if !reflect.DeepEqual(*got, cur) {
+			t.Errorf("round trip of %+v gave %+v", cur, *got)
+		}
+	}
+
+	for _, s := range []string{"not base64!", "bm90IGpzb24"} {
+		if _, err := decodeCursor(s); err == nil {
+			t.Errorf("decodeCursor(%q) succeeded, want an error", s)
+		}
+	}
+}
+
+func TestCursorKeyset(t *testing.T) {
+	tests := []struct {
+		name     string
+		cursor   productCursor
+		sort     string
+		wantCond string
+		wantArgs []interface{}
+		wantErr  bool
+	}{
+		{
+			name:     "newest",
+			cursor:   productCursor{Sort: "newest", ID: 42},
+			sort:     "newest",
+			wantCond: "id < ?",
+			wantArgs: []interface{}{42},
+		},
+		{
+			name:     "price ascending",
+			cursor:   productCursor{Sort: "price_asc", Value: 9.5, ID: 7},
+			sort:     "price_asc",
+			wantCond: "(" + currentPriceExpr + " > ? OR (" + currentPriceExpr + " = ? AND id > ?))",
+			wantArgs: []interface{}{9.5, 9.5, 7},
+		},
+		{
+			name:     "name descending",
+			cursor:   productCursor{Sort: "name_desc", Value: "Mug", ID: 3},
+			sort:     "name_desc",
+			wantCond: "(name < ? OR (name = ? AND id < ?))",
+			wantArgs: []interface{}{"Mug", "Mug", 3},
+		},
+		{
+			name:    "price sort with a name value",
+			cursor:  productCursor{Sort: "price_asc", Value: "Mug", ID: 3},
+			sort:    "price_asc",
+			wantErr: true,
+		},
+		{
+			name:    "name sort with a price value",
+			cursor:  productCursor{Sort: "name_asc", Value: 9.5, ID: 3},
+			sort:    "name_asc",
+			wantErr: true,
+		},
+		{
+			name:    "name sort without a value",
+			cursor:  productCursor{Sort: "name_asc", ID: 3},
+			sort:    "name_asc",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		cond, args, err := tt.cursor.keyset(productSorts[tt.sort])
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: keyset succeeded, want an error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if cond != tt.wantCond {
+			t.Errorf("%s: condition = %q, want %q", tt.name, cond, tt.wantCond)
+		}
+		if !reflect.DeepEqual(args, tt.wantArgs) {
+			t.Errorf("%s: args = %v, want %v", tt.name, args, tt.wantArgs)
+		}
+	}
+}
+
+func TestParseProductQueryCursor(t *testing.T) {
+	priceCursor := encodeCursor(productCursor{Sort: "price_asc", Value: 9.5, ID: 7})
+	tests := []struct {
+		query   string
+		wantErr string
+	}{
+		{query: "sort=price_asc&cursor=" + priceCursor},
+		{query: "sort=newest&cursor=" + priceCursor, wantErr: "Cursor does not match sort order"},
+		{query: "cursor=garbage!", wantErr: "Invalid cursor"},
+		{query: "sort=name_asc&cursor=" + encodeCursor(productCursor{Sort: "name_asc", Value: 1.0, ID: 1}), wantErr: "Invalid cursor"},
+		{query: "limit=0", wantErr: "Invalid limit"},
+		{query: "sort=cheapest", wantErr: "Invalid sort: cheapest"},
+	}
+	for _, tt := range tests {
+		q, err := parseProductQuery(testContext(tt.query))
+		if tt.wantErr != "" {
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("parseProductQuery(%q) error = %v, want %q", tt.query, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseProductQuery(%q): %v", tt.query, err)
+			continue
+		}
+		if q.Cursor == nil || q.Cursor.ID != 7 {
+			t.Errorf("parseProductQuery(%q) cursor = %+v", tt.query, q.Cursor)
+		}
+	}
+}
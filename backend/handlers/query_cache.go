@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"container/list"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// queryCache is a size-bounded LRU of catalog query results. Entries belong
+// to a catalog generation and are misses once the catalog has moved on.
+// Concurrent misses on a key share one load, so a popular entry expiring
+// does not send every waiting request to MySQL at once.
+type queryCache struct {
+	capacity int
+	ttl      time.Duration
+
+	mu       sync.Mutex
+	entries  map[string]*list.Element
+	order    *list.List // front is most recently used
+	inflight map[string]*queryCall
+	stats    QueryCacheStats
+}
+
+type queryEntry struct {
+	key        string
+	generation int64
+	expires    time.Time
+	value      interface{}
+}
+
+type queryCall struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+}
+
+// QueryCacheStats counts how the catalog query cache has been doing since
+// the server started.
+type QueryCacheStats struct {
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Shared    uint64 `json:"shared"` // misses that waited for another request's load
+	Evictions uint64 `json:"evictions"`
+	Entries   int    `json:"entries"`
+	Capacity  int    `json:"capacity"`
+}
+
+func newQueryCache(capacity int, ttl time.Duration) *queryCache {
+	return &queryCache{
+		capacity: capacity,
+		ttl:      ttl,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+		inflight: make(map[string]*queryCall),
+	}
+}
+
+// get returns the cached value for key in generation, calling load on a
+// miss. Values are shared between requests and must not be modified.
+func (q *queryCache) get(key string, generation int64, load func() (interface{}, error)) (interface{}, error) {
+	q.mu.Lock()
+	if el, ok := q.entries[key]; ok {
+		entry := el.Value.(*queryEntry)
+		if entry.generation == generation && time.Now().Before(entry.expires) {
+			q.order.MoveToFront(el)
+			q.stats.Hits++
+			q.mu.Unlock()
+			return entry.value, nil
+		}
+		q.remove(el)
+	}
+	q.stats.Misses++
+
+	// Loads are keyed by generation too, so a request that starts after an
+	// invalidation never waits on a load that may have read the old catalog
+	callKey := strconv.FormatInt(generation, 36) + ":" + key
+	if call, ok := q.inflight[callKey]; ok {
+		q.stats.Shared++
+		q.mu.Unlock()
+		<-call.done
+		return call.value, call.err
+	}
+	call := &queryCall{done: make(chan struct{})}
+	q.inflight[callKey] = call
+	q.mu.Unlock()
+
+	call.value, call.err = load()
+
+	q.mu.Lock()
+	delete(q.inflight, callKey)
+	if call.err == nil && q.capacity > 0 {
+		q.store(key, generation, call.value)
+	}
+	q.mu.Unlock()
+	close(call.done)
+	return call.value, call.err
+}
+
+func (q *queryCache) store(key string, generation int64, value interface{}) {
+	if el, ok := q.entries[key]; ok {
+		// A newer generation may already have been stored by another load
+		if el.Value.(*queryEntry).generation > generation {
+			return
+		}
+		q.remove(el)
+	}
+	entry := &queryEntry{key: key, generation: generation, expires: time.Now().Add(q.ttl), value: value}
+	q.entries[key] = q.order.PushFront(entry)
+	for q.order.Len() > q.capacity {
+		q.remove(q.order.Back())
+		q.stats.Evictions++
+	}
+}
+
+func (q *queryCache) remove(el *list.Element) {
+	q.order.Remove(el)
+	delete(q.entries, el.Value.(*queryEntry).key)
+}
+
+// clear drops every entry. Loads already running still finish and are
+// stored, but under the generation they started in.
+func (q *queryCache) clear() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.entries = make(map[string]*list.Element)
+	q.order.Init()
+}
+
+func (q *queryCache) snapshot() QueryCacheStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	stats := q.stats
+	stats.Entries = q.order.Len()
+	stats.Capacity = q.capacity
+	return stats
+}
+
+// Fetch returns the result of a catalog query from the cache, running load
+// on a miss. It runs load directly on a nil cache.
+func (cc *CatalogCache) Fetch(key string, load func() (interface{}, error)) (interface{}, error) {
+	if cc == nil || cc.queries == nil {
+		return load()
+	}
+	generation, _ := cc.current()
+	return cc.queries.get(key, generation, load)
+}
+
+// CacheStats reports hits, misses, evictions and size of the catalog query
+// cache.
+func (cc *CatalogCache) CacheStats(c *gin.Context) {
+	c.JSON(http.StatusOK, cc.queries.snapshot())
+}
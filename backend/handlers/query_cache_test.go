@@ -0,0 +1,218 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+)
+
+func TestQueryCacheGenerations(t *testing.T) {
+	q := newQueryCache(10, time.Minute)
+	loads := 0
+	load := func() (interface{}, error) {
+		loads++
+		return loads, nil
+	}
+
+	steps := []struct {
+		key        string
+		generation int64
+		want       int
+	}{
+		{"products?a=1", 1, 1},
+		{"products?a=1", 1, 1},
+		{"products?a=2", 1, 2},
+		{"products?a=1", 2, 3}, // a new generation misses
+		{"products?a=1", 1, 4}, // and the entry for the old one is gone
+		{"products?a=2", 1, 2},
+	}
+	for i, step := range steps {
+		v, err := q.get(step.key, step.generation, load)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != step.want {
+			t.Errorf("step %d: get(%q, %d) = %v, want %d", i, step.key, step.generation, v, step.want)
+		}
+	}
+
+	q.clear()
+	if v, _ := q.get("products?a=2", 1, load); v != 5 {
+		t.Errorf("get after clear = %v, want a fresh load", v)
+	}
+	if stats := q.snapshot(); stats.Hits != 2 || stats.Misses != 5 {
+		t.Errorf("stats = %+v, want 2 hits and 5 misses", stats)
+	}
+}
+
+func TestQueryCacheKeepsNewerGeneration(t *testing.T) {
+	q := newQueryCache(10, time.Minute)
+	// A slow load from before the invalidation finishes last
+	started, release, done := make(chan struct{}), make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		q.get("k", 1, func() (interface{}, error) {
+			close(started)
+			<-release
+			return "old", nil
+		})
+	}()
+	<-started
+	q.get("k", 2, func() (interface{}, error) { return "new", nil })
+	close(release)
+	<-done
+	v, _ := q.get("k", 2, func() (interface{}, error) { return "reloaded", nil })
+	if v != "new" {
+		t.Errorf("get = %v, want the entry of the newer generation", v)
+	}
+}
+
+func TestQueryCacheEviction(t *testing.T) {
+	q := newQueryCache(2, time.Minute)
+	value := func(v string) func() (interface{}, error) {
+		return func() (interface{}, error) { return v, nil }
+	}
+	q.get("a", 1, value("a"))
+	q.get("b", 1, value("b"))
+	q.get("a", 1, value("a2")) // a is now the most recently used
+	q.get("c", 1, value("c"))  // evicts b
+
+	if v, _ := q.get("a", 1, value("a3")); v != "a" {
+		t.Errorf("a = %v, want it kept", v)
+	}
+	if v, _ := q.get("b", 1, value("b2")); v != "b2" {
+		t.Errorf("b = %v, want it evicted", v)
+	}
+	if stats := q.snapshot(); stats.Entries != 2 || stats.Evictions != 2 {
+		t.Errorf("stats = %+v, want 2 entries after 2 evictions", stats)
+	}
+}
+
+func TestQueryCacheExpiry(t *testing.T) {
+	q := newQueryCache(10, 10*time.Millisecond)
+	loads := 0
+	load := func() (interface{}, error) {
+		loads++
+		return loads, nil
+	}
+	q.get("k", 1, load)
+	time.Sleep(20 * time.Millisecond)
+	if v, _ := q.get("k", 1, load); v != 2 {
+		t.Errorf("get after the TTL = %v, want a fresh load", v)
+	}
+}
+
+func TestQueryCacheErrorsNotCached(t *testing.T) {
+	q := newQueryCache(10, time.Minute)
+	if _, err := q.get("k", 1, func() (interface{}, error) { return nil, errors.New("deadlock") }); err == nil {
+		t.Fatal("get swallowed the load error")
+	}
+	if v, err := q.get("k", 1, func() (interface{}, error) { return "ok", nil }); err != nil || v != "ok" {
+		t.Errorf("get after an error = %v, %v; want a fresh load", v, err)
+	}
+}
+
+func TestQueryCacheSharedLoad(t *testing.T) {
+	q := newQueryCache(10, time.Minute)
+	release := make(chan struct{})
+	var mu sync.Mutex
+	loads := 0
+	load := func() (interface{}, error) {
+		mu.Lock()
+		loads++
+		mu.Unlock()
+		<-release
+		return "v", nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q.get("k", 1, load)
+		}()
+	}
+	// A load for a newer generation never waits on one for an older
+	if v, _ := q.get("k", 2, func() (interface{}, error) { return "v2", nil }); v != "v2" {
+		t.Errorf("get in generation 2 = %v", v)
+	}
+	for q.snapshot().Shared < 4 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	if loads != 1 {
+		t.Errorf("%d loads for concurrent misses, want 1", loads)
+	}
+}
+
+// TestListProductsCache checks that product pages are cached per query
+// string and locale, that the filter is only resolved on a miss and that
+// Invalidate drops every page.
+func TestListProductsCache(t *testing.T) {
+	cc, mock, _ := newTestCatalogCache(t)
+	h := &ProductHandler{DB: cc.DB, Logger: cc.Logger, Catalog: cc}
+	router := gin.New()
+	router.GET("/products", h.ListProducts)
+	serve := func(path, lang string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if lang != "" {
+			req.Header.Set("Accept-Language", lang)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	// expectPage expects a miss on a page filtered by attribute 3
+	expectPage := func() {
+		mock.ExpectQuery(`SELECT type FROM attributes WHERE id = \?`).WithArgs(3).
+			WillReturnRows(sqlmock.NewRows([]string{"type"}).AddRow("enum"))
+		mock.ExpectQuery(`SELECT COUNT\(\*\) FROM products`).
+			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+		mock.ExpectQuery(`SELECT .* FROM products WHERE .* LIMIT \?`).
+			WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	}
+
+	mock.ExpectQuery(scheduleQuery).WillReturnRows(sqlmock.NewRows([]string{"t"}).AddRow(nil))
+	expectPage()
+	for i := 0; i < 2; i++ {
+		if w := serve("/products?attr[3]=red", ""); w.Code != http.StatusOK {
+			t.Fatalf("request %d: status %d: %s", i, w.Code, w.Body)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("the second request was not served from the cache: %v", err)
+	}
+
+	// Another locale is another page
+	expectPage()
+	serve("/products?attr[3]=red", "zh-HK")
+	serve("/products?attr[3]=red", "zh-HK")
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("pages in another locale: %v", err)
+	}
+
+	// Errors are not cached
+	for i := 0; i < 2; i++ {
+		mock.ExpectQuery(`SELECT type FROM attributes WHERE id = \?`).WithArgs(9).
+			WillReturnRows(sqlmock.NewRows([]string{"type"}))
+		if w := serve("/products?attr[9]=red", ""); w.Code != http.StatusBadRequest {
+			t.Errorf("unknown attribute: status %d, want 400", w.Code)
+		}
+	}
+
+	cc.Invalidate()
+	mock.ExpectQuery(scheduleQuery).WillReturnRows(sqlmock.NewRows([]string{"t"}).AddRow(nil))
+	expectPage()
+	serve("/products?attr[3]=red", "")
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("page after Invalidate: %v", err)
+	}
+}
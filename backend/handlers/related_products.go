@@ -0,0 +1,210 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"backend/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	defaultRelatedLimit = 8
+	maxRelatedLimit     = 24
+)
+
+// Reasons a product is recommended alongside another.
+const (
+	relatedBoughtTogether = "bought_together"
+	relatedSameCategory   = "same_category"
+)
+
+// RelatedProduct is a recommendation for a product page. CoPurchases is the
+// number of verified orders that contained both products.
+type RelatedProduct struct {
+	models.Product
+	Reason      string `json:"reason"`
+	CoPurchases int    `json:"co_purchases"`
+}
+
+// recordCoPurchases counts a verified order towards every pair of distinct
+// products in it. The upsert itself is not idempotent: callers must run it
+// only once per order, as PayPalWebhookHandler does by calling it in the
+// transaction whose conditional approval only one delivery can pass.
+func recordCoPurchases(tx *gorm.DB, products []models.VerifiedOrderProduct) error {
+	seen := make(map[uint]bool)
+	var ids []uint
+	for _, p := range products {
+		if !seen[p.ProductID] {
+			seen[p.ProductID] = true
+			ids = append(ids, p.ProductID)
+		}
+	}
+	if len(ids) < 2 {
+		return nil
+	}
+
+	now := time.Now().UTC()
+	pairs := make([]models.ProductCoPurchase, 0, len(ids)*(len(ids)-1))
+	for _, a := range ids {
+		for _, b := range ids {
+			if a != b {
+				pairs = append(pairs, models.ProductCoPurchase{ProductID: a, RelatedID: b, Orders: 1, UpdatedAt: now})
+			}
+		}
+	}
+	return tx.Clauses(clause.OnConflict{
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"orders":     gorm.Expr("orders + 1"),
+			"updated_at": now,
+		}),
+	}).Create(&pairs).Error
+}
+
+// loadProductsByID returns the products with the given ids that customers
+// can see, keyed by id.
+func loadProductsByID(db sqlExecer, ids []int) (map[int]models.Product, error) {
+	products := make(map[int]models.Product, len(ids))
+	if len(ids) == 0 {
+		return products, nil
+	}
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+	rows, err := db.Query("SELECT "+productColumns+" FROM products WHERE id IN ("+placeholders+") AND archived_at IS NULL AND "+publishedCond, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		p, err := scanProduct(rows)
+		if err != nil {
+			return nil, err
+		}
+		products[p.ID] = p
+	}
+	return products, rows.Err()
+}
+
+// RelatedProducts recommends products to buy with the one in the URL: those
+// most often bought together with it in verified orders, topped up with
+// well-rated products from the same category when there are too few. It
+// accepts limit (default 8).
+func (h *ProductHandler) RelatedProducts(c *gin.Context) {
+	productID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid product ID"})
+		return
+	}
+	limit := defaultRelatedLimit
+	if s := c.Query("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+			return
+		}
+		limit = min(limit, maxRelatedLimit)
+	}
+
+	var categoryID int
+	if err := h.DB.QueryRow("SELECT catid FROM products WHERE id = ?", productID).Scan(&categoryID); err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	rows, err := h.DB.Query(`SELECT cp.related_id, cp.orders FROM product_co_purchases cp
+		JOIN products p ON p.id = cp.related_id AND p.archived_at IS NULL AND `+publishedCond+`
+		WHERE cp.product_id = ? ORDER BY cp.orders DESC, cp.related_id LIMIT ?`, productID, limit)
+	if err != nil {
+		h.Logger.Printf("Error loading co-purchases: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	var ids []int
+	counts := make(map[int]int)
+	for rows.Next() {
+		var id, orders int
+		if err := rows.Scan(&id, &orders); err != nil {
+			rows.Close()
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		ids = append(ids, id)
+		counts[id] = orders
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	products, err := loadProductsByID(h.DB, ids)
+	if err != nil {
+		h.Logger.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	related := []RelatedProduct{}
+	exclude := []interface{}{productID}
+	for _, id := range ids {
+		if p, ok := products[id]; ok {
+			related = append(related, RelatedProduct{Product: p, Reason: relatedBoughtTogether, CoPurchases: counts[id]})
+			exclude = append(exclude, id)
+		}
+	}
+
+	// Not enough purchase data yet: fill up from the same category,
+	// preferring products in stock with the best reviews
+	if len(related) < limit {
+		placeholders := strings.TrimSuffix(strings.Repeat("?,", len(exclude)), ",")
+		args := append([]interface{}{categoryID}, exclude...)
+		args = append(args, limit-len(related))
+		rows, err := h.DB.Query("SELECT "+productColumns+` FROM products
+			WHERE catid = ? AND archived_at IS NULL AND `+publishedCond+` AND id NOT IN (`+placeholders+`)
+			ORDER BY `+productStockExpr+` > 0 DESC, rating_average DESC, review_count DESC, id DESC LIMIT ?`, args...)
+		if err != nil {
+			h.Logger.Printf("Database error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		defer rows.Close()
+		for rows.Next() {
+			p, err := scanProduct(rows)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+				return
+			}
+			related = append(related, RelatedProduct{Product: p, Reason: relatedSameCategory})
+		}
+		if err := rows.Err(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+	}
+
+	localized := make([]models.Product, len(related))
+	for i := range related {
+		localized[i] = related[i].Product
+	}
+	if err := localizeProducts(h.DB, localized, requestLocale(c)); err != nil {
+		h.Logger.Printf("Error loading translations: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	for i := range related {
+		related[i].Product = localized[i]
+	}
+
+	c.JSON(http.StatusOK, related)
+}
@@ -0,0 +1,382 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"backend/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const maxReviewLength = 5000
+
+// ReviewHandler serves product reviews. Only customers with an approved
+// order containing the product can review it, and reviews stay pending until
+// an admin approves them. With AutoApprove, reviews the screener does not
+// flag are approved straight away.
+type ReviewHandler struct {
+	DB          *gorm.DB
+	Logger      *log.Logger
+	Search      *SearchIndex
+	Screener    *ContentScreener
+	AutoApprove bool
+}
+
+type ReviewRequest struct {
+	Rating int    `json:"rating" binding:"required,min=1,max=5"`
+	Body   string `json:"body"`
+}
+
+// RatingSummary describes the reviews of one product.
+type RatingSummary struct {
+	Average      float64     `json:"average"`
+	Count        int         `json:"count"`
+	Distribution map[int]int `json:"distribution"` // rating -> number of reviews
+}
+
+// maskEmail turns an email address into a reviewer name that does not give
+// the address away, e.g. "jane.doe@example.com" becomes "ja***".
+func maskEmail(email string) string {
+	name, _, _ := strings.Cut(email, "@")
+	runes := []rune(name)
+	if len(runes) > 2 {
+		runes = runes[:2]
+	}
+	return string(runes) + "***"
+}
+
+// isVerifiedBuyer reports whether the user has an approved order that
+// contains the product.
+func isVerifiedBuyer(db *gorm.DB, userID uint, productID int) (bool, error) {
+	var count int64
+	err := db.Table("verified_order_products").
+		Joins("JOIN verified_orders ON verified_orders.id = verified_order_products.verified_order_id").
+		Where("verified_orders.user_id = ? AND verified_orders.status = ? AND verified_order_products.product_id = ?", userID, "approved", productID).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// refreshProductRating recomputes the review summary stored on a product
+// from its approved reviews.
+func refreshProductRating(tx *gorm.DB, productID uint) (float64, int, error) {
+	var summary struct {
+		Average float64
+		Count   int
+	}
+	err := tx.Model(&models.Review{}).Select("COALESCE(AVG(rating), 0) AS average, COUNT(*) AS count").
+		Where("product_id = ? AND status = ?", productID, models.ReviewApproved).Scan(&summary).Error
+	if err != nil {
+		return 0, 0, err
+	}
+	err = tx.Exec("UPDATE products SET rating_average = ?, review_count = ? WHERE id = ?", summary.Average, summary.Count, productID).Error
+	return summary.Average, summary.Count, err
+}
+
+// saveReview writes a review change and the product's new rating in one
+// transaction.
+func (h *ReviewHandler) saveReview(productID uint, change func(tx *gorm.DB) error) error {
+	var average float64
+	var count int
+	err := h.DB.Transaction(func(tx *gorm.DB) error {
+		if err := change(tx); err != nil {
+			return err
+		}
+		var err error
+		average, count, err = refreshProductRating(tx, productID)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if h.Search != nil {
+		h.Search.UpdateRating(int(productID), average, count)
+	}
+	return nil
+}
+
+// parseReviewRequest binds and cleans a review submission, writing the
+// error response itself when it is invalid.
+func parseReviewRequest(c *gin.Context) (ReviewRequest, bool) {
+	var req ReviewRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Rating must be between 1 and 5"})
+		return req, false
+	}
+	req.Body = strings.TrimSpace(req.Body)
+	if len([]rune(req.Body)) > maxReviewLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Review text is too long"})
+		return req, false
+	}
+	return req, true
+}
+
+// ListReviews returns a product's approved reviews, newest first, with its
+// rating summary. It accepts limit and offset. Like the product itself, the
+// reviews of archived and unpublished products are not found.
+func (h *ReviewHandler) ListReviews(c *gin.Context) {
+	productID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid product ID"})
+		return
+	}
+
+	var visible int64
+	err = h.DB.Table("products").Where("id = ? AND archived_at IS NULL AND "+publishedCond, productID).Count(&visible).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if visible == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+		return
+	}
+
+	limit, offset := defaultPageSize, 0
+	if s := c.Query("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+			return
+		}
+		limit = min(limit, maxPageSize)
+	}
+	if s := c.Query("offset"); s != "" {
+		if offset, err = strconv.Atoi(s); err != nil || offset < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid offset"})
+			return
+		}
+	}
+
+	var rows []struct {
+		Rating int
+		Count  int
+	}
+	err = h.DB.Model(&models.Review{}).Select("rating, COUNT(*) AS count").
+		Where("product_id = ? AND status = ?", productID, models.ReviewApproved).Group("rating").Scan(&rows).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	summary := RatingSummary{Distribution: map[int]int{1: 0, 2: 0, 3: 0, 4: 0, 5: 0}}
+	total := 0
+	for _, row := range rows {
+		summary.Distribution[row.Rating] = row.Count
+		summary.Count += row.Count
+		total += row.Rating * row.Count
+	}
+	if summary.Count > 0 {
+		summary.Average = float64(total) / float64(summary.Count)
+	}
+
+	reviews := []models.Review{}
+	err = h.DB.Where("product_id = ? AND status = ?", productID, models.ReviewApproved).Order("created_at DESC, id DESC").
+		Limit(limit).Offset(offset).Find(&reviews).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"reviews": reviews,
+		"summary": summary,
+		"limit":   limit,
+		"offset":  offset,
+	})
+}
+
+// screenReview runs a submitted review through the screener and sets its
+// status. The returned decision, if any, records the outcome and must be
+// saved once the review has an id.
+func (h *ReviewHandler) screenReview(review *models.Review) *models.ModerationDecision {
+	result := h.Screener.Screen(review.Body)
+	review.Flags = strings.Join(result.Flags, ",")
+	if result.Flagged() {
+		review.Status = models.ReviewPending
+		reason := "Automatic screening: " + review.Flags
+		if len(result.Matched) > 0 {
+			reason += " (" + strings.Join(result.Matched, ", ") + ")"
+		}
+		return &models.ModerationDecision{Action: models.ModerationFlagged, Reason: reason}
+	}
+	if h.AutoApprove {
+		review.Status = models.ReviewApproved
+		return &models.ModerationDecision{Action: models.ModerationApproved, Reason: "Automatic screening found nothing"}
+	}
+	review.Status = models.ReviewPending
+	return nil
+}
+
+// saveScreenedReview stores a new or resubmitted review together with the
+// screening decision.
+func (h *ReviewHandler) saveScreenedReview(review *models.Review, decision *models.ModerationDecision) error {
+	return h.saveReview(review.ProductID, func(tx *gorm.DB) error {
+		if err := tx.Save(review).Error; err != nil {
+			return err
+		}
+		if decision == nil {
+			return nil
+		}
+		decision.ReviewID = review.ID
+		return tx.Create(decision).Error
+	})
+}
+
+// CreateReview adds the signed-in user's review of a product. The user must
+// have bought it and may only review it once. The review is screened and
+// held for moderation.
+func (h *ReviewHandler) CreateReview(c *gin.Context) {
+	user := c.MustGet("user").(models.User)
+
+	productID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid product ID"})
+		return
+	}
+	req, ok := parseReviewRequest(c)
+	if !ok {
+		return
+	}
+
+	var exists int64
+	if err := h.DB.Table("products").Where("id = ?", productID).Count(&exists).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if exists == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+		return
+	}
+
+	verified, err := isVerifiedBuyer(h.DB, user.ID, productID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if !verified {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only customers who bought this product can review it"})
+		return
+	}
+
+	var existing int64
+	if err := h.DB.Model(&models.Review{}).Where("product_id = ? AND user_id = ?", productID, user.ID).Count(&existing).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if existing > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "You have already reviewed this product"})
+		return
+	}
+
+	review := models.Review{
+		ProductID: uint(productID),
+		UserID:    user.ID,
+		Author:    maskEmail(user.Email),
+		Rating:    req.Rating,
+		Body:      req.Body,
+	}
+	if err := h.saveScreenedReview(&review, h.screenReview(&review)); err != nil {
+		h.Logger.Printf("Error creating review: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, review)
+}
+
+// loadOwnReview fetches a review of the signed-in user. With allowAdmin,
+// admins may load anybody's review.
+func (h *ReviewHandler) loadOwnReview(c *gin.Context, allowAdmin bool) (models.Review, bool) {
+	user := c.MustGet("user").(models.User)
+
+	var review models.Review
+	reviewID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid review ID"})
+		return review, false
+	}
+	if err := h.DB.First(&review, reviewID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Review not found"})
+			return review, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return review, false
+	}
+	if review.UserID != user.ID && !(allowAdmin && user.Admin) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+		return review, false
+	}
+	return review, true
+}
+
+// UpdateReview changes the rating and text of the user's own review. The
+// changed review goes back through screening and moderation.
+func (h *ReviewHandler) UpdateReview(c *gin.Context) {
+	review, ok := h.loadOwnReview(c, false)
+	if !ok {
+		return
+	}
+	req, ok := parseReviewRequest(c)
+	if !ok {
+		return
+	}
+
+	review.Rating = req.Rating
+	review.Body = req.Body
+	if err := h.saveScreenedReview(&review, h.screenReview(&review)); err != nil {
+		h.Logger.Printf("Error updating review: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, review)
+}
+
+// DeleteReview removes the user's own review. Admins can delete any review;
+// that is recorded as a moderation decision.
+func (h *ReviewHandler) DeleteReview(c *gin.Context) {
+	user := c.MustGet("user").(models.User)
+	review, ok := h.loadOwnReview(c, true)
+	if !ok {
+		return
+	}
+
+	err := h.saveReview(review.ProductID, func(tx *gorm.DB) error {
+		if review.UserID != user.ID {
+			decision := models.ModerationDecision{
+				ReviewID:    review.ID,
+				ModeratorID: &user.ID,
+				Action:      models.ModerationDeleted,
+				OldBody:     review.Body,
+				OldRating:   review.Rating,
+			}
+			if err := tx.Create(&decision).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Delete(&review).Error
+	})
+	if err != nil {
+		h.Logger.Printf("Error deleting review: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// MyReviews lists the signed-in user's reviews with their moderation status.
+func (h *ReviewHandler) MyReviews(c *gin.Context) {
+	user := c.MustGet("user").(models.User)
+
+	reviews := []models.Review{}
+	if err := h.DB.Where("user_id = ?", user.ID).Order("created_at DESC, id DESC").Find(&reviews).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	c.JSON(http.StatusOK, reviews)
+}
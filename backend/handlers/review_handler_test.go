@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+)
+
+func TestListReviewsHidesUnpublishedProducts(t *testing.T) {
+	visibility := regexp.QuoteMeta("SELECT count(*) FROM `products` WHERE id = ? AND archived_at IS NULL AND " + publishedCond)
+	for _, tt := range []struct {
+		name    string
+		visible int
+		want    int
+	}{
+		{name: "published", visible: 1, want: http.StatusOK},
+		{name: "draft, scheduled or archived", visible: 0, want: http.StatusNotFound},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := newMockDB(t)
+			mock.ExpectQuery(visibility).WithArgs(4).
+				WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(tt.visible))
+			if tt.visible > 0 {
+				mock.ExpectQuery("SELECT rating, COUNT\\(\\*\\) AS count FROM `reviews`").
+					WillReturnRows(sqlmock.NewRows([]string{"rating", "count"}).AddRow(5, 2))
+				mock.ExpectQuery("SELECT \\* FROM `reviews` WHERE product_id = \\? AND status = \\?").
+					WillReturnRows(sqlmock.NewRows([]string{"id"}))
+			}
+
+			h := &ReviewHandler{DB: db, Logger: log.New(io.Discard, "", 0)}
+			router := gin.New()
+			router.GET("/products/:id/reviews", h.ListReviews)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("GET", "/products/4/reviews", nil))
+
+			if w.Code != tt.want {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"backend/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// ModerationRequest carries an admin's decision on a review. Body and Rating
+// are only used by EditReview.
+type ModerationRequest struct {
+	Reason string  `json:"reason"`
+	Body   *string `json:"body"`
+	Rating *int    `json:"rating"`
+}
+
+// ModerationQueue lists reviews awaiting a decision, flagged ones first and
+// then oldest first. status=approved|rejected|all widens the list and
+// flagged=true narrows it to flagged reviews. It accepts limit and offset.
+func (h *ReviewHandler) ModerationQueue(c *gin.Context) {
+	query := h.DB.Model(&models.Review{})
+
+	switch status := c.DefaultQuery("status", models.ReviewPending); status {
+	case "all":
+	case models.ReviewPending, models.ReviewApproved, models.ReviewRejected:
+		query = query.Where("status = ?", status)
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid status"})
+		return
+	}
+	if c.Query("flagged") == "true" {
+		query = query.Where("flags <> ''")
+	}
+
+	limit, offset := defaultPageSize, 0
+	var err error
+	if s := c.Query("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+			return
+		}
+		limit = min(limit, maxPageSize)
+	}
+	if s := c.Query("offset"); s != "" {
+		if offset, err = strconv.Atoi(s); err != nil || offset < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid offset"})
+			return
+		}
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	reviews := []models.Review{}
+	err = query.Order("flags = '' ASC, created_at ASC, id ASC").Limit(limit).Offset(offset).Find(&reviews).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"reviews": reviews,
+		"total":   total,
+		"limit":   limit,
+		"offset":  offset,
+	})
+}
+
+// moderate loads the review named in the URL, applies an admin decision to
+// it and records the decision, all in one transaction.
+func (h *ReviewHandler) moderate(c *gin.Context, action string, apply func(review *models.Review, req ModerationRequest, decision *models.ModerationDecision) string) {
+	admin := c.MustGet("user").(models.User)
+
+	reviewID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid review ID"})
+		return
+	}
+	var req ModerationRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+			return
+		}
+	}
+
+	var review models.Review
+	if err := h.DB.First(&review, reviewID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Review not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	decision := models.ModerationDecision{
+		ReviewID:    review.ID,
+		ModeratorID: &admin.ID,
+		Action:      action,
+		Reason:      strings.TrimSpace(req.Reason),
+	}
+	if msg := apply(&review, req, &decision); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+
+	err = h.saveReview(review.ProductID, func(tx *gorm.DB) error {
+		if err := tx.Save(&review).Error; err != nil {
+			return err
+		}
+		return tx.Create(&decision).Error
+	})
+	if err != nil {
+		h.Logger.Printf("Error moderating review %d: %v", review.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, review)
+}
+
+// ApproveReview publishes a review.
+func (h *ReviewHandler) ApproveReview(c *gin.Context) {
+	h.moderate(c, models.ModerationApproved, func(review *models.Review, req ModerationRequest, decision *models.ModerationDecision) string {
+		review.Status = models.ReviewApproved
+		return ""
+	})
+}
+
+// RejectReview hides a review from the storefront. A reason is required so
+// the decision can be explained later.
+func (h *ReviewHandler) RejectReview(c *gin.Context) {
+	h.moderate(c, models.ModerationRejected, func(review *models.Review, req ModerationRequest, decision *models.ModerationDecision) string {
+		if decision.Reason == "" {
+			return "A reason is required to reject a review"
+		}
+		review.Status = models.ReviewRejected
+		return ""
+	})
+}
+
+// EditReview changes the text or rating of a review, for example to remove
+// personal details, without changing its status. The previous content is
+// kept in the moderation log.
+func (h *ReviewHandler) EditReview(c *gin.Context) {
+	h.moderate(c, models.ModerationEdited, func(review *models.Review, req ModerationRequest, decision *models.ModerationDecision) string {
+		if req.Body == nil && req.Rating == nil {
+			return "body or rating is required"
+		}
+		decision.OldBody = review.Body
+		decision.OldRating = review.Rating
+		if req.Body != nil {
+			body := strings.TrimSpace(*req.Body)
+			if len([]rune(body)) > maxReviewLength {
+				return "Review text is too long"
+			}
+			review.Body = body
+		}
+		if req.Rating != nil {
+			if *req.Rating < 1 || *req.Rating > 5 {
+				return "Rating must be between 1 and 5"
+			}
+			review.Rating = *req.Rating
+		}
+		return ""
+	})
+}
+
+// ReviewHistory returns every moderation decision on a review, oldest first.
+func (h *ReviewHandler) ReviewHistory(c *gin.Context) {
+	reviewID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid review ID"})
+		return
+	}
+
+	decisions := []models.ModerationDecision{}
+	if err := h.DB.Where("review_id = ?", reviewID).Order("created_at, id").Find(&decisions).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	c.JSON(http.StatusOK, decisions)
+}
@@ -0,0 +1,401 @@
+package handlers
+
+import (
+	"database/sql"
+	"html"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"backend/models"
+)
+
+const (
+	nameFieldWeight        = 3.0
+	descriptionFieldWeight = 1.0
+	prefixMatchWeight      = 0.5
+	snippetRadius          = 80
+)
+
+// SearchIndex is an in-memory inverted index over product names and
+// descriptions. It does not depend on MySQL FULLTEXT, so it behaves the same
+// on every database. ProductHandler keeps it in sync on create, update and
+// delete.
+type SearchIndex struct {
+	mu       sync.RWMutex
+	docs     map[int]models.Product
+	postings map[string]map[int]float64 // term -> product id -> weighted term frequency
+	terms    []string                   // sorted view of postings keys, for prefix lookups
+	dirty    bool
+}
+
+// SearchResult is a single ranked search hit.
+type SearchResult struct {
+	Product    models.Product    `json:"product"`
+	Score      float64           `json:"score"`
+	Highlights map[string]string `json:"highlights"`
+}
+
+func NewSearchIndex() *SearchIndex {
+	return &SearchIndex{
+		docs:     make(map[int]models.Product),
+		postings: make(map[string]map[int]float64),
+	}
+}
+
+// Load replaces the index contents with every product customers can see,
+// including their translations.
+func (idx *SearchIndex) Load(db *sql.DB) error {
+	rows, err := db.Query("SELECT " + productColumns + " FROM products WHERE archived_at IS NULL AND " + publishedCond)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var products []models.Product
+	for rows.Next() {
+		p, err := scanProduct(rows)
+		if err != nil {
+			return err
+		}
+		products = append(products, p)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if err := loadAllProductTranslations(db, products); err != nil {
+		return err
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.docs = make(map[int]models.Product)
+	idx.postings = make(map[string]map[int]float64)
+	for _, p := range products {
+		idx.add(p)
+	}
+	idx.dirty = true
+	return nil
+}
+
+// Upsert adds a product to the index or replaces its previous entry.
+func (idx *SearchIndex) Upsert(p models.Product) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.remove(p.ID)
+	idx.add(p)
+	idx.dirty = true
+}
+
+// UpdateRating refreshes the review summary of an indexed product.
+func (idx *SearchIndex) UpdateRating(id int, average float64, count int) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if p, ok := idx.docs[id]; ok {
+		p.RatingAverage, p.ReviewCount = average, count
+		idx.docs[id] = p
+	}
+}
+
+// Remove drops a product from the index.
+func (idx *SearchIndex) Remove(id int) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.remove(id)
+	idx.dirty = true
+}
+
+func (idx *SearchIndex) add(p models.Product) {
+	p.Images = nil
+	idx.docs[p.ID] = p
+	for _, term := range tokenize(p.Name) {
+		idx.addPosting(term, p.ID, nameFieldWeight)
+	}
+	for _, term := range tokenize(p.Description) {
+		idx.addPosting(term, p.ID, descriptionFieldWeight)
+	}
+	for _, t := range p.Translations {
+		for _, term := range tokenize(t.Name) {
+			idx.addPosting(term, p.ID, nameFieldWeight)
+		}
+		for _, term := range tokenize(t.Description) {
+			idx.addPosting(term, p.ID, descriptionFieldWeight)
+		}
+	}
+}
+
+// loadAllProductTranslations attaches the translations of every product in
+// one query, for loading the whole index.
+func loadAllProductTranslations(db *sql.DB, products []models.Product) error {
+	byID := make(map[int]*models.Product, len(products))
+	for i := range products {
+		byID[products[i].ID] = &products[i]
+	}
+	rows, err := db.Query("SELECT product_id, locale, name, COALESCE(description, '') FROM product_translations")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var locale string
+		var t models.ProductText
+		if err := rows.Scan(&id, &locale, &t.Name, &t.Description); err != nil {
+			return err
+		}
+		if p, ok := byID[id]; ok {
+			if p.Translations == nil {
+				p.Translations = make(map[string]models.ProductText)
+			}
+			p.Translations[locale] = t
+		}
+	}
+	return rows.Err()
+}
+
+func (idx *SearchIndex) addPosting(term string, id int, weight float64) {
+	docs, ok := idx.postings[term]
+	if !ok {
+		docs = make(map[int]float64)
+		idx.postings[term] = docs
+	}
+	docs[id] += weight
+}
+
+func (idx *SearchIndex) remove(id int) {
+	p, ok := idx.docs[id]
+	if !ok {
+		return
+	}
+	delete(idx.docs, id)
+	terms := append(tokenize(p.Name), tokenize(p.Description)...)
+	for _, t := range p.Translations {
+		terms = append(terms, tokenize(t.Name)...)
+		terms = append(terms, tokenize(t.Description)...)
+	}
+	for _, term := range terms {
+		if docs, ok := idx.postings[term]; ok {
+			delete(docs, id)
+			if len(docs) == 0 {
+				delete(idx.postings, term)
+			}
+		}
+	}
+}
+
+// sortedTerms returns the sorted term list, rebuilding it after writes.
+func (idx *SearchIndex) sortedTerms() []string {
+	idx.mu.RLock()
+	if !idx.dirty {
+		terms := idx.terms
+		idx.mu.RUnlock()
+		return terms
+	}
+	idx.mu.RUnlock()
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if idx.dirty {
+		idx.terms = make([]string, 0, len(idx.postings))
+		for term := range idx.postings {
+			idx.terms = append(idx.terms, term)
+		}
+		sort.Strings(idx.terms)
+		idx.dirty = false
+	}
+	return idx.terms
+}
+
+// Search ranks products matching every token of query in any locale. A token
+// matches a term exactly or as a prefix; prefix matches score lower. It
+// returns the requested window of results, translated into locale, and the
+// total number of matches.
+func (idx *SearchIndex) Search(query, locale string, offset, limit int) ([]SearchResult, int) {
+	tokens := tokenize(query)
+	if len(tokens) == 0 {
+		return []SearchResult{}, 0
+	}
+	terms := idx.sortedTerms()
+
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	total := float64(len(idx.docs))
+	var scores map[int]float64
+	matched := make(map[string]bool)
+	for _, token := range tokens {
+		tokenScores := make(map[int]float64)
+		start := sort.SearchStrings(terms, token)
+		for i := start; i < len(terms) && strings.HasPrefix(terms[i], token); i++ {
+			docs := idx.postings[terms[i]]
+			if len(docs) == 0 {
+				continue
+			}
+			matched[terms[i]] = true
+			weight := 1.0
+			if terms[i] != token {
+				weight = prefixMatchWeight
+			}
+			idf := math.Log(1 + total/float64(len(docs)))
+			for id, tf := range docs {
+				s := weight * idf * (1 + math.Log(tf))
+				if s > tokenScores[id] {
+					tokenScores[id] = s
+				}
+			}
+		}
+
+		// Every token has to match for a product to be returned.
+		if scores == nil {
+			scores = tokenScores
+			continue
+		}
+		for id := range scores {
+			if s, ok := tokenScores[id]; ok {
+				scores[id] += s
+			} else {
+				delete(scores, id)
+			}
+		}
+	}
+
+	results := make([]SearchResult, 0, len(scores))
+	for id, score := range scores {
+		results = append(results, SearchResult{Product: idx.docs[id], Score: score})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Product.ID < results[j].Product.ID
+	})
+
+	count := len(results)
+	if offset >= count {
+		return []SearchResult{}, count
+	}
+	end := offset + limit
+	if end > count {
+		end = count
+	}
+	results = results[offset:end]
+	for i := range results {
+		p := results[i].Product
+		localizeProduct(&p, locale)
+		p.Translations = nil
+		results[i].Product = p
+		results[i].Highlights = map[string]string{
+			"name":        highlight(p.Name, matched, 0),
+			"description": highlight(p.Description, matched, snippetRadius),
+		}
+	}
+	return results, count
+}
+
+func isTokenRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// tokenize lowercases text and splits it into words. Han characters are
+// indexed one per token since Chinese text has no word separators.
+func tokenize(text string) []string {
+	var tokens []string
+	var word strings.Builder
+	flush := func() {
+		if word.Len() > 0 {
+			tokens = append(tokens, word.String())
+			word.Reset()
+		}
+	}
+	for _, r := range strings.ToLower(text) {
+		switch {
+		case unicode.Is(unicode.Han, r):
+			flush()
+			tokens = append(tokens, string(r))
+		case isTokenRune(r):
+			word.WriteRune(r)
+		default:
+			flush()
+		}
+	}
+	flush()
+	return tokens
+}
+
+// highlight HTML-escapes text and wraps every word that matched the query in
+// <mark> tags. With a non-zero radius only a snippet around the first match
+// is returned.
+func highlight(text string, matched map[string]bool, radius int) string {
+	type span struct{ start, end int }
+	var spans []span
+	start := -1
+	for i, r := range text {
+		if unicode.Is(unicode.Han, r) {
+			if start >= 0 {
+				spans = append(spans, span{start, i})
+				start = -1
+			}
+			spans = append(spans, span{i, i + utf8.RuneLen(r)})
+			continue
+		}
+		if isTokenRune(r) {
+			if start < 0 {
+				start = i
+			}
+		} else if start >= 0 {
+			spans = append(spans, span{start, i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		spans = append(spans, span{start, len(text)})
+	}
+
+	var hits []span
+	for _, s := range spans {
+		if matched[strings.ToLower(text[s.start:s.end])] {
+			hits = append(hits, s)
+		}
+	}
+
+	from, to := 0, len(text)
+	if radius > 0 && len(text) > 2*radius {
+		center := 0
+		if len(hits) > 0 {
+			center = hits[0].start
+		}
+		from = max(center-radius, 0)
+		to = min(from+2*radius, len(text))
+		// Snap the window to rune boundaries.
+		for from > 0 && !utf8.RuneStart(text[from]) {
+			from--
+		}
+		for to < len(text) && !utf8.RuneStart(text[to]) {
+			to++
+		}
+	}
+
+	var b strings.Builder
+	if from > 0 {
+		b.WriteString("…")
+	}
+	pos := from
+	for _, s := range hits {
+		if s.start < from || s.end > to {
+			continue
+		}
+		b.WriteString(html.EscapeString(text[pos:s.start]))
+		b.WriteString("<mark>")
+		b.WriteString(html.EscapeString(text[s.start:s.end]))
+		b.WriteString("</mark>")
+		pos = s.end
+	}
+	b.WriteString(html.EscapeString(text[pos:to]))
+	if to < len(text) {
+		b.WriteString("…")
+	}
+	return b.String()
+}
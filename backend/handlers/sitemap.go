@@ -0,0 +1,204 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/xml"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// sitemapMaxURLs is the most URLs the sitemap protocol allows in one file.
+// Past it, /sitemap.xml becomes an index of numbered sitemaps.
+const sitemapMaxURLs = 50000
+
+const sitemapNS = "http://www.sitemaps.org/schemas/sitemap/0.9"
+
+// Sitemap lists the storefront's pages for search engines: the home page,
+// every category and every published product. Links are built against
+// StoreURL.
+type Sitemap struct {
+	DB       *sql.DB
+	Logger   *log.Logger
+	Catalog  *CatalogCache
+	StoreURL string
+}
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"urlset"`
+	Xmlns   string       `xml:"xmlns,attr"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapIndex struct {
+	XMLName  xml.Name     `xml:"sitemapindex"`
+	Xmlns    string       `xml:"xmlns,attr"`
+	Sitemaps []sitemapURL `xml:"sitemap"`
+}
+
+// NewSitemapFromEnv creates a Sitemap for the storefront at STORE_URL.
+func NewSitemapFromEnv(db *sql.DB, logger *log.Logger, catalog *CatalogCache) (*Sitemap, error) {
+	sitemap := &Sitemap{DB: db, Logger: logger, Catalog: catalog}
+	u, err := storeURLFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if u != nil {
+		sitemap.StoreURL = u.String()
+	}
+	return sitemap, nil
+}
+
+// ServeSitemap serves /sitemap.xml: every URL while they fit in one
+// sitemap, otherwise an index of the numbered sitemaps under /sitemaps.
+func (s *Sitemap) ServeSitemap(c *gin.Context) {
+	urls, ok := s.urls(c)
+	if !ok {
+		return
+	}
+	if len(urls) <= sitemapMaxURLs {
+		writeSitemapXML(c, sitemapURLSet{Xmlns: sitemapNS, URLs: urls})
+		return
+	}
+
+	index := sitemapIndex{Xmlns: sitemapNS}
+	for page := 1; (page-1)*sitemapMaxURLs < len(urls); page++ {
+		index.Sitemaps = append(index.Sitemaps, sitemapURL{
+			Loc:     s.StoreURL + "/sitemaps/" + strconv.Itoa(page) + ".xml",
+			LastMod: latestLastMod(sitemapPage(urls, page)),
+		})
+	}
+	writeSitemapXML(c, index)
+}
+
+// ServeSitemapPage serves one numbered sitemap of the index, as in
+// /sitemaps/2.xml.
+func (s *Sitemap) ServeSitemapPage(c *gin.Context) {
+	page, err := strconv.Atoi(strings.TrimSuffix(c.Param("page"), ".xml"))
+	if err != nil || page < 1 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Sitemap not found"})
+		return
+	}
+	urls, ok := s.urls(c)
+	if !ok {
+		return
+	}
+	entries := sitemapPage(urls, page)
+	if len(entries) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Sitemap not found"})
+		return
+	}
+	writeSitemapXML(c, sitemapURLSet{Xmlns: sitemapNS, URLs: entries})
+}
+
+// urls returns every sitemap entry, cached until the catalog changes. It
+// writes the error response itself when it fails.
+func (s *Sitemap) urls(c *gin.Context) ([]sitemapURL, bool) {
+	if s.StoreURL == "" {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "The sitemap needs STORE_URL to be set"})
+		return nil, false
+	}
+	urls, err := s.Catalog.Fetch("sitemap", func() (interface{}, error) {
+		return s.loadURLs()
+	})
+	if err != nil {
+		s.Logger.Printf("Error building sitemap: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return nil, false
+	}
+	return urls.([]sitemapURL), true
+}
+
+// loadURLs lists the home page, then categories and published products by
+// id, so that numbered sitemaps keep their URLs as the catalog grows.
+func (s *Sitemap) loadURLs() ([]sitemapURL, error) {
+	urls := []sitemapURL{{Loc: s.StoreURL + "/"}}
+
+	// The storefront shows a category as the home page filtered to it
+	rows, err := s.DB.Query("SELECT catid, UNIX_TIMESTAMP(updated_at) FROM categories ORDER BY catid")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var id int
+		var updated int64
+		if err := rows.Scan(&id, &updated); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		urls = append(urls, sitemapURL{
+			Loc:     s.StoreURL + "/?categoryId=" + strconv.Itoa(id),
+			LastMod: sitemapTime(updated),
+		})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = s.DB.Query("SELECT id, COALESCE(slug, ''), UNIX_TIMESTAMP(updated_at) FROM products WHERE archived_at IS NULL AND " + publishedCond + " ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var slug string
+		var updated int64
+		if err := rows.Scan(&id, &slug, &updated); err != nil {
+			return nil, err
+		}
+		if slug == "" {
+			slug = strconv.Itoa(id)
+		}
+		urls = append(urls, sitemapURL{
+			Loc:     s.StoreURL + "/products/" + url.PathEscape(slug),
+			LastMod: sitemapTime(updated),
+		})
+	}
+	return urls, rows.Err()
+}
+
+// sitemapPage returns the entries of numbered sitemap page, counting from 1.
+func sitemapPage(urls []sitemapURL, page int) []sitemapURL {
+	start := (page - 1) * sitemapMaxURLs
+	if start >= len(urls) {
+		return nil
+	}
+	return urls[start:min(start+sitemapMaxURLs, len(urls))]
+}
+
+// latestLastMod is the most recent lastmod among entries. W3C datetimes in
+// UTC compare correctly as strings.
+func latestLastMod(urls []sitemapURL) string {
+	latest := ""
+	for _, u := range urls {
+		if u.LastMod > latest {
+			latest = u.LastMod
+		}
+	}
+	return latest
+}
+
+func sitemapTime(unix int64) string {
+	return time.Unix(unix, 0).UTC().Format(time.RFC3339)
+}
+
+func writeSitemapXML(c *gin.Context, v interface{}) {
+	body, err := xml.Marshal(v)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to write sitemap"})
+		return
+	}
+	c.Data(http.StatusOK, "application/xml; charset=utf-8", append([]byte(xml.Header), body...))
+}
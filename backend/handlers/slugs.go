@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"backend/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// slugTable describes where the items of a slug kind live.
+type slugTable struct {
+	table, idColumn, path string
+}
+
+var slugTables = map[string]slugTable{
+	models.SlugProduct:  {table: "products", idColumn: "id", path: "/products/"},
+	models.SlugCategory: {table: "categories", idColumn: "catid", path: "/categories/"},
+}
+
+// assignSlug gives an item a slug made from its name, adding a numeric suffix
+// if another item already has it. An item that already has a slug for the
+// same name keeps it. When the slug changes, the old one is kept as a
+// redirect.
+func assignSlug(tx sqlExecer, kind string, id int, name string) (string, error) {
+	t := slugTables[kind]
+
+	var current sql.NullString
+	err := tx.QueryRow("SELECT slug FROM "+t.table+" WHERE "+t.idColumn+" = ?", id).Scan(&current)
+	if err != nil {
+		return "", err
+	}
+	taken := func(s string) (bool, error) {
+		var taken bool
+		err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM "+t.table+" WHERE slug = ? AND "+t.idColumn+" <> ?)", s, id).Scan(&taken)
+		return taken, err
+	}
+
+	// A suffixed slug is kept while another item still holds the bare one
+	base := models.Slugify(name, kind)
+	if current.Valid && hasSlugSuffix(current.String, base) {
+		used, err := taken(base)
+		if err != nil {
+			return "", err
+		}
+		if used {
+			return current.String, nil
+		}
+	}
+
+	slug, err := models.UniqueSlug(kind, base, taken)
+	if err != nil || (current.Valid && slug == current.String) {
+		return slug, err
+	}
+	if _, err := tx.Exec("UPDATE "+t.table+" SET slug = ? WHERE "+t.idColumn+" = ?", slug, id); err != nil {
+		return "", err
+	}
+
+	// A slug in use always wins over a redirect
+	if _, err := tx.Exec("DELETE FROM slug_redirects WHERE kind = ? AND slug = ?", kind, slug); err != nil {
+		return "", err
+	}
+	if current.Valid && current.String != "" {
+		_, err := tx.Exec(`INSERT INTO slug_redirects (kind, slug, target_id, created_at) VALUES (?, ?, ?, UTC_TIMESTAMP())
+			ON DUPLICATE KEY UPDATE target_id = VALUES(target_id), created_at = VALUES(created_at)`, kind, current.String, id)
+		if err != nil {
+			return "", err
+		}
+	}
+	return slug, nil
+}
+
+// hasSlugSuffix reports whether slug is base with a collision suffix.
+func hasSlugSuffix(slug, base string) bool {
+	suffix, ok := strings.CutPrefix(slug, base+"-")
+	if !ok {
+		return false
+	}
+	n, err := strconv.Atoi(suffix)
+	return err == nil && n >= 2
+}
+
+// resolveSlug maps the id-or-slug in the URL to an item id. When the slug is
+// an old one, it also returns the item's current slug.
+func resolveSlug(db sqlExecer, kind, param string) (id int, redirectTo string, err error) {
+	if id, err := strconv.Atoi(param); err == nil {
+		return id, "", nil
+	}
+	t := slugTables[kind]
+
+	err = db.QueryRow("SELECT "+t.idColumn+" FROM "+t.table+" WHERE slug = ?", param).Scan(&id)
+	if err != sql.ErrNoRows {
+		return id, "", err
+	}
+	err = db.QueryRow(`SELECT t.`+t.idColumn+`, t.slug FROM slug_redirects r
+		JOIN `+t.table+` t ON t.`+t.idColumn+` = r.target_id
+		WHERE r.kind = ? AND r.slug = ? AND t.slug IS NOT NULL`, kind, param).Scan(&id, &redirectTo)
+	return id, redirectTo, err
+}
+
+// setCanonicalLink points a response served under an old slug at the item's
+// current URL. The item itself is still served: the storefront reaches this
+// API under a prefix, so a redirect would send its fetch to the HTML page.
+// The storefront redirects the page using the slug in the response.
+func setCanonicalLink(c *gin.Context, kind, slug string) {
+	c.Header("Link", "<"+slugTables[kind].path+url.PathEscape(slug)+`>; rel="canonical"`)
+}
@@ -0,0 +1,240 @@
+package handlers
+
+import (
+	"fmt"
+	"strings"
+
+	"backend/models"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/text/language"
+)
+
+var localeMatcher = func() language.Matcher {
+	tags := make([]language.Tag, len(models.Locales))
+	for i, l := range models.Locales {
+		tags[i] = language.MustParse(l)
+	}
+	return language.NewMatcher(tags)
+}()
+
+// requestLocale picks the locale to serve: the lang query parameter if it
+// names a supported locale, otherwise the best match for Accept-Language,
+// otherwise models.DefaultLocale. Close variants match, so zh-TW or zh-Hant
+// get zh-HK. It sets the Content-Language and Vary headers to match.
+func requestLocale(c *gin.Context) string {
+	locale := models.DefaultLocale
+	if lang := c.Query("lang"); lang != "" {
+		if l, ok := matchLocale(lang); ok {
+			locale = l
+		}
+	} else if tags, _, err := language.ParseAcceptLanguage(c.GetHeader("Accept-Language")); err == nil && len(tags) > 0 {
+		if _, i, confidence := localeMatcher.Match(tags...); confidence != language.No {
+			locale = models.Locales[i]
+		}
+	}
+	c.Header("Content-Language", locale)
+	addVary(c, "Accept-Language")
+	return locale
+}
+
+func matchLocale(lang string) (string, bool) {
+	tag, err := language.Parse(lang)
+	if err != nil {
+		return "", false
+	}
+	_, i, confidence := localeMatcher.Match(tag)
+	if confidence == language.No {
+		return "", false
+	}
+	return models.Locales[i], true
+}
+
+// translationLocale returns the supported non-default locale a form key
+// names, ignoring case.
+func translationLocale(key string) (string, error) {
+	for _, l := range models.Locales[1:] {
+		if strings.EqualFold(key, l) {
+			return l, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported translation locale %q", key)
+}
+
+// parseProductTranslations reads translated content from form fields named
+// name[<locale>] and description[<locale>]. Only the locales present are
+// returned; an empty ProductText means the translation is to be removed.
+func parseProductTranslations(c *gin.Context) (map[string]models.ProductText, error) {
+	texts := make(map[string]models.ProductText)
+	for key, name := range c.PostFormMap("name") {
+		locale, err := translationLocale(key)
+		if err != nil {
+			return nil, err
+		}
+		t := texts[locale]
+		t.Name = strings.TrimSpace(name)
+		texts[locale] = t
+	}
+	for key, description := range c.PostFormMap("description") {
+		locale, err := translationLocale(key)
+		if err != nil {
+			return nil, err
+		}
+		t := texts[locale]
+		t.Description = strings.TrimSpace(description)
+		texts[locale] = t
+	}
+	return texts, nil
+}
+
+// parseCategoryTranslations reads translated names from form fields named
+// name[<locale>]. An empty name removes the translation.
+func parseCategoryTranslations(c *gin.Context) (map[string]string, error) {
+	names := make(map[string]string)
+	for key, name := range c.PostFormMap("name") {
+		locale, err := translationLocale(key)
+		if err != nil {
+			return nil, err
+		}
+		names[locale] = strings.TrimSpace(name)
+	}
+	return names, nil
+}
+
+// saveProductTranslations stores the given translations of a product. Each
+// locale is replaced as a whole, so a form that sends name[zh-HK] without
+// description[zh-HK] clears the translated description.
+func saveProductTranslations(tx sqlExecer, productID int, texts map[string]models.ProductText) error {
+	for locale, t := range texts {
+		var err error
+		if t == (models.ProductText{}) {
+			_, err = tx.Exec("DELETE FROM product_translations WHERE product_id = ? AND locale = ?", productID, locale)
+		} else {
+			_, err = tx.Exec(`INSERT INTO product_translations (product_id, locale, name, description, created_at, updated_at)
+				VALUES (?, ?, ?, ?, UTC_TIMESTAMP(), UTC_TIMESTAMP())
+				ON DUPLICATE KEY UPDATE name = VALUES(name), description = VALUES(description), updated_at = VALUES(updated_at)`,
+				productID, locale, t.Name, t.Description)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveCategoryTranslations stores the given translated names of a category.
+func saveCategoryTranslations(tx sqlExecer, categoryID int, names map[string]string) error {
+	for locale, name := range names {
+		var err error
+		if name == "" {
+			_, err = tx.Exec("DELETE FROM category_translations WHERE category_id = ? AND locale = ?", categoryID, locale)
+		} else {
+			_, err = tx.Exec(`INSERT INTO category_translations (category_id, locale, name, created_at, updated_at)
+				VALUES (?, ?, ?, UTC_TIMESTAMP(), UTC_TIMESTAMP())
+				ON DUPLICATE KEY UPDATE name = VALUES(name), updated_at = VALUES(updated_at)`,
+				categoryID, locale, name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadProductTranslations fills in the Translations of the given products.
+// With a locale only that locale is loaded, which is all localizeProduct
+// needs; with "" every locale is.
+func loadProductTranslations(db sqlExecer, products []models.Product, locale string) error {
+	if len(products) == 0 || locale == models.DefaultLocale {
+		return nil
+	}
+	byID := make(map[int]*models.Product, len(products))
+	args := make([]interface{}, 0, len(products)+1)
+	for i := range products {
+		byID[products[i].ID] = &products[i]
+		args = append(args, products[i].ID)
+	}
+	query := "SELECT product_id, locale, name, COALESCE(description, '') FROM product_translations WHERE product_id IN (" +
+		strings.TrimSuffix(strings.Repeat("?,", len(products)), ",") + ")"
+	if locale != "" {
+		query += " AND locale = ?"
+		args = append(args, locale)
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var l string
+		var t models.ProductText
+		if err := rows.Scan(&id, &l, &t.Name, &t.Description); err != nil {
+			return err
+		}
+		p := byID[id]
+		if p.Translations == nil {
+			p.Translations = make(map[string]models.ProductText)
+		}
+		p.Translations[l] = t
+	}
+	return rows.Err()
+}
+
+// localizeProduct replaces a product's name and description with their
+// translation into locale where there is one.
+func localizeProduct(p *models.Product, locale string) {
+	t := p.Translations[locale]
+	if t.Name != "" {
+		p.Name = t.Name
+	}
+	if t.Description != "" {
+		p.Description = t.Description
+	}
+}
+
+// localizeProducts translates a list of products for a public response.
+// The translations themselves are left out of the response.
+func localizeProducts(db sqlExecer, products []models.Product, locale string) error {
+	if err := loadProductTranslations(db, products, locale); err != nil {
+		return err
+	}
+	for i := range products {
+		localizeProduct(&products[i], locale)
+		products[i].Translations = nil
+	}
+	return nil
+}
+
+// loadCategoryTranslations returns the translated names of every category,
+// keyed by category id and then locale.
+func loadCategoryTranslations(db sqlExecer) (map[int]map[string]string, error) {
+	rows, err := db.Query("SELECT category_id, locale, name FROM category_translations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := make(map[int]map[string]string)
+	for rows.Next() {
+		var id int
+		var locale, name string
+		if err := rows.Scan(&id, &locale, &name); err != nil {
+			return nil, err
+		}
+		if names[id] == nil {
+			names[id] = make(map[string]string)
+		}
+		names[id][locale] = name
+	}
+	return names, rows.Err()
+}
+
+// localizeCategory replaces a category's name with its translation into
+// locale where there is one.
+func localizeCategory(cat *models.Category, locale string) {
+	if name := cat.Translations[locale]; name != "" {
+		cat.Name = name
+	}
+}
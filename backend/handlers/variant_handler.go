@@ -0,0 +1,512 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"backend/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type VariantHandler struct {
+	DB     *gorm.DB
+	Logger *log.Logger
+}
+
+// variantStockExpr is the stock of a product's variants together, for use in
+// queries on the products table. It is NULL for products without variants.
+const variantStockExpr = "(SELECT SUM(GREATEST(v.stock, 0)) FROM product_variants v WHERE v.product_id = products.id)"
+
+type OptionRequest struct {
+	Name   string   `json:"name" form:"name" binding:"required"`
+	Values []string `json:"values" form:"values" binding:"required,min=1"`
+}
+
+func (h *VariantHandler) productExists(productID int) (bool, error) {
+	var count int64
+	err := h.DB.Table("products").Where("id = ?", productID).Count(&count).Error
+	return count > 0, err
+}
+
+// productVisible reports whether customers may see the product.
+func (h *VariantHandler) productVisible(productID int) (bool, error) {
+	var count int64
+	err := h.DB.Table("products").Where("id = ? AND archived_at IS NULL AND "+publishedCond, productID).Count(&count).Error
+	return count > 0, err
+}
+
+// ListVariants returns the options and variants of a product customers may
+// see.
+func (h *VariantHandler) ListVariants(c *gin.Context) {
+	h.listVariants(c, false)
+}
+
+// PreviewVariants is ListVariants for admins, for products of any status.
+func (h *VariantHandler) PreviewVariants(c *gin.Context) {
+	h.listVariants(c, true)
+}
+
+func (h *VariantHandler) listVariants(c *gin.Context, preview bool) {
+	productID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid product ID"})
+		return
+	}
+
+	found := h.productVisible
+	if preview {
+		found = h.productExists
+	}
+	if ok, err := found(productID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	} else if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+		return
+	}
+
+	options := []models.ProductOption{}
+	err = h.DB.Preload("Values", func(db *gorm.DB) *gorm.DB {
+		return db.Order("position, id")
+	}).Where("product_id = ?", productID).Order("position, id").Find(&options).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	variants := []models.ProductVariant{}
+	if err := h.DB.Preload("OptionValues").Where("product_id = ?", productID).Order("id").Find(&variants).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"options": options, "variants": variants})
+}
+
+// CreateOption adds an option with its values to a product.
+func (h *VariantHandler) CreateOption(c *gin.Context) {
+	productID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid product ID"})
+		return
+	}
+
+	var req OptionRequest
+	if err := c.ShouldBind(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+
+	if exists, err := h.productExists(productID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	} else if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+		return
+	}
+
+	var position int64
+	if err := h.DB.Model(&models.ProductOption{}).Where("product_id = ?", productID).Count(&position).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	option := models.ProductOption{
+		ProductID: uint(productID),
+		Name:      strings.TrimSpace(req.Name),
+		Position:  int(position),
+	}
+	seen := make(map[string]bool)
+	for _, v := range req.Values {
+		v = strings.TrimSpace(v)
+		if v == "" || seen[strings.ToLower(v)] {
+			continue
+		}
+		seen[strings.ToLower(v)] = true
+		option.Values = append(option.Values, models.ProductOptionValue{Value: v, Position: len(option.Values)})
+	}
+	if option.Name == "" || len(option.Values) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Option name and values are required"})
+		return
+	}
+
+	if err := h.DB.Create(&option).Error; err != nil {
+		h.Logger.Printf("Error creating option: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, option)
+}
+
+// DeleteOption removes an option that no variant uses any more.
+func (h *VariantHandler) DeleteOption(c *gin.Context) {
+	optionID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid option ID"})
+		return
+	}
+
+	var inUse int64
+	err = h.DB.Table("variant_option_values").
+		Joins("JOIN product_option_values ON product_option_values.id = variant_option_values.product_option_value_id").
+		Where("product_option_values.option_id = ?", optionID).
+		Count(&inUse).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if inUse > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Option is used by existing variants"})
+		return
+	}
+
+	var rowsAffected int64
+	err = h.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("option_id = ?", optionID).Delete(&models.ProductOptionValue{}).Error; err != nil {
+			return err
+		}
+		res := tx.Delete(&models.ProductOption{}, optionID)
+		rowsAffected = res.RowsAffected
+		return res.Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if rowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Option not found"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// parseOptionValueIDs accepts option_value_ids either repeated or as a
+// comma-separated list.
+func parseOptionValueIDs(c *gin.Context) ([]uint, error) {
+	var ids []uint
+	for _, field := range c.PostFormArray("option_value_ids") {
+		for _, part := range strings.Split(field, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			id, err := strconv.ParseUint(part, 10, 64)
+			if err != nil {
+				return nil, errors.New("Invalid option value ID")
+			}
+			ids = append(ids, uint(id))
+		}
+	}
+	return ids, nil
+}
+
+// loadOptionValues checks that the given values belong to the product and
+// name at most one value per option.
+func (h *VariantHandler) loadOptionValues(productID int, ids []uint) ([]models.ProductOptionValue, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	var values []models.ProductOptionValue
+	err := h.DB.Joins("JOIN product_options ON product_options.id = product_option_values.option_id").
+		Where("product_options.product_id = ? AND product_option_values.id IN ?", productID, ids).
+		Find(&values).Error
+	if err != nil {
+		return nil, err
+	}
+	if len(values) != len(ids) {
+		return nil, errors.New("Option values must belong to the product")
+	}
+	seen := make(map[uint]bool)
+	for _, v := range values {
+		if seen[v.OptionID] {
+			return nil, errors.New("Only one value per option is allowed")
+		}
+		seen[v.OptionID] = true
+	}
+	return values, nil
+}
+
+func optionValueKey(values []models.ProductOptionValue) string {
+	ids := make([]int, len(values))
+	for i, v := range values {
+		ids[i] = int(v.ID)
+	}
+	sort.Ints(ids)
+	parts := make([]string, len(ids))
+	for i, id := range ids {
+		parts[i] = strconv.Itoa(id)
+	}
+	return strings.Join(parts, ",")
+}
+
+// parseVariantFields reads the optional price and stock fields shared by
+// create and update. An empty price clears the override.
+func parseVariantFields(c *gin.Context, variant *models.ProductVariant) error {
+	if s, ok := c.GetPostForm("price"); ok {
+		if s == "" {
+			variant.Price = nil
+		} else {
+			price, err := strconv.ParseFloat(s, 64)
+			if err != nil || price <= 0 {
+				return errors.New("Invalid price")
+			}
+			variant.Price = &price
+		}
+	}
+	if s, ok := c.GetPostForm("stock"); ok {
+		stock, err := strconv.Atoi(s)
+		if err != nil || stock < 0 {
+			return errors.New("Invalid stock")
+		}
+		variant.Stock = stock
+	}
+	return nil
+}
+
+// CreateVariant adds a variant to a product. The multipart form takes sku,
+// option_value_ids and optionally price, stock and an image.
+func (h *VariantHandler) CreateVariant(c *gin.Context) {
+	productID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid product ID"})
+		return
+	}
+
+	if exists, err := h.productExists(productID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	} else if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+		return
+	}
+
+	variant := models.ProductVariant{
+		ProductID: uint(productID),
+		SKU:       strings.TrimSpace(c.PostForm("sku")),
+	}
+	if variant.SKU == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "SKU is required"})
+		return
+	}
+	if err := parseVariantFields(c, &variant); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ids, err := parseOptionValueIDs(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	variant.OptionValues, err = h.loadOptionValues(productID, ids)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Reject a second variant with the same combination of values
+	var existing []models.ProductVariant
+	if err := h.DB.Preload("OptionValues").Where("product_id = ?", productID).Find(&existing).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	key := optionValueKey(variant.OptionValues)
+	for _, v := range existing {
+		if optionValueKey(v.OptionValues) == key {
+			c.JSON(http.StatusConflict, gin.H{"error": "A variant with these options already exists", "variant_id": v.ID})
+			return
+		}
+	}
+
+	var count int64
+	if err := h.DB.Model(&models.ProductVariant{}).Where("sku = ?", variant.SKU).Count(&count).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if count > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "SKU already exists"})
+		return
+	}
+
+	if fileHeader, err := c.FormFile("image"); err == nil {
+		saved, err := saveUploadedImage(fileHeader, h.Logger)
+		if err != nil {
+			respondUploadError(c, h.Logger, err)
+			return
+		}
+		variant.ImageURL = saved.ImageURL
+		variant.ThumbnailURL = saved.ThumbnailURL
+	}
+
+	if err := h.DB.Create(&variant).Error; err != nil {
+		h.Logger.Printf("Error creating variant: %v", err)
+		removeImageFiles(variant.ImageURL, variant.ThumbnailURL)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, variant)
+}
+
+// UpdateVariant changes a variant's sku, price, stock or image. Only the
+// fields posted are written. Like UpdateStock, it takes "delta" as well as
+// "stock", so stock can be adjusted without overwriting units reserved by
+// checkouts in the meantime.
+func (h *VariantHandler) UpdateVariant(c *gin.Context) {
+	variantID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid variant ID"})
+		return
+	}
+
+	var variant models.ProductVariant
+	if err := h.DB.First(&variant, variantID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Variant not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	updates := map[string]interface{}{}
+	if sku, ok := c.GetPostForm("sku"); ok {
+		sku = strings.TrimSpace(sku)
+		if sku == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "SKU is required"})
+			return
+		}
+		if sku != variant.SKU {
+			var count int64
+			if err := h.DB.Model(&models.ProductVariant{}).Where("sku = ? AND id <> ?", sku, variant.ID).Count(&count).Error; err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+				return
+			}
+			if count > 0 {
+				c.JSON(http.StatusConflict, gin.H{"error": "SKU already exists"})
+				return
+			}
+		}
+		updates["sku"] = sku
+	}
+
+	// parseVariantFields only sets what was posted, so compare against a
+	// scratch copy to find those fields
+	posted := variant
+	if err := parseVariantFields(c, &posted); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if _, ok := c.GetPostForm("price"); ok {
+		updates["price"] = posted.Price
+	}
+	delta := 0
+	if _, ok := c.GetPostForm("stock"); ok {
+		updates["stock"] = posted.Stock
+	} else if s, ok := c.GetPostForm("delta"); ok {
+		delta, err = strconv.Atoi(s)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid delta"})
+			return
+		}
+		updates["stock"] = gorm.Expr("stock + ?", delta)
+	}
+
+	var newImages []string
+	if fileHeader, err := c.FormFile("image"); err == nil {
+		saved, err := saveUploadedImage(fileHeader, h.Logger)
+		if err != nil {
+			respondUploadError(c, h.Logger, err)
+			return
+		}
+		newImages = []string{saved.ImageURL, saved.ThumbnailURL}
+		updates["image_url"] = saved.ImageURL
+		updates["thumbnail_url"] = saved.ThumbnailURL
+	}
+
+	if len(updates) > 0 {
+		query := h.DB.Model(&models.ProductVariant{}).Where("id = ?", variant.ID)
+		if delta != 0 {
+			query = query.Where("stock + ? >= 0", delta)
+		}
+		result := query.Updates(updates)
+		if result.Error != nil {
+			h.Logger.Printf("Error updating variant: %v", result.Error)
+			removeImageFiles(newImages...)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		if delta != 0 && result.RowsAffected == 0 {
+			removeImageFiles(newImages...)
+			var stock int
+			h.DB.Model(&models.ProductVariant{}).Where("id = ?", variant.ID).Pluck("stock", &stock)
+			c.JSON(http.StatusConflict, gin.H{"error": "Stock cannot go below zero", "stock": stock})
+			return
+		}
+		if len(newImages) > 0 {
+			removeImageFiles(variant.ImageURL, variant.ThumbnailURL)
+		}
+	}
+
+	if err := h.DB.Preload("OptionValues").First(&variant, variant.ID).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	c.JSON(http.StatusOK, variant)
+}
+
+// DeleteVariant removes a variant. Orders keep the SKU they were placed with.
+// Variants that are part of a bundle cannot be deleted until the bundle no
+// longer uses them. Wishlists saving the variant lose it.
+func (h *VariantHandler) DeleteVariant(c *gin.Context) {
+	variantID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid variant ID"})
+		return
+	}
+
+	var variant models.ProductVariant
+	if err := h.DB.First(&variant, variantID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Variant not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	var bundles int64
+	if err := h.DB.Model(&models.BundleComponent{}).Where("variant_id = ?", variant.ID).Count(&bundles).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if bundles > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Variant is part of a bundle"})
+		return
+	}
+
+	err = h.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&variant).Association("OptionValues").Clear(); err != nil {
+			return err
+		}
+		if err := tx.Where("variant_id = ?", variant.ID).Delete(&models.WishlistItem{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&variant).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	removeImageFiles(variant.ImageURL, variant.ThumbnailURL)
+
+	c.Status(http.StatusNoContent)
+}
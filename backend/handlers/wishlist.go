@@ -0,0 +1,248 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"backend/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// WishlistHandler serves the wishlists of logged-in customers. Its routes
+// sit behind AuthMiddleware.
+type WishlistHandler struct {
+	DB     *gorm.DB
+	Logger *log.Logger
+}
+
+type WishlistRequest struct {
+	ProductID int   `json:"product_id" binding:"required"`
+	VariantID *uint `json:"variant_id"` // Set when the product is sold in variants
+}
+
+type MoveToCartRequest struct {
+	Quantity int `json:"quantity"` // Defaults to 1
+}
+
+// WishlistEntry is a saved product as the wishlist shows it. PriceDropped
+// is set when the product sells for less now than when it was saved.
+type WishlistEntry struct {
+	ID           uint      `json:"id"`
+	ProductID    uint      `json:"product_id"`
+	VariantID    *uint     `json:"variant_id"`
+	Name         string    `json:"name"`
+	Slug         string    `json:"slug"`
+	ThumbnailURL string    `json:"thumbnail_url"`
+	AddedPrice   float64   `json:"added_price"`
+	CurrentPrice float64   `json:"current_price"`
+	PriceChange  float64   `json:"price_change"` // current_price - added_price
+	PriceDropped bool      `json:"price_dropped"`
+	Available    bool      `json:"available"` // Still for sale
+	InStock      bool      `json:"in_stock"`
+	AddedAt      time.Time `json:"added_at"`
+}
+
+// wishlistRow is a wishlist item joined with its product's state now.
+type wishlistRow struct {
+	models.WishlistItem
+	Name         string
+	Slug         string
+	ThumbnailURL string
+	CurrentPrice float64
+	Stock        int
+	Available    bool
+}
+
+// ListWishlist returns the user's wishlist, most recently saved first, with
+// each item's current price against the price when it was saved.
+func (h *WishlistHandler) ListWishlist(c *gin.Context) {
+	user := c.MustGet("user").(models.User)
+
+	var rows []wishlistRow
+	err := h.DB.Table("wishlist_items").
+		Select(`wishlist_items.*, products.name, COALESCE(products.slug, '') AS slug,
+			COALESCE(product_variants.thumbnail_url, products.thumbnail_url) AS thumbnail_url,
+			COALESCE(product_variants.price, (SELECT pp.price `+activeSale+`), products.price) AS current_price,
+			COALESCE(product_variants.stock, `+productStockExpr+`) AS stock,
+			products.archived_at IS NULL AND `+publishedCond+` AS available`).
+		Joins("JOIN products ON products.id = wishlist_items.product_id").
+		Joins("LEFT JOIN product_variants ON product_variants.id = wishlist_items.variant_id").
+		Where("wishlist_items.user_id = ?", user.ID).
+		Order("wishlist_items.created_at DESC, wishlist_items.id DESC").
+		Scan(&rows).Error
+	if err != nil {
+		h.Logger.Printf("Error loading wishlist of user %d: %v", user.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	entries := make([]WishlistEntry, 0, len(rows))
+	for _, row := range rows {
+		change := math.Round((row.CurrentPrice-row.AddedPrice)*100) / 100
+		entries = append(entries, WishlistEntry{
+			ID:           row.ID,
+			ProductID:    row.ProductID,
+			VariantID:    row.VariantID,
+			Name:         row.Name,
+			Slug:         row.Slug,
+			ThumbnailURL: row.ThumbnailURL,
+			AddedPrice:   row.AddedPrice,
+			CurrentPrice: row.CurrentPrice,
+			PriceChange:  change,
+			PriceDropped: change < 0,
+			Available:    row.Available,
+			InStock:      row.Available && row.Stock > 0,
+			AddedAt:      row.CreatedAt,
+		})
+	}
+	c.JSON(http.StatusOK, entries)
+}
+
+// AddToWishlist saves a product, or one of its variants, to the user's
+// wishlist at its current price. Saving it again keeps the original price,
+// so a drop since the first save still shows.
+func (h *WishlistHandler) AddToWishlist(c *gin.Context) {
+	user := c.MustGet("user").(models.User)
+
+	var req WishlistRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+
+	items := []CartItem{{ID: req.ProductID, VariantID: req.VariantID, Quantity: 1}}
+	if err := h.priceItems(items); err != nil {
+		h.respondItemError(c, err)
+		return
+	}
+
+	item := models.WishlistItem{
+		UserID:     user.ID,
+		ProductID:  uint(req.ProductID),
+		VariantID:  req.VariantID,
+		AddedPrice: items[0].Price,
+	}
+	if req.VariantID != nil {
+		item.VariantKey = *req.VariantID
+	}
+	result := h.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&item)
+	if result.Error != nil {
+		h.Logger.Printf("Error saving wishlist item for user %d: %v", user.ID, result.Error)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		err := h.DB.Where("user_id = ? AND product_id = ? AND variant_key = ?", user.ID, item.ProductID, item.VariantKey).First(&item).Error
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		c.JSON(http.StatusOK, item)
+		return
+	}
+	c.JSON(http.StatusCreated, item)
+}
+
+// RemoveFromWishlist deletes an item from the user's wishlist.
+func (h *WishlistHandler) RemoveFromWishlist(c *gin.Context) {
+	user := c.MustGet("user").(models.User)
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid wishlist item ID"})
+		return
+	}
+	result := h.DB.Where("id = ? AND user_id = ?", id, user.ID).Delete(&models.WishlistItem{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Wishlist item not found"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// MoveToCart takes an item off the user's wishlist and returns it as a cart
+// item at today's price, for the storefront to add to its cart. Items that
+// are no longer for sale stay on the wishlist. Stock is checked at checkout.
+func (h *WishlistHandler) MoveToCart(c *gin.Context) {
+	user := c.MustGet("user").(models.User)
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid wishlist item ID"})
+		return
+	}
+	var req MoveToCartRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil || req.Quantity < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+			return
+		}
+	}
+	if req.Quantity == 0 {
+		req.Quantity = 1
+	}
+
+	var item models.WishlistItem
+	if err := h.DB.Where("id = ? AND user_id = ?", id, user.ID).First(&item).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Wishlist item not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	items := []CartItem{{ID: int(item.ProductID), VariantID: item.VariantID, Quantity: req.Quantity}}
+	if err := h.priceItems(items); err != nil {
+		h.respondItemError(c, err)
+		return
+	}
+	if err := h.DB.Table("products").Where("id = ?", item.ProductID).Pluck("name", &items[0].Name).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if err := h.DB.Delete(&item).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	c.JSON(http.StatusOK, items[0])
+}
+
+// priceItems checks that wishlist items can still be bought, the way the
+// checkout does, and prices them as of now.
+func (h *WishlistHandler) priceItems(items []CartItem) error {
+	if err := checkAvailability(h.DB, items); err != nil {
+		return err
+	}
+	if err := resolveVariants(h.DB, items); err != nil {
+		return err
+	}
+	if err := expandBundles(h.DB, items); err != nil {
+		return err
+	}
+	return priceCart(h.DB, items, time.Now())
+}
+
+// respondItemError reports why an item cannot be saved or bought.
+func (h *WishlistHandler) respondItemError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errUnavailableProduct):
+		c.JSON(http.StatusConflict, gin.H{"error": "Product is no longer available"})
+	case errors.Is(err, errUnknownVariant):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		h.Logger.Printf("Error pricing wishlist item: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+	}
+}
@@ -76,10 +76,59 @@ func main() {
 		log.Fatal(err)
 	}
 
+	// Bring the schema up to date
+	if err := models.Migrate(gormDB); err != nil {
+		log.Fatalf("Failed to migrate database: %v", err)
+	}
+
+	// Validators for HTTP caching of the public catalog
+	catalogCache, err := handlers.NewCatalogCacheFromEnv(db, log.Default())
+	if err != nil {
+		log.Fatalf("Failed to load catalog cache settings: %v", err)
+	}
+
+	// Release stock held by orders that were never paid
+	sweeperCtx, stopSweeper := context.WithCancel(context.Background())
+	defer stopSweeper()
+	go handlers.RunReservationSweeper(sweeperCtx, gormDB, time.Minute, catalogCache)
+
 	// Initialize handlers
-	productHandler := &handlers.ProductHandler{DB: db, Logger: log.Default()}
-	categoryHandler := &handlers.CategoryHandler{DB: db, Logger: log.Default()}
+	searchIndex := handlers.NewSearchIndex()
+	if err := searchIndex.Load(db); err != nil {
+		log.Fatalf("Failed to build search index: %v", err)
+	}
+	productHandler := &handlers.ProductHandler{DB: db, Logger: log.Default(), Search: searchIndex, Catalog: catalogCache}
+
+	// Put scheduled products live once their publish time comes
+	go productHandler.RunPublishScheduler(sweeperCtx, time.Minute)
+	categoryHandler := &handlers.CategoryHandler{DB: db, Logger: log.Default(), Catalog: catalogCache}
+	variantHandler := &handlers.VariantHandler{DB: gormDB, Logger: log.Default()}
+	attributeHandler := &handlers.AttributeHandler{DB: gormDB, Logger: log.Default()}
+	screener, err := handlers.NewContentScreenerFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to load moderation settings: %v", err)
+	}
+	reviewHandler := &handlers.ReviewHandler{
+		DB:          gormDB,
+		Logger:      log.Default(),
+		Search:      searchIndex,
+		Screener:    screener,
+		AutoApprove: os.Getenv("MODERATION_AUTO_APPROVE") == "true",
+	}
 	authHandler := &handlers.AuthHandler{DB: gormDB}
+	wishlistHandler := &handlers.WishlistHandler{DB: gormDB, Logger: log.Default()}
+	productFeed, err := handlers.NewProductFeedFromEnv(db, log.Default(), catalogCache)
+	if err != nil {
+		log.Fatalf("Failed to load product feed settings: %v", err)
+	}
+	sitemap, err := handlers.NewSitemapFromEnv(db, log.Default(), catalogCache)
+	if err != nil {
+		log.Fatalf("Failed to load sitemap settings: %v", err)
+	}
+	downloads, err := handlers.NewDownloadsFromEnv(gormDB, log.Default())
+	if err != nil {
+		log.Fatalf("Failed to load download settings: %v", err)
+	}
 
   // Setup routes
   router.GET("/auth/csrf-token", authHandler.GetCSRFToken)
@@ -88,33 +137,99 @@ func main() {
   router.POST("/auth/logout", authHandler.Logout)
   router.POST("/auth/register", authHandler.Register)
   router.POST("/auth/change-password", authHandler.AuthMiddleware(), authHandler.ChangePassword)
+  router.POST("/products/:id/reviews", authHandler.AuthMiddleware(), catalogCache.InvalidateOnWrite(), reviewHandler.CreateReview)
+  router.POST("/reviews/update/:id", authHandler.AuthMiddleware(), catalogCache.InvalidateOnWrite(), reviewHandler.UpdateReview)
+  router.DELETE("/reviews/delete/:id", authHandler.AuthMiddleware(), catalogCache.InvalidateOnWrite(), reviewHandler.DeleteReview)
+  router.GET("/reviews/mine", authHandler.AuthMiddleware(), reviewHandler.MyReviews)
+  router.GET("/downloads/mine", authHandler.AuthMiddleware(), downloads.MyDownloads)
+
+  // Wishlist routes
+  wishlist := router.Group("/wishlist", authHandler.AuthMiddleware())
+  {
+    wishlist.GET("", wishlistHandler.ListWishlist)
+    wishlist.POST("", wishlistHandler.AddToWishlist)
+    wishlist.DELETE("/:id", wishlistHandler.RemoveFromWishlist)
+    wishlist.POST("/:id/move-to-cart", wishlistHandler.MoveToCart)
+  }
   
   // Protected routes
   adminGroup := router.Group("/admin")
-  adminGroup.Use(authHandler.AdminAuthMiddleware())
+  adminGroup.Use(authHandler.AdminAuthMiddleware(), catalogCache.InvalidateOnWrite())
   {
     adminGroup.POST("/products/create", productHandler.CreateProduct)
 	adminGroup.POST("/products/update/:id", productHandler.UpdateProduct)
+	adminGroup.PATCH("/products/update/:id", productHandler.PatchProduct)
     adminGroup.DELETE("/products/delete/:id", productHandler.DeleteProduct)
+    adminGroup.POST("/products/restore/:id", productHandler.RestoreProduct)
+    adminGroup.GET("/products/archived", productHandler.ListArchivedProducts)
+    adminGroup.GET("/products/unpublished", productHandler.ListUnpublishedProducts)
+    adminGroup.GET("/products/all", productHandler.ListAllProducts)
+    adminGroup.GET("/products/preview/:id", productHandler.PreviewProduct)
+    adminGroup.POST("/products/status/:id", productHandler.UpdateProductStatus)
+    adminGroup.DELETE("/products/purge", productHandler.PurgeArchivedProducts)
+    adminGroup.POST("/products/stock/:id", productHandler.UpdateStock)
+    adminGroup.GET("/products/prices/:id", productHandler.PriceHistory)
+    adminGroup.POST("/products/sales/create/:id", productHandler.CreateSale)
+    adminGroup.POST("/products/sales/cancel/:id", productHandler.CancelSale)
+    adminGroup.POST("/products/import", productHandler.ImportProducts)
+    adminGroup.GET("/products/export", productHandler.ExportProducts)
+    adminGroup.POST("/products/images/add/:id", productHandler.AddProductImages)
+    adminGroup.POST("/products/images/reorder/:id", productHandler.ReorderProductImages)
+    adminGroup.POST("/products/images/primary/:id", productHandler.SetPrimaryProductImage)
+    adminGroup.DELETE("/products/images/delete/:id", productHandler.DeleteProductImage)
+    adminGroup.GET("/products/variants/:id", variantHandler.PreviewVariants)
+    adminGroup.POST("/products/options/create/:id", variantHandler.CreateOption)
+    adminGroup.DELETE("/products/options/delete/:id", variantHandler.DeleteOption)
+    adminGroup.POST("/products/variants/create/:id", variantHandler.CreateVariant)
+    adminGroup.POST("/products/variants/update/:id", variantHandler.UpdateVariant)
+    adminGroup.DELETE("/products/variants/delete/:id", variantHandler.DeleteVariant)
+    adminGroup.POST("/products/attributes/set/:id", attributeHandler.SetProductAttributes)
+    adminGroup.POST("/products/bundle/:id", productHandler.SetBundleComponents)
+    adminGroup.POST("/products/file/:id", downloads.UploadProductFile)
+    adminGroup.DELETE("/products/file/:id", downloads.RemoveProductFile)
+    adminGroup.GET("/reviews/moderation", reviewHandler.ModerationQueue)
+    adminGroup.GET("/reviews/history/:id", reviewHandler.ReviewHistory)
+    adminGroup.POST("/reviews/approve/:id", reviewHandler.ApproveReview)
+    adminGroup.POST("/reviews/reject/:id", reviewHandler.RejectReview)
+    adminGroup.POST("/reviews/edit/:id", reviewHandler.EditReview)
     adminGroup.POST("/categories/create", categoryHandler.CreateCategory)
     adminGroup.POST("/categories/update", categoryHandler.UpdateCategory)
     adminGroup.DELETE("/categories/delete", categoryHandler.DeleteCategory)
+    adminGroup.POST("/categories/update/:id", categoryHandler.UpdateCategory)
+    adminGroup.DELETE("/categories/delete/:id", categoryHandler.DeleteCategory)
+    adminGroup.POST("/categories/attributes/create/:id", attributeHandler.CreateAttribute)
+    adminGroup.POST("/categories/attributes/update/:id", attributeHandler.UpdateAttribute)
+    adminGroup.DELETE("/categories/attributes/delete/:id", attributeHandler.DeleteAttribute)
+    adminGroup.DELETE("/categories/attributes/options/delete/:id", attributeHandler.DeleteAttributeOption)
+    adminGroup.GET("/cache/stats", catalogCache.CacheStats)
   }
 
   // Public routes
-  router.GET("/products", productHandler.ListProducts)
-  router.GET("/products/:id", productHandler.GetProduct)
-  router.GET("/products/category", productHandler.GetProductsByCategoryID)
-  router.GET("/categories", categoryHandler.ListCategories)
-  router.GET("/categories/id", categoryHandler.GetCategoryIDByName)
-  router.GET("/categories/:id", categoryHandler.GetCategory)
+  catalog := router.Group("", catalogCache.Conditional())
+  catalog.GET("/products", productHandler.ListProducts)
+  catalog.GET("/products/search", productHandler.SearchProducts)
+  catalog.GET("/products/:id", productHandler.GetProduct)
+  catalog.GET("/products/:id/variants", variantHandler.ListVariants)
+  router.GET("/products/:id/reviews", reviewHandler.ListReviews)
+  catalog.GET("/products/:id/related", productHandler.RelatedProducts)
+  catalog.GET("/products/category", productHandler.GetProductsByCategoryID)
+  catalog.GET("/categories", categoryHandler.ListCategories)
+  catalog.GET("/categories/id", categoryHandler.GetCategoryIDByName)
+  catalog.GET("/categories/tree", categoryHandler.GetCategoryTree)
+  catalog.GET("/categories/:id", categoryHandler.GetCategory)
+  catalog.GET("/categories/:id/attributes", attributeHandler.ListCategoryAttributes)
+  catalog.GET("/feeds/google.xml", productFeed.GoogleFeed)
+  catalog.GET("/feeds/facebook.csv", productFeed.FacebookFeed)
+  catalog.GET("/sitemap.xml", sitemap.ServeSitemap)
+  catalog.GET("/sitemaps/:page", sitemap.ServeSitemapPage)
   router.GET("/health", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{"status": "OK"})
 	})
-	router.POST("/checkout/paypal", gin.WrapH(handlers.CheckoutHandler(gormDB)))
-	router.POST("/paypal/webhook", gin.WrapH(handlers.PayPalWebhookHandler(gormDB)))
+	router.POST("/checkout/paypal", gin.WrapH(handlers.CheckoutHandler(gormDB, catalogCache)))
+	router.POST("/paypal/webhook", gin.WrapH(handlers.PayPalWebhookHandler(gormDB, downloads, catalogCache)))
 	router.GET("/admin/orders", gin.WrapH(handlers.GetOrdersHandler(gormDB)))
 	router.GET("/orders/by-email", gin.WrapH(handlers.GetRecentOrdersByEmailHandler(gormDB)))
+	router.GET("/downloads/:id", downloads.Download)
 
 	// Start server with graceful shutdown
 	server := &http.Server{
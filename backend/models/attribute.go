@@ -0,0 +1,53 @@
+package models
+
+import "time"
+
+// Attribute types
+const (
+	AttributeEnum    = "enum"
+	AttributeNumber  = "number"
+	AttributeBoolean = "boolean"
+)
+
+// Attribute is a typed spec such as "Brand" or "Capacity". It is defined on
+// a category and applies to products in that category and its subcategories.
+type Attribute struct {
+	ID         uint              `json:"id" gorm:"primaryKey"`
+	CategoryID int               `json:"category_id" gorm:"index;not null"`
+	Name       string            `json:"name" gorm:"not null"`
+	Type       string            `json:"type" gorm:"type:varchar(16);not null"`
+	Unit       string            `json:"unit,omitempty"`
+	Position   int               `json:"position"`
+	Options    []AttributeOption `json:"options,omitempty" gorm:"foreignKey:AttributeID;constraint:OnDelete:CASCADE"`
+	CreatedAt  time.Time         `json:"created_at"`
+	UpdatedAt  time.Time         `json:"updated_at"`
+}
+
+// AttributeOption is one allowed value of an enum attribute.
+type AttributeOption struct {
+	ID          uint   `json:"id" gorm:"primaryKey"`
+	AttributeID uint   `json:"attribute_id" gorm:"index;not null"`
+	Value       string `json:"value" gorm:"not null"`
+	Position    int    `json:"position"`
+}
+
+// ProductAttributeValue stores a product's value for one attribute. Exactly
+// one of the value columns is set, matching the attribute type.
+type ProductAttributeValue struct {
+	ID          uint     `json:"id" gorm:"primaryKey"`
+	ProductID   uint     `json:"product_id" gorm:"uniqueIndex:idx_product_attribute;not null"`
+	AttributeID uint     `json:"attribute_id" gorm:"uniqueIndex:idx_product_attribute;index;not null"`
+	OptionID    *uint    `json:"option_id"`
+	NumberValue *float64 `json:"number_value"`
+	BoolValue   *bool    `json:"bool_value"`
+}
+
+// ProductAttribute is the read-only view of an attribute value returned with
+// a product. Value is a string, number or boolean depending on Type.
+type ProductAttribute struct {
+	AttributeID uint        `json:"attribute_id"`
+	Name        string      `json:"name"`
+	Type        string      `json:"type"`
+	Unit        string      `json:"unit,omitempty"`
+	Value       interface{} `json:"value"`
+}
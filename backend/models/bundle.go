@@ -0,0 +1,16 @@
+package models
+
+// BundleComponent is one product that a bundle product is made of, in the
+// quantity one bundle contains. A bundle is an ordinary product row with its
+// own price; it holds no stock of its own but takes its components' stock
+// when it is sold. Bundles do not nest.
+type BundleComponent struct {
+	ID        uint   `json:"id" gorm:"primaryKey"`
+	BundleID  uint   `json:"bundle_id" gorm:"index;not null"`
+	ProductID uint   `json:"product_id" gorm:"index;not null"`
+	VariantID *uint  `json:"variant_id"`
+	Quantity  int    `json:"quantity" gorm:"not null"`
+	Position  int    `json:"position" gorm:"not null;default:0"`
+	Name      string `json:"name" gorm:"-"` // The component product's name, filled in when read
+	SKU       string `json:"sku" gorm:"-"`  // The variant's SKU if one is set, otherwise the product's
+}
@@ -3,8 +3,21 @@ package models
 import "time"
 
 type Category struct {
-	ID        int       `json:"id"`
-	Name      string    `json:"name"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID           int               `json:"id"`
+	Name         string            `json:"name"`
+	Slug         string            `json:"slug"`
+	Translations map[string]string `json:"translations,omitempty"` // Name by locale; see DefaultLocale
+	ParentID     *int              `json:"parent_id"`
+	Version      int               `json:"version"` // Bumped on every edit; see the ETag header
+	Children     []Category        `json:"children,omitempty"`
+	Breadcrumbs  []Breadcrumb      `json:"breadcrumbs,omitempty"` // Path from the root down to this category
+	CreatedAt    time.Time         `json:"created_at"`
+	UpdatedAt    time.Time         `json:"updated_at"`
+}
+
+// Breadcrumb is one step of a category's path from the root of the tree.
+type Breadcrumb struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+	Slug string `json:"slug"`
 }
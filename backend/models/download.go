@@ -0,0 +1,29 @@
+package models
+
+import "time"
+
+// ProductFile is the private file sold with a digital product. It is stored
+// outside the public images and only handed out through signed download
+// links.
+type ProductFile struct {
+	ID          uint      `json:"id" gorm:"primaryKey"`
+	ProductID   uint      `json:"product_id" gorm:"uniqueIndex;not null"`
+	FileName    string    `json:"file_name" gorm:"not null"` // Name the buyer downloads it as
+	StoredName  string    `json:"-" gorm:"not null"`         // Random name on disk
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// DownloadGrant lets the buyer of an approved order download a product's
+// file up to MaxDownloads times until ExpiresAt.
+type DownloadGrant struct {
+	ID           uint      `json:"id" gorm:"primaryKey"`
+	OrderID      uint      `json:"order_id" gorm:"uniqueIndex:idx_download_grants_order_product;not null"`
+	ProductID    uint      `json:"product_id" gorm:"uniqueIndex:idx_download_grants_order_product;not null"`
+	Downloads    int       `json:"downloads" gorm:"not null;default:0"`
+	MaxDownloads int       `json:"max_downloads" gorm:"not null"`
+	ExpiresAt    time.Time `json:"expires_at" gorm:"not null"`
+	CreatedAt    time.Time `json:"created_at"`
+}
@@ -0,0 +1,25 @@
+package models
+
+import "time"
+
+const (
+	ReservationReserved  = "reserved"
+	ReservationCommitted = "committed"
+	ReservationReleased  = "released"
+)
+
+// StockReservation holds units of a product aside for a pending order. The
+// units are taken off products.stock, or product_variants.stock when a
+// variant was ordered, when the reservation is made and put back if it is
+// released.
+type StockReservation struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	OrderID   uint      `json:"order_id" gorm:"index;not null"`
+	ProductID uint      `json:"product_id" gorm:"index;not null"`
+	VariantID *uint     `json:"variant_id" gorm:"index"`
+	Quantity  int       `json:"quantity" gorm:"not null"`
+	Status    string    `json:"status" gorm:"index;not null;default:'reserved'"`
+	ExpiresAt time.Time `json:"expires_at" gorm:"index"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
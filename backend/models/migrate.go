@@ -0,0 +1,165 @@
+package models
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"gorm.io/gorm"
+)
+
+// defaultInitialStock is the stock existing products get when stock
+// tracking is first added. Selling stock nobody has counted would oversell,
+// so they start out of stock unless INITIAL_STOCK says otherwise.
+const defaultInitialStock = 0
+
+// Migrate brings the schema up to date. GORM-managed tables are
+// auto-migrated; the products and categories tables predate GORM (see
+// scripts/init-db.cjs), so new columns on them are added explicitly.
+func Migrate(db *gorm.DB) error {
+	err := db.AutoMigrate(&User{}, &Order{}, &OrderProduct{}, &VerifiedOrder{}, &VerifiedOrderProduct{},
+		&StockReservation{}, &ProductOption{}, &ProductOptionValue{}, &ProductVariant{},
+		&ProductImage{}, &Attribute{}, &AttributeOption{}, &ProductAttributeValue{},
+		&Review{}, &ModerationDecision{}, &ProductPrice{}, &ProductCoPurchase{}, &SlugRedirect{},
+		&ProductTranslation{}, &CategoryTranslation{}, &BundleComponent{},
+		&ProductFile{}, &DownloadGrant{}, &WishlistItem{})
+	if err != nil {
+		return err
+	}
+
+	// Products that predate stock tracking start with INITIAL_STOCK, which
+	// operators set on purpose to keep the catalog sellable until they have
+	// counted it. Adding the column with that default fills them in the
+	// same statement.
+	initialStock := defaultInitialStock
+	if s := os.Getenv("INITIAL_STOCK"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid INITIAL_STOCK: %q", s)
+		}
+		initialStock = n
+	}
+	trackingStock := db.Migrator().HasColumn("products", "stock")
+
+	columns := []struct {
+		table, column, definition string
+	}{
+		{"products", "stock", fmt.Sprintf("INT NOT NULL DEFAULT %d", initialStock)},
+		{"products", "sku", "VARCHAR(64) NULL UNIQUE"},
+		{"products", "archived_at", "DATETIME NULL"},
+		{"products", "rating_average", "DECIMAL(3,2) NOT NULL DEFAULT 0"},
+		{"products", "review_count", "INT NOT NULL DEFAULT 0"},
+		{"products", "slug", "VARCHAR(191) NULL UNIQUE"},
+		{"products", "status", "VARCHAR(16) NOT NULL DEFAULT 'published'"},
+		{"products", "publish_at", "DATETIME NULL"},
+		{"products", "version", "INT NOT NULL DEFAULT 1"},
+		{"products", "updated_at", "TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP"},
+		{"categories", "parent_id", "INT NULL"},
+		{"categories", "slug", "VARCHAR(191) NULL UNIQUE"},
+		{"categories", "version", "INT NOT NULL DEFAULT 1"},
+		{"categories", "updated_at", "TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP"},
+	}
+	for _, col := range columns {
+		if err := addColumn(db, col.table, col.column, col.definition); err != nil {
+			return err
+		}
+	}
+
+	// New products say how much stock they have
+	if !trackingStock {
+		if err := db.Exec("ALTER TABLE products ALTER COLUMN stock SET DEFAULT 0").Error; err != nil {
+			return fmt.Errorf("reset product stock default: %w", err)
+		}
+	}
+
+	// Every product needs a SKU since bulk imports match rows on it
+	if err := db.Exec("UPDATE products SET sku = CONCAT('P', id) WHERE sku IS NULL").Error; err != nil {
+		return fmt.Errorf("backfill product skus: %w", err)
+	}
+
+	// Products created before galleries existed get their single image as
+	// the primary gallery entry.
+	err = db.Exec(`INSERT INTO product_images (product_id, image_url, thumbnail_url, position, is_primary, created_at)
+		SELECT p.id, p.image_url, p.thumbnail_url, 0, TRUE, NOW() FROM products p
+		WHERE p.image_url <> '' AND NOT EXISTS (SELECT 1 FROM product_images i WHERE i.product_id = p.id)`).Error
+	if err != nil {
+		return fmt.Errorf("backfill product images: %w", err)
+	}
+
+	// Start every product's price history with its current price
+	err = db.Exec(`INSERT INTO product_prices (product_id, kind, price, starts_at, created_at)
+		SELECT p.id, 'base', p.price, UTC_TIMESTAMP(), UTC_TIMESTAMP() FROM products p
+		WHERE NOT EXISTS (SELECT 1 FROM product_prices pp WHERE pp.product_id = p.id AND pp.kind = 'base')`).Error
+	if err != nil {
+		return fmt.Errorf("backfill price history: %w", err)
+	}
+
+	// Build the co-purchase counts from the orders verified so far. From then
+	// on the PayPal webhook keeps them up to date.
+	var pairs int64
+	if err := db.Model(&ProductCoPurchase{}).Count(&pairs).Error; err != nil {
+		return fmt.Errorf("count co-purchases: %w", err)
+	}
+	if pairs == 0 {
+		err = db.Exec(`INSERT INTO product_co_purchases (product_id, related_id, orders, updated_at)
+			SELECT a.product_id, b.product_id, COUNT(DISTINCT a.verified_order_id), UTC_TIMESTAMP()
+			FROM verified_order_products a
+			JOIN verified_order_products b ON b.verified_order_id = a.verified_order_id AND b.product_id <> a.product_id
+			JOIN verified_orders vo ON vo.id = a.verified_order_id AND vo.status = 'approved'
+			GROUP BY a.product_id, b.product_id`).Error
+		if err != nil {
+			return fmt.Errorf("backfill co-purchases: %w", err)
+		}
+	}
+
+	if err := backfillSlugs(db, "products", "id", SlugProduct); err != nil {
+		return fmt.Errorf("backfill product slugs: %w", err)
+	}
+	if err := backfillSlugs(db, "categories", "catid", SlugCategory); err != nil {
+		return fmt.Errorf("backfill category slugs: %w", err)
+	}
+	return nil
+}
+
+// backfillSlugs gives every row of a legacy table without a slug one made
+// from its name, oldest rows first so they get the unsuffixed slugs.
+func backfillSlugs(db *gorm.DB, table, idColumn, kind string) error {
+	var rows []struct {
+		ID   int
+		Name string
+	}
+	err := db.Table(table).Select(idColumn + " AS id, name").Where("slug IS NULL").Order(idColumn).Scan(&rows).Error
+	if err != nil || len(rows) == 0 {
+		return err
+	}
+
+	var existing []string
+	if err := db.Table(table).Where("slug IS NOT NULL").Pluck("slug", &existing).Error; err != nil {
+		return err
+	}
+	used := make(map[string]bool, len(existing)+len(rows))
+	for _, slug := range existing {
+		used[slug] = true
+	}
+
+	for _, row := range rows {
+		slug, _ := UniqueSlug(kind, Slugify(row.Name, kind), func(s string) (bool, error) { return used[s], nil })
+		used[slug] = true
+		if err := db.Table(table).Where(idColumn+" = ?", row.ID).Update("slug", slug).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addColumn adds a column to a legacy table unless it already exists.
+func addColumn(db *gorm.DB, table, column, definition string) error {
+	if db.Migrator().HasColumn(table, column) {
+		return nil
+	}
+	sql := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)
+	if err := db.Exec(sql).Error; err != nil {
+		return fmt.Errorf("add column %s.%s: %w", table, column, err)
+	}
+	return nil
+}
@@ -24,6 +24,9 @@ type OrderProduct struct {
 	ID        uint    `json:"id" gorm:"primaryKey"`
 	OrderID   uint    `json:"order_id"`
 	ProductID uint    `json:"product_id"`
-	Quantity  int     `json:"quantity"`
-	Price     float64 `json:"price"` // Price at time of purchase
+	VariantID *uint   `json:"variant_id"`
+	ParentID  *uint   `json:"parent_id"` // Set on a bundle's components, pointing at the bundle's line
+	SKU       string  `json:"sku"`
+	Quantity  int     `json:"quantity"` // For components, the units taken for the whole line
+	Price     float64 `json:"price"` // Price at time of purchase; components are 0, the bundle line carries the price
 }
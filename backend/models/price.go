@@ -0,0 +1,24 @@
+package models
+
+import "time"
+
+// Kinds of ProductPrice entries.
+const (
+	PriceBase = "base"
+	PriceSale = "sale"
+)
+
+// ProductPrice is one entry in a product's price history. Base entries
+// record changes to the regular price from StartsAt on. Sale entries
+// override the regular price between StartsAt and EndsAt unless cancelled.
+// Entries are never deleted, so the history stays complete.
+type ProductPrice struct {
+	ID          uint       `json:"id" gorm:"primaryKey"`
+	ProductID   uint       `json:"product_id" gorm:"index:idx_product_prices_lookup;not null"`
+	Kind        string     `json:"kind" gorm:"type:varchar(8);index:idx_product_prices_lookup;not null"`
+	Price       float64    `json:"price" gorm:"type:decimal(10,2);not null"`
+	StartsAt    time.Time  `json:"starts_at" gorm:"index:idx_product_prices_lookup;not null"`
+	EndsAt      *time.Time `json:"ends_at,omitempty"`
+	CancelledAt *time.Time `json:"cancelled_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
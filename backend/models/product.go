@@ -2,14 +2,38 @@ package models
 
 import "time"
 
+// Product statuses. Only published products, and scheduled ones whose
+// publish time has passed, are shown to customers.
+const (
+	ProductDraft     = "draft"
+	ProductScheduled = "scheduled"
+	ProductPublished = "published"
+)
+
 type Product struct {
 	ID          int       `json:"id"`
+	SKU         string    `json:"sku"`
+	Slug        string    `json:"slug"`
 	CategoryID  int       `json:"catid"`
 	Name        string    `json:"name"`
-	Price       float64   `json:"price"`
+	Price       float64   `json:"price"` // Regular price
+	CurrentPrice float64  `json:"current_price"` // Sale price while a sale runs, otherwise Price
+	WasPrice    *float64  `json:"was_price,omitempty"` // Regular price, set only during a sale
+	SaleEndsAt  *time.Time `json:"sale_ends_at,omitempty"`
 	Description string    `json:"description"`
 	ImageURL    string    `json:"image_url"`
 	ThumbnailURL string   `json:"thumbnail_url"`
+	Stock       int       `json:"stock"`
+	RatingAverage float64 `json:"rating_average"`
+	ReviewCount int       `json:"review_count"`
+	Images      []ProductImage `json:"images,omitempty"`
+	Attributes  []ProductAttribute `json:"attributes,omitempty"`
+	Components  []BundleComponent `json:"components,omitempty"` // Set on bundles; see BundleComponent
+	Translations map[string]ProductText `json:"translations,omitempty"` // Keyed by locale; see DefaultLocale
+	Status      string    `json:"status"`
+	Version     int       `json:"version"` // Bumped on every edit; see the ETag header
+	PublishAt   *time.Time `json:"publish_at,omitempty"` // When a scheduled product goes live, or went live
+	ArchivedAt  *time.Time `json:"archived_at,omitempty"` // Set when the product is withdrawn from sale
 	CreatedAt   time.Time `json:"created_at"`
 	UpdatedAt   time.Time `json:"updated_at"`
 }
@@ -0,0 +1,16 @@
+package models
+
+import "time"
+
+// ProductImage is one entry of a product's ordered gallery. The primary
+// image is mirrored into products.image_url and products.thumbnail_url so
+// listings don't need to join the gallery.
+type ProductImage struct {
+	ID           uint      `json:"id" gorm:"primaryKey"`
+	ProductID    uint      `json:"product_id" gorm:"index;not null"`
+	ImageURL     string    `json:"image_url" gorm:"not null"`
+	ThumbnailURL string    `json:"thumbnail_url" gorm:"not null"`
+	Position     int       `json:"position" gorm:"not null;default:0"`
+	IsPrimary    bool      `json:"is_primary" gorm:"not null;default:false"`
+	CreatedAt    time.Time `json:"created_at"`
+}
@@ -0,0 +1,13 @@
+package models
+
+import "time"
+
+// ProductCoPurchase counts the verified orders that contained both products.
+// Each pair is stored in both directions so a product's neighbours can be
+// read with one index lookup.
+type ProductCoPurchase struct {
+	ProductID uint      `json:"product_id" gorm:"primaryKey;autoIncrement:false"`
+	RelatedID uint      `json:"related_id" gorm:"primaryKey;autoIncrement:false"`
+	Orders    int       `json:"orders" gorm:"not null;default:0"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
@@ -0,0 +1,49 @@
+package models
+
+import "time"
+
+// Review moderation states. Only approved reviews are shown publicly.
+const (
+	ReviewPending  = "pending"
+	ReviewApproved = "approved"
+	ReviewRejected = "rejected"
+)
+
+// Review is a verified buyer's rating of a product. Each user can review a
+// product once.
+type Review struct {
+	ID        uint   `json:"id" gorm:"primaryKey"`
+	ProductID uint   `json:"product_id" gorm:"uniqueIndex:idx_review_product_user;not null"`
+	UserID    uint   `json:"-" gorm:"uniqueIndex:idx_review_product_user;not null"`
+	Author    string `json:"author" gorm:"not null"` // Masked email of the reviewer
+	Rating    int    `json:"rating" gorm:"not null"`
+	Body      string `json:"body" gorm:"type:text"`
+	// Reviews written before moderation existed were already public, hence
+	// the approved default. New reviews are always created as pending.
+	Status    string    `json:"status" gorm:"type:varchar(16);not null;default:approved;index"`
+	Flags     string    `json:"flags,omitempty"` // Comma-separated screening findings
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Moderation actions recorded in ModerationDecision.
+const (
+	ModerationFlagged  = "flagged"
+	ModerationApproved = "approved"
+	ModerationRejected = "rejected"
+	ModerationEdited   = "edited"
+	ModerationDeleted  = "deleted"
+)
+
+// ModerationDecision records one moderation step on a review, whether made
+// by the automatic screener (no moderator) or by an admin.
+type ModerationDecision struct {
+	ID          uint      `json:"id" gorm:"primaryKey"`
+	ReviewID    uint      `json:"review_id" gorm:"index;not null"`
+	ModeratorID *uint     `json:"moderator_id"` // nil for automatic screening
+	Action      string    `json:"action" gorm:"type:varchar(16);not null"`
+	Reason      string    `json:"reason,omitempty" gorm:"type:text"`
+	OldBody     string    `json:"old_body,omitempty" gorm:"type:text"` // Set for edits
+	OldRating   int       `json:"old_rating,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
@@ -0,0 +1,102 @@
+package models
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Kinds of item that have slugs.
+const (
+	SlugProduct  = "product"
+	SlugCategory = "category"
+)
+
+// reservedSlugs are paths the router serves itself next to /products/:slug
+// and /categories/:slug, so no item may take them.
+var reservedSlugs = map[string][]string{
+	SlugProduct:  {"search", "category"},
+	SlugCategory: {"id", "tree"},
+}
+
+// maxSlugLength leaves room under the 191-character column for a "-N"
+// suffix added on collision.
+const maxSlugLength = 80
+
+// SlugRedirect remembers a slug an item used to have, so links to it keep
+// working after a rename.
+type SlugRedirect struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	Kind      string    `json:"kind" gorm:"type:varchar(16);uniqueIndex:idx_slug_redirect;not null"`
+	Slug      string    `json:"slug" gorm:"type:varchar(191);uniqueIndex:idx_slug_redirect;not null"`
+	TargetID  int       `json:"target_id" gorm:"index;not null"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+var stripMarks = transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+
+// Slugify turns a name into a URL path segment: lower case letters and
+// digits separated by single hyphens, with accents removed. Letters outside
+// the Latin alphabet are kept. Names with nothing usable fall back to kind,
+// and all-digit results are prefixed with it so they cannot be mistaken for
+// an ID.
+func Slugify(name, kind string) string {
+	folded, _, err := transform.String(stripMarks, name)
+	if err != nil {
+		folded = name
+	}
+
+	var b strings.Builder
+	hyphen := false
+	length := 0
+	for _, r := range strings.ToLower(folded) {
+		if length >= maxSlugLength {
+			break
+		}
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if hyphen && b.Len() > 0 {
+				b.WriteByte('-')
+				length++
+			}
+			b.WriteRune(r)
+			length++
+			hyphen = false
+		} else {
+			hyphen = true
+		}
+	}
+
+	slug := b.String()
+	if slug == "" {
+		return kind
+	}
+	if strings.Trim(slug, "0123456789") == "" {
+		return kind + "-" + slug
+	}
+	return slug
+}
+
+// UniqueSlug returns base, or base-2, base-3 and so on, whichever is the
+// first that is not reserved and that taken reports as free.
+func UniqueSlug(kind, base string, taken func(slug string) (bool, error)) (string, error) {
+	slug := base
+	for n := 2; ; n++ {
+		used := slices.Contains(reservedSlugs[kind], slug)
+		if !used {
+			var err error
+			if used, err = taken(slug); err != nil {
+				return "", err
+			}
+		}
+		if !used {
+			return slug, nil
+		}
+		slug = base + "-" + strconv.Itoa(n)
+	}
+}
@@ -0,0 +1,64 @@
+package models
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSlugify(t *testing.T) {
+	tests := []struct {
+		name, kind string
+		want       string
+	}{
+		{"Blue Widget", SlugProduct, "blue-widget"},
+		{"  Crème brûlée -- deluxe!  ", SlugProduct, "creme-brulee-deluxe"},
+		{"Kaffee & Kuchen", SlugCategory, "kaffee-kuchen"},
+		{"Ünïcödé", SlugProduct, "unicode"},
+		{"日本茶 Sencha", SlugProduct, "日本茶-sencha"},
+		{"2024", SlugProduct, "product-2024"},
+		{"12 34", SlugCategory, "12-34"},
+		{"!!!", SlugCategory, "category"},
+		{"", SlugProduct, "product"},
+		{"USB-C 3.1 cable", SlugProduct, "usb-c-3-1-cable"},
+	}
+	for _, tt := range tests {
+		if got := Slugify(tt.name, tt.kind); got != tt.want {
+			t.Errorf("Slugify(%q, %q) = %q, want %q", tt.name, tt.kind, got, tt.want)
+		}
+	}
+}
+
+func TestSlugifyLength(t *testing.T) {
+	slug := Slugify(strings.Repeat("ab ", 100), SlugProduct)
+	if len(slug) > maxSlugLength {
+		t.Errorf("slug is %d characters long, want at most %d", len(slug), maxSlugLength)
+	}
+	if strings.HasSuffix(slug, "-") {
+		t.Errorf("slug %q ends in a hyphen", slug)
+	}
+}
+
+func TestUniqueSlug(t *testing.T) {
+	taken := map[string]bool{"widget": true, "widget-2": true}
+	tests := []struct {
+		kind, base string
+		want       string
+	}{
+		{SlugProduct, "gadget", "gadget"},
+		{SlugProduct, "widget", "widget-3"},
+		{SlugProduct, "search", "search-2"},
+		{SlugCategory, "search", "search"},
+		{SlugCategory, "tree", "tree-2"},
+	}
+	for _, tt := range tests {
+		got, err := UniqueSlug(tt.kind, tt.base, func(slug string) (bool, error) {
+			return taken[slug], nil
+		})
+		if err != nil {
+			t.Fatalf("UniqueSlug(%q, %q): %v", tt.kind, tt.base, err)
+		}
+		if got != tt.want {
+			t.Errorf("UniqueSlug(%q, %q) = %q, want %q", tt.kind, tt.base, got, tt.want)
+		}
+	}
+}
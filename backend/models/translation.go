@@ -0,0 +1,40 @@
+package models
+
+import "time"
+
+// DefaultLocale is the language of the name and description columns of
+// products and categories. Translations into other locales are optional and
+// fall back to it field by field.
+const DefaultLocale = "en"
+
+// Locales lists every locale content can be served in, DefaultLocale first.
+var Locales = []string{DefaultLocale, "zh-HK"}
+
+// ProductTranslation holds a product's name and description in one locale
+// other than DefaultLocale. Empty fields fall back to the default text.
+type ProductTranslation struct {
+	ID          uint   `gorm:"primaryKey"`
+	ProductID   uint   `gorm:"uniqueIndex:idx_product_translation;not null"`
+	Locale      string `gorm:"type:varchar(16);uniqueIndex:idx_product_translation;not null"`
+	Name        string `gorm:"not null"`
+	Description string `gorm:"type:text"`
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// CategoryTranslation holds a category's name in one locale other than
+// DefaultLocale.
+type CategoryTranslation struct {
+	ID         uint   `gorm:"primaryKey"`
+	CategoryID uint   `gorm:"uniqueIndex:idx_category_translation;not null"`
+	Locale     string `gorm:"type:varchar(16);uniqueIndex:idx_category_translation;not null"`
+	Name       string `gorm:"not null"`
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+// ProductText is the translatable content of a product in one locale.
+type ProductText struct {
+	Name        string `json:"name,omitempty"`
+	Description string `json:"description,omitempty"`
+}
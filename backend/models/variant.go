@@ -0,0 +1,37 @@
+package models
+
+import "time"
+
+// ProductOption is a dimension a product varies along, such as "Size" or
+// "Colour".
+type ProductOption struct {
+	ID        uint                 `json:"id" gorm:"primaryKey"`
+	ProductID uint                 `json:"product_id" gorm:"index;not null"`
+	Name      string               `json:"name" gorm:"not null"`
+	Position  int                  `json:"position"`
+	Values    []ProductOptionValue `json:"values" gorm:"foreignKey:OptionID;constraint:OnDelete:CASCADE"`
+	CreatedAt time.Time            `json:"created_at"`
+	UpdatedAt time.Time            `json:"updated_at"`
+}
+
+type ProductOptionValue struct {
+	ID       uint   `json:"id" gorm:"primaryKey"`
+	OptionID uint   `json:"option_id" gorm:"index;not null"`
+	Value    string `json:"value" gorm:"not null"`
+	Position int    `json:"position"`
+}
+
+// ProductVariant is a purchasable combination of option values. Price and
+// image fall back to the parent product when unset.
+type ProductVariant struct {
+	ID           uint                 `json:"id" gorm:"primaryKey"`
+	ProductID    uint                 `json:"product_id" gorm:"index;not null"`
+	SKU          string               `json:"sku" gorm:"uniqueIndex;not null;type:varchar(64)"`
+	Price        *float64             `json:"price"`
+	ImageURL     string               `json:"image_url"`
+	ThumbnailURL string               `json:"thumbnail_url"`
+	Stock        int                  `json:"stock" gorm:"not null;default:0"`
+	OptionValues []ProductOptionValue `json:"option_values" gorm:"many2many:variant_option_values"`
+	CreatedAt    time.Time            `json:"created_at"`
+	UpdatedAt    time.Time            `json:"updated_at"`
+}
@@ -23,6 +23,8 @@ type VerifiedOrderProduct struct {
 	UpdatedAt       time.Time
 	VerifiedOrderID uint64  `gorm:"type:bigint unsigned;not null"`
 	ProductID       uint    `gorm:"not null"`
+	VariantID       *uint
+	SKU             string
 	Quantity        int     `gorm:"not null"`
 	Price           float64 `gorm:"not null;type:decimal(10,2)"`
 }
@@ -0,0 +1,19 @@
+package models
+
+import "time"
+
+// WishlistItem is a product a customer saved for later, along with what it
+// sold for when they saved it so price drops can be pointed out. Each user
+// saves a product, or one of its variants, once.
+type WishlistItem struct {
+	ID        uint  `json:"id" gorm:"primaryKey"`
+	UserID    uint  `json:"-" gorm:"uniqueIndex:idx_wishlist_user_item;not null"`
+	ProductID uint  `json:"product_id" gorm:"uniqueIndex:idx_wishlist_user_item;not null"`
+	VariantID *uint `json:"variant_id"`
+	// VariantKey is VariantID with 0 for none, as MySQL lets NULLs repeat
+	// in a unique index
+	VariantKey uint      `json:"-" gorm:"uniqueIndex:idx_wishlist_user_item;not null;default:0"`
+	AddedPrice float64   `json:"added_price" gorm:"type:decimal(10,2);not null"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
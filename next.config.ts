@@ -7,6 +7,16 @@ const nextConfig: NextConfig = {
       {
         source: '/api/:path*',
         destination: 'http://localhost:8080/:path*'
+      },
+      // Sitemaps must be served from the storefront's own paths, as they may
+      // only list URLs below the directory they are served from
+      {
+        source: '/sitemap.xml',
+        destination: 'http://localhost:8080/sitemap.xml'
+      },
+      {
+        source: '/sitemaps/:page',
+        destination: 'http://localhost:8080/sitemaps/:page'
       }
     ]
   },
@@ -5,6 +5,7 @@ import { useState, useEffect } from 'react';
 type Category = {
   id: number;
   name: string;
+  version: number;
 };
 
 export default function CategoryPage() {
@@ -61,7 +62,8 @@ export default function CategoryPage() {
         },
         body: new URLSearchParams({ 
           id: editCategory.id.toString(),
-          name: editCategory.name 
+          name: editCategory.name,
+          version: editCategory.version.toString()
         }),
       });
 
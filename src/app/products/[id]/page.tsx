@@ -7,11 +7,12 @@ import Image from 'next/image';
 import Cart from '@/components/Cart';
 import { Product } from '@/types';
 
-import { useParams } from 'next/navigation';
+import { useParams, useRouter } from 'next/navigation';
 import { useState, useEffect } from 'react';
 
 export default function ProductPage() {
   const params = useParams();
+  const router = useRouter();
   const [product, setProduct] = useState<Product | null>(null);
   const [loading, setLoading] = useState(true);
   const [error, setError] = useState<string | null>(null);
@@ -26,6 +27,10 @@ export default function ProductPage() {
           throw new Error('Failed to fetch product');
         }
         const data = await response.json();
+        // Old slugs still find the product; move the page to its current URL
+        if (data.slug && params.id !== data.slug && params.id !== String(data.id)) {
+          router.replace(`/products/${data.slug}`);
+        }
         setProduct(data);
       } catch (err) {
         setError(err instanceof Error ? err.message : 'Unknown error');
@@ -39,7 +44,7 @@ export default function ProductPage() {
     // 每5秒检查图片更新
     const intervalId = setInterval(fetchProduct, 5000);
     return () => clearInterval(intervalId);
-  }, [params?.id]);
+  }, [params?.id, router]);
 
   if (!params || !params.id) {
     notFound();
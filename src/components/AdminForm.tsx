@@ -18,6 +18,7 @@ export default function AdminForm() {
   const [selectedCategory, setSelectedCategory] = useState<number>(0)
   const [name, setName] = useState('')
   const [price, setPrice] = useState('')
+  const [stock, setStock] = useState('')
   const [description, setDescription] = useState('')
   const [image, setImage] = useState<File | null>(null)
   const [loading, setLoading] = useState(false)
@@ -46,8 +47,17 @@ export default function AdminForm() {
 
   const fetchProducts = async () => {
     try {
-      const response = await axios.get('/api/products')
-      const formattedProducts = response.data.map((product: Product & { catid: string }) => ({
+      // The admin listing includes drafts and scheduled products, which the
+      // public one hides. It is paged; follow next_cursor so every product
+      // can be edited
+      const allProducts: (Product & { catid: string })[] = []
+      let cursor: string | undefined
+      do {
+        const response = await axios.get('/api/admin/products/all', { params: { limit: 100, cursor } })
+        allProducts.push(...response.data.products)
+        cursor = response.data.next_cursor
+      } while (cursor)
+      const formattedProducts = allProducts.map((product) => ({
         ...product,
         image_url: product.image_url,
         category_id: product.catid
@@ -88,6 +98,9 @@ export default function AdminForm() {
       formData.append('price', updatedProduct.price.toString())
       formData.append('description', updatedProduct.description)
       formData.append('category_id', updatedProduct.category_id.toString())
+      if (updatedProduct.version) {
+        formData.append('version', updatedProduct.version.toString())
+      }
       if (image) {
         formData.append('image', image, image.name)
       }
@@ -116,6 +129,7 @@ export default function AdminForm() {
     formData.append('category_id', selectedCategory?.toString() || '')
     formData.append('name', name)
     formData.append('price', parseFloat(price).toString())
+    formData.append('stock', parseInt(stock, 10).toString())
     formData.append('description', description)
     if (image) {
       formData.append('image', image, image.name)
@@ -142,6 +156,7 @@ export default function AdminForm() {
       // 重置表单字段
       setName('')
       setPrice('')
+      setStock('')
       setDescription('')
       setImage(null)
       fetchProducts()
@@ -219,6 +234,19 @@ export default function AdminForm() {
         />
       </div>
 
+      <div>
+        <label className="block text-sm font-medium mb-1">Stock</label>
+        <input
+          type="number"
+          min="0"
+          step="1"
+          value={stock}
+          onChange={(e) => setStock(e.target.value)}
+          className="w-full p-2 border rounded"
+          required
+        />
+      </div>
+
       <div>
         <label className="block text-sm font-medium mb-1">Product Description</label>
         <textarea
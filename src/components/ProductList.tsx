@@ -12,20 +12,33 @@ interface ProductListProps {
 
 export default function ProductList({ categoryId }: ProductListProps) {
   const [products, setProducts] = useState<Product[]>([]);
+  const [nextCursor, setNextCursor] = useState<string | null>(null);
   const [loading, setLoading] = useState(true);
+  const [loadingMore, setLoadingMore] = useState(false);
+
+  // Fetches one page of the listing; the first page when cursor is null
+  const fetchPage = async (cursor: string | null) => {
+    const params = new URLSearchParams();
+    if (categoryId) {
+      params.set('category_id', categoryId);
+    }
+    if (cursor) {
+      params.set('cursor', cursor);
+    }
+    const url = (categoryId ? '/api/products/category' : '/api/products') + '?' + params.toString();
+    const response = await fetch(url);
+    if (!response.ok) {
+      throw new Error('Failed to fetch products');
+    }
+    return response.json();
+  };
 
   useEffect(() => {
     const fetchProducts = async () => {
       try {
-        const url = categoryId 
-          ? `/api/products/category?category_id=${categoryId}`
-          : '/api/products';
-        const response = await fetch(url);
-        if (!response.ok) {
-          throw new Error('Failed to fetch products');
-        }
-        const data = await response.json();
-        setProducts(data);
+        const data = await fetchPage(null);
+        setProducts(data.products);
+        setNextCursor(data.next_cursor || null);
       } catch (error) {
         console.error('Error fetching products:', error);
       } finally {
@@ -33,13 +46,29 @@ export default function ProductList({ categoryId }: ProductListProps) {
       }
     };
     fetchProducts();
+    // eslint-disable-next-line react-hooks/exhaustive-deps
   }, [categoryId]);
 
+  const loadMore = async () => {
+    if (!nextCursor) return;
+    setLoadingMore(true);
+    try {
+      const data = await fetchPage(nextCursor);
+      setProducts((current) => [...current, ...data.products]);
+      setNextCursor(data.next_cursor || null);
+    } catch (error) {
+      console.error('Error fetching products:', error);
+    } finally {
+      setLoadingMore(false);
+    }
+  };
+
   if (loading) {
     return <div>Loading...</div>;
   }
 
   return (
+    <div>
     <div className="grid grid-cols-1 md:grid-cols-2 lg:grid-cols-3 xl:grid-cols-4 gap-6">
       {products.map((product) => (
         <div
@@ -69,5 +98,17 @@ export default function ProductList({ categoryId }: ProductListProps) {
         </div>
       ))}
     </div>
+    {nextCursor && (
+      <div className="flex justify-center mt-8">
+        <button
+          onClick={loadMore}
+          disabled={loadingMore}
+          className="px-6 py-2 text-white bg-blue-500 rounded hover:bg-blue-600 disabled:bg-blue-300"
+        >
+          {loadingMore ? 'Loading...' : 'Load more'}
+        </button>
+      </div>
+    )}
+    </div>
   );
 }
@@ -21,8 +21,15 @@ import axios from 'axios';
 
 export const getProducts = async (): Promise<Product[]> => {
   try {
-    const response = await axios.get('/api/products');
-    return response.data.map((product: Product) => ({
+    // The listing is paged; follow next_cursor to the last page
+    const products: Product[] = [];
+    let cursor: string | undefined;
+    do {
+      const response = await axios.get('/api/products', { params: { limit: 100, cursor } });
+      products.push(...response.data.products);
+      cursor = response.data.next_cursor;
+    } while (cursor);
+    return products.map((product: Product) => ({
       ...product,
       image_url: product.image_url,
       category_id: product.catid
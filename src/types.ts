@@ -6,6 +6,8 @@ export interface Product {
   image_url: string;
   thumbnail_url: string;
   category_id: string;
+  slug?: string;
+  version?: number;
   createdAt?: string;
   updatedAt?: string;
 }